@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// AckLevel selects the acknowledgment of segment writes
+type AckLevel int
+
+const (
+	// AckDefault uses the write concern of the collection
+	AckDefault AckLevel = iota
+	// AckNone does not wait for writes to be acknowledged (w:0).
+	// Failed writes are not reported.
+	AckNone
+	// AckPrimary waits for the primary to acknowledge writes (w:1).
+	// Writes not yet replicated are lost if the primary fails.
+	AckPrimary
+	// AckMajority waits for a majority of the replica set to
+	// acknowledge writes
+	AckMajority
+)
+
+// DefaultVerifyDelay is the default time after a write at which
+// VerifyAfter checks the blob
+var DefaultVerifyDelay = time.Second
+
+// verifyTimeout is the time limit of a verification started by
+// VerifyAfter
+const verifyTimeout = time.Minute
+
+// writeConcern returns the write concern of the acknowledgment level,
+// or nil for AckDefault
+func (level AckLevel) writeConcern() *writeconcern.WriteConcern {
+	switch level {
+	case AckNone:
+		return writeconcern.New(writeconcern.W(0))
+	case AckPrimary:
+		return writeconcern.New(writeconcern.W(1))
+	case AckMajority:
+		return writeconcern.New(writeconcern.WMajority())
+	}
+	return nil
+}
+
+// ackCollection returns the collection segments are written to, with
+// the write concern selected by AckLevel
+func (store *Store) ackCollection() (*mongo.Collection, error) {
+	wc := store.AckLevel.writeConcern()
+	if wc == nil {
+		return store.Collection, nil
+	}
+	return store.Collection.Clone(options.Collection().SetWriteConcern(wc))
+}
+
+// ackError returns the error of a segment write, ignoring the error
+// returned for unacknowledged writes
+func ackError(err error) error {
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return nil
+	}
+	return err
+}
+
+// verifyLater starts verifying the blob written with the given version
+// in the background, if VerifyAfter is set and writes are not
+// acknowledged by a majority. Errors are reported to OnVerifyError.
+// Blobs written again or removed in the meantime are not checked.
+func (store *Store) verifyLater(blobID, version string) {
+	if !store.VerifyAfter || store.OnVerifyError == nil || isInternal(blobID) {
+		return
+	}
+	if store.AckLevel != AckNone && store.AckLevel != AckPrimary {
+		return
+	}
+	delay := store.VerifyDelay
+	if delay <= 0 {
+		delay = DefaultVerifyDelay
+	}
+	time.AfterFunc(delay, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+		defer cancel()
+		hdr, err := store.getHeader(ctx, blobID)
+		if err == nil && (hdr == nil || hdr.Version != version) {
+			return
+		}
+		if err == nil {
+			err = store.Verify(ctx, blobID)
+		}
+		if err != nil {
+			store.OnVerifyError(blobID, err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAckLevelWriteConcern(t *testing.T) {
+	if AckDefault.writeConcern() != nil {
+		t.Errorf("AckDefault should use the collection write concern")
+	}
+	for level, w := range map[AckLevel]interface{}{AckNone: 0, AckPrimary: 1, AckMajority: "majority"} {
+		wc := level.writeConcern()
+		if wc == nil || wc.GetW() != w {
+			t.Errorf("%d: wrong write concern %v", level, wc)
+		}
+	}
+	if AckNone.writeConcern().Acknowledged() {
+		t.Errorf("AckNone writes should not be acknowledged")
+	}
+}
+
+func TestVerifyAfter(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.AckLevel = AckPrimary
+	store.VerifyAfter = true
+	store.VerifyDelay = 100 * time.Millisecond
+	errs := make(chan error, 2)
+	store.OnVerifyError = func(blobID string, err error) {
+		errs <- err
+	}
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "good", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "lost", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// Lose a segment before it is verified
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "lost", "seq": 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost write not reported")
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Unexpected error: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Unacknowledged writes are eventually readable
+	store.AckLevel = AckNone
+	store.VerifyAfter = false
+	if err := store.Write(context.Background(), "fast", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// The segments may still be in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := store.Verify(context.Background(), "fast"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Equal(readBlob(t, store, "fast"), data) {
+		t.Errorf("Wrong data")
+	}
+}
@@ -0,0 +1,146 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Append writes data to the end of the blob. If the blob does not
+// exist, it is created using opts. The segments of an existing blob
+// are kept, and the chunk size, key and codec of the blob are used
+// for the appended data. If the last segment is partial, it is read
+// back and completed, unless WithNewSegment is given. Append is
+// permitted in an append-only store.
+func (store *Store) Append(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	w, err := store.appendWriter(ctx, blobID, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.ReadFrom(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NewAppendWriter returns a writer appending to the end of the blob,
+// so a blob whose write failed can be continued from its last written
+// segment. Data is written as it arrives, as with NewWriter, and Close
+// must be called to complete the blob. The blob is created if it does
+// not exist. Options are as in Append. Abort removes only the data
+// written by the writer, and restores the blob as it was when the
+// writer was opened, so the data committed before is kept.
+func (store *Store) NewAppendWriter(ctx context.Context, blobID string, opts ...WriteOption) (*Writer, error) {
+	return store.appendWriter(ctx, blobID, opts...)
+}
+
+// appendWriter returns a writer positioned at the end of the blob
+func (store *Store) appendWriter(ctx context.Context, blobID string, opts ...WriteOption) (*Writer, error) {
+	if store.WriteOnce {
+		if err := store.checkWritable(ctx, blobID); err != nil {
+			return nil, err
+		}
+	}
+	var size int64
+	last, err := store.lastSegment(ctx, segmentFilter(blobID))
+	switch {
+	case err == nil:
+		size = int64(last.Start + last.N)
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+	var wopts writeOptions
+	for _, opt := range opts {
+		opt(&wopts)
+	}
+	if size == 0 || !wopts.newSegment {
+		w, err := store.resumeWriter(ctx, blobID, size, opts...)
+		if err == nil && size == 0 {
+			w.resumed = &resumePoint{}
+		}
+		return w, err
+	}
+	w, _, err := store.continueWriter(ctx, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	w.seq = last.Seq + 1
+	w.start = uint64(size)
+	w.resumed = &resumePoint{seq: w.seq}
+	if err := w.unseal(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// AppendAt writes data to the blob as new segments starting with
+// segment seq at offset start, for appenders that track the end of the
+// blob themselves. Unlike Append, the last segment is not looked up,
+// so seq and start are not checked: they must be the seq after the
+// last segment of the blob and the size of the blob, otherwise reading
+// the blob fails with ErrCorrupted. Segments at seq and after are
+// replaced, so the last writer wins. In an append-only store, AppendAt
+// returns ErrAppendOnly if a segment at seq or after exists. The
+// chunk size, key and codec of the blob are used as in Append.
+func (store *Store) AppendAt(ctx context.Context, blobID string, seq, start uint64, data io.Reader, opts ...WriteOption) error {
+	if store.WriteOnce {
+		if err := store.checkWritable(ctx, blobID); err != nil {
+			return err
+		}
+	}
+	if store.AppendOnly {
+		n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": seq}}, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrAppendOnly
+		}
+	}
+	w, _, err := store.continueWriter(ctx, blobID, opts...)
+	if err != nil {
+		return err
+	}
+	w.seq = seq
+	w.start = start
+	if err := w.unseal(); err != nil {
+		return err
+	}
+	if _, err := w.ReadFrom(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Compact rewrites the blob with full segments of its chunk size,
+// such as after appends using WithNewSegment. The blob is rewritten
+// as a staged upload, so readers see either the old or the new
+// layout. Compact is permitted in an append-only store, since it does
+// not change the data.
+func (store *Store) Compact(ctx context.Context, blobID string) error {
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	chunkSize, err := store.ChunkSizeOf(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	rd, err := store.read(ctx, blobID, false)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	u, err := store.beginUpload(ctx, blobID, WithChunkSize(chunkSize))
+	if err != nil {
+		return err
+	}
+	u.rewrite = true
+	if _, err := u.w.ReadFrom(rd); err != nil {
+		u.Abort()
+		return err
+	}
+	return u.Commit()
+}
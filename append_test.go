@@ -0,0 +1,251 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAppendNewSegment(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	var data []byte
+	for i := 0; i < 3; i++ {
+		more := randomData(300)
+		data = append(data, more...)
+		if err := store.Append(context.Background(), "1", bytes.NewReader(more), WithNewSegment()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Errorf("Expected 3 segments, got %d", len(segments))
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 900 {
+		t.Errorf("Wrong size: %d %v", size, err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+
+	if err := store.Compact(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	segments, err = store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("Expected 1 segment after compact, got %d", len(segments))
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data after compact")
+	}
+}
+
+func TestAppendWriter(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// A write that failed after some segments were written
+	data := randomData(5000)
+	w, err := store.NewWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:2500]); err != nil {
+		t.Fatal(err)
+	}
+	// The writer did not close, so only full segments are stored
+	size, err := store.Size(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = store.NewAppendWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range [][]byte{data[size:3000], data[3000:]} {
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestAppendWriterAbort(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first blob ends with a partial segment, the second at a
+	// segment boundary
+	for _, size := range []int{2500, 2048} {
+		for _, encrypter := range []Encrypter{nil, enc} {
+			store.Encrypter = encrypter
+			for _, opts := range [][]WriteOption{nil, {WithNewSegment()}} {
+				data := randomData(size)
+				if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+				w, err := store.NewAppendWriter(context.Background(), "1", opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(randomData(3000)); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Abort(); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(readBlob(t, store, "1"), data) {
+					t.Errorf("%d: Wrong data after abort", size)
+				}
+				if got, err := store.Size(context.Background(), "1"); err != nil || got != int64(size) {
+					t.Errorf("%d: Wrong size after abort: %d %v", size, got, err)
+				}
+				if err := store.DeepVerify(context.Background(), "1"); err != nil {
+					t.Errorf("%d: %v", size, err)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendAt(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// Segments of 1500 bytes are split in two by the chunk size
+	var data []byte
+	var seq, start uint64
+	for i := 0; i < 3; i++ {
+		more := randomData(1500)
+		data = append(data, more...)
+		if err := store.AppendAt(context.Background(), "1", seq, start, bytes.NewReader(more)); err != nil {
+			t.Fatal(err)
+		}
+		seq += 2
+		start += 1500
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 4500 {
+		t.Errorf("Wrong size: %d %v", size, err)
+	}
+
+	store.AppendOnly = true
+	if err := store.AppendAt(context.Background(), "1", 4, 3000, bytes.NewReader(randomData(10))); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected ErrAppendOnly, got %v", err)
+	}
+	more := randomData(10)
+	if err := store.AppendAt(context.Background(), "1", seq, start, bytes.NewReader(more)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), append(data, more...)) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestAppendEncrypted(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Encrypter = enc
+
+	appends := map[string]func(more []byte) error{
+		"append": func(more []byte) error {
+			return store.Append(context.Background(), "1", bytes.NewReader(more))
+		},
+		"new segment": func(more []byte) error {
+			return store.Append(context.Background(), "1", bytes.NewReader(more), WithNewSegment())
+		},
+		"append at": func(more []byte) error {
+			return store.AppendAt(context.Background(), "1", 4, 4096, bytes.NewReader(more))
+		},
+		"append writer": func(more []byte) error {
+			w, err := store.NewAppendWriter(context.Background(), "1")
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(more); err != nil {
+				return err
+			}
+			return w.Close()
+		},
+	}
+	for name, appendData := range appends {
+		// The blob ends at a segment boundary, so its last segment is
+		// kept by the append
+		data := randomData(4096)
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		more := randomData(1500)
+		if err := appendData(more); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(readBlob(t, store, "1"), append(data, more...)) {
+			t.Errorf("%s: Wrong data", name)
+		}
+
+		// Cut the blob back to its length before the append
+		if _, err := store.Collection.DeleteMany(context.Background(), bson.M{"blobId": "1", "seq": bson.M{"$gte": 4}}); err != nil {
+			t.Fatal(err)
+		}
+		rd, err := store.Read(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(rd); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: Expected ErrCorrupted, got %v", name, err)
+		}
+		rd.Close()
+	}
+}
+
+func TestChunkSizeOf(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000)), WithChunkSize(512)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.ChunkSizeOf(context.Background(), "1"); err != nil || n != 512 {
+		t.Errorf("Wrong chunk size: %d %v", n, err)
+	}
+	// Without a header, the chunk size is inferred from the first
+	// segment
+	if _, err := store.Collection.DeleteOne(context.Background(), headerFilter("1")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.ChunkSizeOf(context.Background(), "1"); err != nil || n != 512 {
+		t.Errorf("Wrong inferred chunk size: %d %v", n, err)
+	}
+	if err := store.Compact(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.ChunkSizeOf(context.Background(), "1"); err != nil || n != 512 {
+		t.Errorf("Wrong chunk size after compact: %d %v", n, err)
+	}
+}
@@ -0,0 +1,211 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BatchError is returned by WriteBatch if some of the blobs could not
+// be written. The other blobs are written.
+type BatchError struct {
+	// Errors are the errors of the blobs that failed, by blob ID
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, id+": "+e.Errors[id].Error())
+	}
+	return fmt.Sprintf("%d blobs failed: %s", len(ids), strings.Join(msgs, "; "))
+}
+
+// batch collects the write models of WriteBatch, and the blob each
+// model belongs to
+type batch struct {
+	models []mongo.WriteModel
+	ids    []string
+	bytes  int
+}
+
+func (b *batch) add(blobID string, model mongo.WriteModel, n int) {
+	b.models = append(b.models, model)
+	b.ids = append(b.ids, blobID)
+	b.bytes += n
+}
+
+// addAll adds the models of other to the batch
+func (b *batch) addAll(other batch) {
+	b.models = append(b.models, other.models...)
+	b.ids = append(b.ids, other.ids...)
+	b.bytes += other.bytes
+}
+
+// maxInFlight returns the number of bytes WriteBatch buffers
+func (store *Store) maxInFlight() int {
+	if store.MaxInFlightBytes > 0 {
+		return store.MaxInFlightBytes
+	}
+	return copyBatchBytes
+}
+
+// WriteBatch writes many blobs, sending the segments and headers of
+// the blobs in bulk writes instead of writing each blob separately.
+// This is much faster than Write for many small blobs. Segments of the
+// previous versions of the blobs beyond their new ends are removed. If
+// some blobs fail, the others are still written, and a *BatchError
+// listing the failed blobs is returned. A failed blob can be partially
+// written. At most MaxInFlightBytes of encoded segments are buffered
+// between bulk writes. If the store detects conflicts or has a chunk
+// collection, the blobs are written one by one.
+func (store *Store) WriteBatch(ctx context.Context, blobs map[string]io.Reader) error {
+	ids := make([]string, 0, len(blobs))
+	for id := range blobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failed := map[string]error{}
+	if store.DetectConflicts || store.ChunkCollection != nil {
+		for _, id := range ids {
+			if err := store.Write(ctx, id, blobs[id]); err != nil {
+				failed[id] = err
+			}
+		}
+	} else {
+		var b batch
+		for _, id := range ids {
+			if err := store.batchBlob(ctx, &b, id, blobs[id], failed); err != nil {
+				failed[id] = err
+			}
+			if b.bytes >= store.maxInFlight() {
+				if err := store.writeBatch(ctx, &b, failed); err != nil {
+					return err
+				}
+			}
+		}
+		if err := store.writeBatch(ctx, &b, failed); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// batchBlob adds the write models of a blob to the batch. The models
+// are added only if the blob data can be read and encoded, unless the
+// blob exceeds MaxInFlightBytes, in which case the batch is written
+// while the blob is read.
+func (store *Store) batchBlob(ctx context.Context, b *batch, blobID string, data io.Reader, failed map[string]error) error {
+	if err := store.checkWritable(ctx, blobID); err != nil {
+		return err
+	}
+	w, err := store.openWriter(ctx, blobID, blobID)
+	if err != nil {
+		return err
+	}
+	data = store.progressReader(data)
+	var blob batch
+	// A chunk is encoded when the next one is read, so the last chunk
+	// is known when it is encoded
+	var pending []byte
+	addSegment := func(chunk []byte, final bool) error {
+		if err := w.checkChunks(w.seq); err != nil {
+			return err
+		}
+		segment, err := w.encode(w.seq, w.start, chunk, final)
+		if err != nil {
+			return err
+		}
+		blob.add(blobID, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"blobId": blobID, "seq": segment.Seq}).
+			SetReplacement(segment).
+			SetUpsert(true), len(segment.Data))
+		w.advance(segment, chunk)
+		if b.bytes+blob.bytes >= store.maxInFlight() {
+			b.addAll(blob)
+			blob = batch{}
+			if err := store.writeBatch(ctx, b, failed); err != nil {
+				return err
+			}
+			if err, ok := failed[blobID]; ok {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		n, rerr := io.ReadFull(data, w.buf[:w.chunkSize])
+		if n > 0 {
+			if pending != nil {
+				if err := addSegment(pending, false); err != nil {
+					return err
+				}
+			}
+			// The segment can refer to its data, so it is not
+			// encoded from the reused buffer
+			pending = append([]byte(nil), w.buf[:n]...)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if pending != nil {
+		if err := addSegment(pending, true); err != nil {
+			return err
+		}
+	}
+	blob.add(blobID, mongo.NewDeleteManyModel().
+		SetFilter(bson.M{"blobId": blobID, "seq": bson.M{"$gte": w.seq}}), 0)
+	update, err := w.headerUpdate()
+	if err != nil {
+		return err
+	}
+	blob.add(blobID, mongo.NewUpdateOneModel().
+		SetFilter(headerFilter(blobID)).
+		SetUpdate(update).
+		SetUpsert(true), 0)
+	b.addAll(blob)
+	return nil
+}
+
+// writeBatch writes the models of the batch and resets it. The
+// errors of failed models are recorded in failed by blob ID. Errors
+// that are not specific to a model are returned.
+func (store *Store) writeBatch(ctx context.Context, b *batch, failed map[string]error) error {
+	if len(b.models) == 0 {
+		return nil
+	}
+	_, err := store.Collection.BulkWrite(ctx, b.models, options.BulkWrite().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			if _, ok := failed[b.ids[we.Index]]; !ok {
+				failed[b.ids[we.Index]] = we
+			}
+		}
+		err = nil
+	}
+	if err == nil {
+		store.countBytes("write", b.bytes)
+	}
+	*b = batch{}
+	return err
+}
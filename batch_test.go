@@ -0,0 +1,91 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// A larger old version, so stale segments must be removed
+	if err := store.Write(context.Background(), "0", bytes.NewReader(randomData(5000))); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{}
+	blobs := map[string]io.Reader{}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		data[id] = randomData(i * 30)
+		blobs[id] = bytes.NewReader(data[id])
+	}
+	if err := store.WriteBatch(context.Background(), blobs); err != nil {
+		t.Fatal(err)
+	}
+	for id, d := range data {
+		if !bytes.Equal(readBlob(t, store, id), d) {
+			t.Errorf("Wrong data for %s", id)
+		}
+		if err := store.Verify(context.Background(), id); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWriteBatchPartialFailure(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.MaxChunks = 1
+
+	err := store.WriteBatch(context.Background(), map[string]io.Reader{
+		"small": bytes.NewReader(randomData(100)),
+		"large": bytes.NewReader(randomData(3000)),
+	})
+	var berr *BatchError
+	if !errors.As(err, &berr) {
+		t.Fatalf("Expected BatchError, got %v", err)
+	}
+	if len(berr.Errors) != 1 || !errors.Is(berr.Errors["large"], ErrTooManyChunks) {
+		t.Errorf("Wrong errors: %v", berr.Errors)
+	}
+	if exists, err := store.Exists(context.Background(), "small"); err != nil || !exists {
+		t.Errorf("Small blob not written: %v %v", exists, err)
+	}
+}
+
+func TestWriteBatchMaxInFlight(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.MaxInFlightBytes = 3000
+	writes := 0
+	store.OnBytes = func(op string, n int) {
+		if op == "write" {
+			if n > store.MaxInFlightBytes+store.ChunkSize {
+				t.Errorf("Bulk write of %d bytes", n)
+			}
+			writes++
+		}
+	}
+
+	data := map[string][]byte{"1": randomData(10000), "2": randomData(500)}
+	blobs := map[string]io.Reader{}
+	for id, d := range data {
+		blobs[id] = bytes.NewReader(d)
+	}
+	if err := store.WriteBatch(context.Background(), blobs); err != nil {
+		t.Fatal(err)
+	}
+	if writes < 3 {
+		t.Errorf("Expected several bulk writes, got %d", writes)
+	}
+	for id, d := range data {
+		if !bytes.Equal(readBlob(t, store, id), d) {
+			t.Errorf("Wrong data for %s", id)
+		}
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"io"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,91 +16,1118 @@ import (
 )
 
 type blobSegment struct {
-	ID    string `bson:"blobId"`
+	ID   string `bson:"blobId"`
+	Seq  uint64 `bson:"seq"`
+	Data []byte `bson:"data,omitempty"`
+	// Ref is the key of the chunk holding the data of the segment, if
+	// the store deduplicates chunks
+	Ref string `bson:"ref,omitempty"`
+	// Start and N are the offset and length of the segment in the
+	// blob. They are uncompressed lengths even if Data is compressed,
+	// so offsets are mapped to segments without decompressing them.
+	Start uint64 `bson:"s"`
+	N     uint64 `bson:"n"`
+	Codec string `bson:"codec,omitempty"`
+	Nonce []byte `bson:"nonce,omitempty"`
+	// Final is set for encrypted segments, and marks the last segment
+	// of the blob. It is authenticated with the segment, so removing
+	// the trailing segments of the blob is detected.
+	Final *bool `bson:"final,omitempty"`
+	// Hash is the SHA-256 hash of the uncompressed data
+	Hash     []byte    `bson:"h,omitempty"`
+	ExpireAt time.Time `bson:"expireAt,omitempty"`
+}
+
+// segmentPos is the position of a segment in a blob. It is used to
+// decode segments without copying their data.
+type segmentPos struct {
 	Seq   uint64 `bson:"seq"`
-	Data  []byte `bson:"data"`
 	Start uint64 `bson:"s"`
 	N     uint64 `bson:"n"`
 }
 
 var DefaultChunkSize = 2048 * 1024 // 2MB chunks
 
+// MaxChunkSize is the largest chunk size. A segment must fit into a
+// 16MB MongoDB document, together with the segment fields and the
+// compression and encryption overhead.
+const MaxChunkSize = 15 * 1024 * 1024
+
 var ErrNotFound = errors.New("Not found")
 
+// NotFoundError is returned when a blob does not exist. It matches
+// ErrNotFound with errors.Is.
+type NotFoundError struct {
+	BlobID string
+}
+
+func (e *NotFoundError) Error() string {
+	return "Not found: " + e.BlobID
+}
+
+// Is returns true for ErrNotFound
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// notFound returns the error for a missing blob
+func notFound(blobID string) error {
+	return &NotFoundError{BlobID: blobID}
+}
+
+var ErrInvalidChunkSize = errors.New("Invalid chunk size")
+
+// ErrChunkTooLarge is returned when the chunk size is larger than
+// MaxChunkSize
+var ErrChunkTooLarge = errors.New("Chunk size too large")
+
+var ErrInvalidRange = errors.New("Invalid range")
+
+// ErrImmutable is returned when modifying an existing blob of a
+// write-once store
+var ErrImmutable = errors.New("Immutable")
+
+// ErrConflict is returned when a segment written by a store with
+// DetectConflicts was already written by another writer
+var ErrConflict = errors.New("Conflict")
+
+// ErrTooManyChunks is returned when a blob would have more than
+// MaxChunks segments
+var ErrTooManyChunks = errors.New("Too many chunks")
+
+// ErrNoIndex is returned by writes to a store with RequireIndex set if
+// the unique index created by EnsureIndex is missing
+var ErrNoIndex = errors.New("Unique index on blobId and seq is missing")
+
+// ErrAppendOnly is returned when overwriting or truncating an
+// existing blob of an append-only store
+var ErrAppendOnly = errors.New("Append only")
+
+// Store keeps blobs as segments in a MongoDB collection. Blob IDs are
+// strings: prefixes, internal IDs and listings are built on string
+// comparison, so other ID types are not supported. Store ObjectID keys
+// by their hex encoding; the (blobId, seq) index works the same.
 type Store struct {
 	Collection *mongo.Collection
-	ChunkSize  int
+	// ChunkSize is the size of the segments of written blobs. It
+	// cannot be larger than MaxChunkSize.
+	ChunkSize int
+
+	// Codec, if set, is used to compress the data of the written
+	// segments. If the first segment of a blob does not compress
+	// well, the blob is stored uncompressed.
+	Codec Codec
+
+	// IncompressibleRatio is the compressed to uncompressed size ratio
+	// of the first segment of a blob above which the blob is stored
+	// uncompressed. If zero, DefaultIncompressibleRatio is used. If
+	// negative, blobs are always compressed.
+	IncompressibleRatio float64
+
+	// DetectCompression enables decompressing blobs written by
+	// external tools. If set, Read decompresses blobs stored without a
+	// codec whose data starts with a gzip or zstd header. Readers of
+	// zstd blobs use goroutines that are released on Close.
+	DetectCompression bool
+
+	// Encrypter, if set, is used to encrypt the data of the written
+	// segments. It is also needed to read encrypted segments.
+	Encrypter Encrypter
+
+	// KeyProvider, if set, supplies the encryption keys of blobs. It
+	// takes precedence over Encrypter for writing. Blobs written
+	// without a key from the KeyProvider are read using Encrypter.
+	KeyProvider KeyProvider
+
+	// OnBytes, if set, is called with the number of data bytes
+	// transferred to or from the database. The bytes are counted as
+	// stored, after compression and encryption. op is "read" or
+	// "write".
+	OnBytes func(op string, n int)
+
+	// UploadTTL is the time an upload session started with
+	// BeginUpload can stay uncommitted before its staged data is
+	// removed. If zero, DefaultUploadTTL is used.
+	UploadTTL time.Duration
+
+	// ReserveTTL is the time a blob reserved with Reserve stays
+	// reserved if it is not written. If zero, DefaultReserveTTL is
+	// used.
+	ReserveTTL time.Duration
+
+	// MaxConcurrentReads limits the number of readers that can be
+	// open at the same time. If the limit is reached, opening a
+	// reader blocks until another reader is done or the context is
+	// canceled. A reader is done when it returns an error, reaches the
+	// end of the blob, or is closed. If zero, there is no limit. The
+	// limit cannot be changed after the first read.
+	MaxConcurrentReads int
+
+	// WriteOnce makes blobs immutable once they are stored. Writing
+	// to or removing an existing blob returns ErrImmutable. This is
+	// enforced by checking if the blob exists before modifying it, so
+	// it is best-effort: there is no server-side enforcement, and a
+	// concurrent writer can create the blob after the check.
+	WriteOnce bool
+
+	// AppendOnly allows existing blobs only to grow. Writing to an
+	// existing blob, or truncating it, returns ErrAppendOnly, but
+	// Append is permitted. Existing blobs can still be removed. Like
+	// WriteOnce, this is best-effort.
+	AppendOnly bool
+
+	// DetectConflicts makes writers insert segments instead of
+	// replacing them, so concurrent writers of the same blob are
+	// detected by the unique (blobId, seq) index, and the write fails
+	// with ErrConflict. A segment already stored with the same data by
+	// a concurrent writer is not a conflict, so writers storing
+	// identical content all succeed. In this mode, an existing blob
+	// cannot be overwritten; it must be removed first. Segments
+	// previously written by the same writer, such as partial flushes,
+	// or the partial segment completed by Resume or Append, are
+	// replaced. ConflictPolicy selects how Write handles a conflict.
+	DetectConflicts bool
+
+	// ConflictPolicy selects what Write does when it detects a
+	// conflict with another writer. It is used only if DetectConflicts
+	// is set.
+	ConflictPolicy ConflictPolicy
+
+	// ConflictWait is the maximum time a write waits for a
+	// conflicting write to finish with ConflictRetry. If zero,
+	// DefaultConflictWait is used.
+	ConflictWait time.Duration
+
+	// AckLevel selects the write concern of segment writes. A lower
+	// level makes writes faster, at the risk of losing acknowledged
+	// segments in a failover, or, with AckNone, of not seeing write
+	// errors at all. The header of a blob is always written with the
+	// write concern of the collection. AckLevel is not used if the
+	// store detects conflicts, deduplicates chunks, or encrypts, since
+	// those need to read back the segments they write.
+	AckLevel AckLevel
+
+	// VerifyAfter makes writes with AckNone or AckPrimary check the
+	// blob with Verify in the background, VerifyDelay after the write
+	// completes, reporting errors to OnVerifyError. This catches lost
+	// writes out of band without slowing down the writer. If
+	// VerifyDelay is zero, DefaultVerifyDelay is used. Staged uploads
+	// are not verified.
+	VerifyAfter   bool
+	VerifyDelay   time.Duration
+	OnVerifyError func(blobID string, err error)
+
+	// CompressResponses makes ServeBlob gzip encode responses if the
+	// client accepts it. Blobs stored with the gzip codec are sent
+	// without recompressing them. Errors after a gzip encoded response
+	// has started cannot be sent to the client, and are reported to
+	// OnServeError if it is set.
+	CompressResponses bool
+	OnServeError      func(blobID string, err error)
+
+	// IndexOptions, if set, are the options used by EnsureIndex to
+	// create the (blobId, seq) index, such as the index name or a
+	// partial filter expression. The index is always unique.
+	IndexOptions *options.IndexOptions
+
+	// HintIndex makes segment queries hint the (blobId, seq) index, so
+	// segments are always sorted using the index instead of in memory.
+	// An in-memory sort fails for large blobs. If set, the index
+	// created by EnsureIndex must exist, otherwise reads fail.
+	HintIndex bool
+
+	// AllowDiskUse lets the server use temporary files when sorting the
+	// segments of a blob. This avoids the in-memory sort limit if the
+	// (blobId, seq) index is missing, but it can be slow.
+	AllowDiskUse bool
+
+	// ReadPrefetch is the number of segments a reader fetches ahead
+	// of the data being read, so fetching the next segments overlaps
+	// with processing the current one. If zero, segments are fetched
+	// as they are read. A prefetching reader runs a goroutine, so it
+	// must be closed.
+	ReadPrefetch int
 
-	index sync.Once
+	// WriteConcurrency is the number of segments a Writer stores at the
+	// same time. If it is greater than one, full segments are
+	// compressed, encrypted and written by goroutines while the writer
+	// buffers the next segments, which limits the memory used by a
+	// writer to WriteConcurrency+1 chunks. The Codec and the Encrypter
+	// of the store must be safe for concurrent use. Writers with
+	// periodic flushes, and stores detecting conflicts, write one
+	// segment at a time.
+	WriteConcurrency int
+
+	// ReadRetries is the number of times a reader reopens its cursor
+	// after a transient error, such as a getMore failing during a
+	// replica set election. The new cursor continues after the last
+	// segment read, so the consumer of the reader does not see the
+	// failure. ReadBackoff returns the time to wait before the given
+	// attempt, starting from 1; if nil, DefaultReadBackoff is used.
+	// Prefetching readers are not retried.
+	ReadRetries int
+	ReadBackoff func(attempt int) time.Duration
+
+	// VerifyOnRead makes Read check the checksum recorded with each
+	// segment, failing with ErrCorrupted at the first segment whose
+	// data does not match, and the content hash of blobs whose
+	// hash is known. The data is hashed as it is read, and instead of
+	// io.EOF, the reader returns an error wrapping ErrCorrupted at the
+	// end of the blob if the hash does not match. Data is returned
+	// before it is verified, so it should not be trusted until the end
+	// of the blob is reached. Hashing costs some CPU time, and opening
+	// a reader fetches the blob header. Blobs written by Writer,
+	// Write, or uploads record their hash; appending to or resuming a
+	// blob, or writing it with WriteParallel, clears it. The recorded
+	// hash is returned by Reader.Sum.
+	VerifyOnRead bool
+
+	// MaxChunks, if positive, is the maximum number of segments of a
+	// blob. Writing more segments fails with an error wrapping
+	// ErrTooManyChunks. This guards against runaway writers and very
+	// small chunk sizes.
+	MaxChunks int
+
+	// ConsistentSize makes Size check the continuity of the segments
+	// of a blob instead of reading only its last segment. A writer
+	// overwriting a blob with shorter data removes the remaining
+	// segments of the previous version when it is closed. Until then,
+	// the stale segments normally do not follow the new data, so they
+	// are not counted, and Size returns the size written so far. If the
+	// new data ends exactly where a stale segment starts, the stale
+	// segments are counted until the writer is closed. Checking
+	// continuity reads the metadata of all segments of the blob.
+	ConsistentSize bool
+
+	// Scan tunes the queries of maintenance operations scanning many
+	// blobs, independently of the reads of the store
+	Scan ScanOptions
+
+	// Now returns the current time. It is used for expiration times,
+	// lock timeouts, periodic flushes, and modification times. If nil,
+	// time.Now is used.
+	Now func() time.Time
+
+	// AtomicWrites makes Write, WriteMulti and WriteReader stage the
+	// data under a temporary ID and replace the blob in a single
+	// transaction once all of it is written, as an Upload does.
+	// Readers see either the old or the new blob, never a mix of
+	// them, and a failed or interrupted write leaves the old blob
+	// intact. Staged data of interrupted writes is removed after the
+	// UploadTTL. If the deployment does not support transactions, the
+	// old blob is removed before the new one is renamed, so readers may
+	// briefly see the blob missing.
+	AtomicWrites bool
+
+	// DryRun makes destructive operations report what they would
+	// remove without removing anything. Remove and RemoveStrict do not
+	// remove blobs, Repair returns the size it would truncate a blob
+	// to, and GCChunks and DeleteOlderThan return the number of chunks
+	// and blobs they would remove. Writes are not affected.
+	DryRun bool
+
+	// ChunkCollection, if set, stores the data of segments by content.
+	// Segments with the same data share a single chunk, and Clone
+	// copies a blob by adding references to its chunks. The chunk
+	// collection cannot be used with encryption.
+	ChunkCollection *mongo.Collection
+
+	// AutoIndex makes the first write or read call EnsureIndex. If
+	// creating the indexes fails, the operation fails with the error.
+	AutoIndex bool
+
+	// RequireIndex makes writes fail with ErrNoIndex if the unique
+	// (blobId, seq) index created by EnsureIndex does not exist.
+	// Without it, concurrent writers can store duplicate segments, and
+	// reading the blob returns garbled data. Once the index is found,
+	// it is not checked again.
+	RequireIndex bool
+
+	// MaxEmptyReads is the number of consecutive reads returning no
+	// data and no error after which a write from a reader fails with
+	// io.ErrNoProgress, so a misbehaving reader cannot make the write
+	// spin. If zero, DefaultMaxEmptyReads is used.
+	MaxEmptyReads int
+
+	// MaxInFlightBytes is the number of encoded segment bytes
+	// WriteBatch buffers before sending them in a bulk write. A blob
+	// larger than this is sent in several bulk writes, so memory stays
+	// bounded for large chunk sizes. If zero, 16MB is used.
+	MaxInFlightBytes int
+
+	index    sync.Once
+	indexErr error
+	// Set atomically once RequireIndex found the index
+	indexFound uint32
+
+	readSlots     chan struct{}
+	readSlotsOnce sync.Once
+}
+
+// ScanOptions tune the queries of operations that scan blobs
+// sequentially, such as ScanIntegrity and GCChunks. Scans fetch only
+// segment metadata, so they benefit from larger batches than reads.
+type ScanOptions struct {
+	// BatchSize is the number of documents fetched in each batch of a
+	// scan query. If zero, the server default is used.
+	BatchSize int32
+	// Prefetch is the number of blob IDs listed ahead of the blobs
+	// being processed by ScanIntegrity. If zero, listing waits for a
+	// blob to be picked up before fetching the next ID.
+	Prefetch int
+}
+
+// segmentIndexKeys are the keys of the (blobId, seq) index
+var segmentIndexKeys = bson.D{
+	{Key: "blobId", Value: 1},
+	{Key: "seq", Value: 1},
 }
 
 // EnsureIndex ensures that the collection has an index on id and
-// seq. This can be called multiple times on a store object.
-func (store *Store) EnsureIndex(ctx context.Context) (err error) {
+// seq, and a TTL index on the expiration time used to clean up
+// abandoned uploads and reservations. If the store has a chunk
+// collection, segments are also indexed by chunk reference. The
+// options of the (blobId, seq) index can be set using IndexOptions.
+// Segments are read sorted by seq, which requires the (blobId, seq)
+// index for large blobs. This can be called multiple times on a store
+// object; the indexes are created only by the first call, and later
+// calls return its error.
+func (store *Store) EnsureIndex(ctx context.Context) error {
 	store.index.Do(func() {
 		ix := store.Collection.Indexes()
-		_, err = ix.CreateOne(ctx, mongo.IndexModel{
-			Keys: bson.D{
-				{Key: "blobId", Value: 1},
-				{Key: "seq", Value: 1},
+		models := []mongo.IndexModel{
+			{
+				Keys:    segmentIndexKeys,
+				Options: options.MergeIndexOptions(store.IndexOptions).SetUnique(true),
 			},
-			Options: options.Index().SetUnique(true),
+			{
+				Keys:    bson.D{{Key: "expireAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		}
+		// Used by DeleteOlderThan. Only headers have the field.
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+			Options: options.Index().SetSparse(true),
 		})
+		if store.ChunkCollection != nil {
+			// Used by GCChunks to find unreferenced chunks
+			models = append(models, mongo.IndexModel{
+				Keys:    bson.D{{Key: "ref", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			})
+		}
+		_, store.indexErr = ix.CreateMany(ctx, models)
+	})
+	return store.indexErr
+}
+
+// now returns the current time using the clock of the store
+func (store *Store) now() time.Time {
+	if store.Now != nil {
+		return store.Now()
+	}
+	return time.Now()
+}
+
+// Reset makes the store use collection c. The indexes of c are
+// created by the next call to EnsureIndex. Reset must not be called
+// while the store is in use.
+func (store *Store) Reset(c *mongo.Collection) {
+	store.Collection = c
+	store.index = sync.Once{}
+	store.indexErr = nil
+	atomic.StoreUint32(&store.indexFound, 0)
+}
+
+// autoIndex calls EnsureIndex if AutoIndex is set
+func (store *Store) autoIndex(ctx context.Context) error {
+	if !store.AutoIndex {
+		return nil
+	}
+	return store.EnsureIndex(ctx)
+}
+
+// requireIndex returns ErrNoIndex if RequireIndex is set and the
+// unique (blobId, seq) index does not exist
+func (store *Store) requireIndex(ctx context.Context) error {
+	if !store.RequireIndex || atomic.LoadUint32(&store.indexFound) != 0 {
+		return nil
+	}
+	cursor, err := store.Collection.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var index struct {
+			Key    bson.Raw `bson:"key"`
+			Unique bool     `bson:"unique"`
+		}
+		if err := cursor.Decode(&index); err != nil {
+			return err
+		}
+		if index.Unique && isSegmentIndex(index.Key) {
+			atomic.StoreUint32(&store.indexFound, 1)
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return ErrNoIndex
+}
+
+// isSegmentIndex returns if the index keys are segmentIndexKeys
+func isSegmentIndex(keys bson.Raw) bool {
+	elements, err := keys.Elements()
+	if err != nil || len(elements) != len(segmentIndexKeys) {
+		return false
+	}
+	for i, element := range elements {
+		if element.Key() != segmentIndexKeys[i].Key {
+			return false
+		}
+		if n, ok := element.Value().AsInt64OK(); !ok || n != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Exists returns if a blob exists. An empty blob exists, even though
+// it has no segments.
+func (store *Store) Exists(ctx context.Context, blobID string) (bool, error) {
+	return store.exists(ctx, blobID)
+}
+
+// exists returns if a blob exists
+func (store *Store) exists(ctx context.Context, blobID string) (bool, error) {
+	err := store.Collection.FindOne(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": headerSeq}}, options.FindOne().
+		SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkWritable returns ErrImmutable if the store is write-once, or
+// ErrAppendOnly if the store is append-only, and the blob exists. A
+// reserved blob can be written.
+func (store *Store) checkWritable(ctx context.Context, blobID string) error {
+	if !store.WriteOnce && !store.AppendOnly {
+		return nil
+	}
+	exists, err := store.exists(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	if reserved, err := store.Reserved(ctx, blobID); err != nil || reserved {
+		return err
+	}
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	return ErrAppendOnly
+}
+
+// acquireRead waits until a read slot is available, and returns a
+// function that releases it. The release function can be called
+// multiple times.
+func (store *Store) acquireRead(ctx context.Context) (func(), error) {
+	if store.MaxConcurrentReads <= 0 {
+		return func() {}, nil
+	}
+	store.readSlotsOnce.Do(func() {
+		store.readSlots = make(chan struct{}, store.MaxConcurrentReads)
+	})
+	select {
+	case store.readSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-store.readSlots })
+	}, nil
+}
+
+// limitRead calls open holding a read slot. The slot is released when
+// the returned reader is done.
+func (store *Store) limitRead(ctx context.Context, open func() (*Reader, error)) (*Reader, error) {
+	if err := store.autoIndex(ctx); err != nil {
+		return nil, err
+	}
+	release, err := store.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := open()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	rd.release = release
+	if rd.err != nil {
+		release()
+	}
+	return rd, nil
+}
+
+// countBytes reports n bytes transferred for op to OnBytes
+func (store *Store) countBytes(op string, n int) {
+	if store.OnBytes != nil {
+		store.OnBytes(op, n)
+	}
+}
+
+// countSegment reports the stored data bytes of a raw segment read
+// from the database to OnBytes
+func (store *Store) countSegment(raw bson.Raw) {
+	if store.OnBytes == nil {
+		return
+	}
+	if _, data, ok := raw.Lookup("data").BinaryOK(); ok {
+		store.OnBytes("read", len(data))
+	}
+}
+
+// WithCausalSession starts a causally consistent session, and returns
+// a context carrying it. Operations using the returned context observe
+// the effects of the earlier ones, so a Read following a Write sees
+// the written data even if it is served by a secondary. Call the
+// returned function to end the session.
+func (store *Store) WithCausalSession(ctx context.Context) (context.Context, func(), error) {
+	session, err := store.Collection.Database().Client().StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return nil, nil, err
+	}
+	return mongo.NewSessionContext(ctx, session), func() { session.EndSession(context.Background()) }, nil
+}
+
+// WithTransaction runs fn in a transaction, so blob operations using
+// the context passed to fn, and other operations of the caller using
+// it, are committed together or not at all. Writes, Remove, and the
+// other operations of the store that run their own transaction take
+// part in this one instead. fn may be called again if the transaction
+// fails with a transient error. If the deployment does not support
+// transactions, fn runs without one. Large writes may exceed the limits
+// of a transaction; use AtomicWrites for them instead.
+func (store *Store) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return store.inTransaction(ctx, func(ctx context.Context) error {
+		return fn(context.WithValue(ctx, txKey{}, true))
 	})
-	return
 }
 
-// Remove all given blobs
+// txKey marks a context passed to the function of WithTransaction
+type txKey struct{}
+
+// inTransaction runs fn in a transaction. If the deployment does not
+// support transactions, fn runs without one. If ctx carries a session,
+// the transaction runs in that session. If ctx is in a transaction
+// started by WithTransaction, fn runs in it.
+func (store *Store) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(txKey{}) != nil {
+		return fn(ctx)
+	}
+	session := mongo.SessionFromContext(ctx)
+	if session == nil {
+		var err error
+		session, err = store.Collection.Database().Client().StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(ctx)
+	}
+	_, err := session.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sctx)
+	})
+	var cerr mongo.CommandError
+	if errors.As(err, &cerr) && cerr.Code == 20 {
+		// IllegalOperation: transactions are not supported on standalone servers
+		return fn(ctx)
+	}
+	return err
+}
+
+// Remove all given blobs. Removing a blob that does not exist is not
+// an error. Locks on the blobs are not removed. If the store is in
+// DryRun mode, nothing is removed.
 func (store *Store) Remove(ctx context.Context, blobIDs ...string) error {
 	if len(blobIDs) == 0 {
 		return nil
 	}
-	_, err := store.Collection.DeleteMany(ctx, bson.M{"blobId": bson.M{"$in": blobIDs}})
+	if store.WriteOnce {
+		for _, blobID := range blobIDs {
+			if err := store.checkWritable(ctx, blobID); err != nil {
+				return err
+			}
+		}
+	}
+	if store.DryRun {
+		return nil
+	}
+	return store.remove(ctx, blobIDs...)
+}
+
+// deleteMany deletes the documents of coll matching filter, and
+// returns the number of documents deleted. If the store is in DryRun
+// mode, the documents are counted instead.
+func (store *Store) deleteMany(ctx context.Context, coll *mongo.Collection, filter bson.M) (int64, error) {
+	if store.DryRun {
+		return coll.CountDocuments(ctx, filter)
+	}
+	result, err := coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (store *Store) remove(ctx context.Context, blobIDs ...string) error {
+	_, err := store.deleteSegments(ctx, bson.M{"blobId": bson.M{"$in": blobIDs}, "seq": bson.M{"$ne": lockSeq}})
 	return err
 }
 
-// Write blob data. Data can be nil, if so, a truncated blob will be written
-func (store *Store) Write(ctx context.Context, blobID string, data io.Reader) error {
-	var segment blobSegment
-	chunkSize := store.ChunkSize
-	if chunkSize <= 0 {
-		chunkSize = DefaultChunkSize
-	}
-	segment.Data = make([]byte, chunkSize)
-	segment.ID = blobID
-	start := uint64(0)
-	for {
-		n, err := io.ReadAtLeast(data, segment.Data, len(segment.Data))
-		if errors.Is(err, io.ErrUnexpectedEOF) {
-			// n > 0 is guaranteed
-			segment.Data = segment.Data[:n]
-			err = nil
-		} else if errors.Is(err, io.EOF) {
-			// Nothing read
-			break
-		} else if err != nil {
+// RemoveStrict removes a blob, and returns ErrNotFound if the blob
+// does not exist. If the store is in DryRun mode, the blob is not
+// removed, but ErrNotFound is still returned for a missing blob.
+func (store *Store) RemoveStrict(ctx context.Context, blobID string) error {
+	if store.WriteOnce {
+		if err := store.checkWritable(ctx, blobID); err != nil {
 			return err
 		}
-		segment.Start = start
-		segment.N = uint64(len(segment.Data))
-		start += uint64(len(segment.Data))
-		_, err = store.Collection.ReplaceOne(ctx, bson.M{"blobId": segment.ID, "seq": segment.Seq}, segment, options.Replace().SetUpsert(true))
-		if err != nil {
+	}
+	filter := bson.M{"blobId": blobID, "seq": bson.M{"$ne": lockSeq}}
+	var deleted int64
+	var err error
+	if store.DryRun {
+		deleted, err = store.Collection.CountDocuments(ctx, filter)
+	} else {
+		deleted, err = store.deleteSegments(ctx, filter)
+	}
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return notFound(blobID)
+	}
+	return nil
+}
+
+// RemoveBatchSize is the number of segments RemoveProgress deletes at
+// a time
+var RemoveBatchSize uint64 = 1000
+
+// RemoveProgress removes a blob in batches of RemoveBatchSize
+// segments, calling report, if not nil, with the number of documents
+// deleted so far after each batch. Segments are deleted from the end
+// of the blob, so if ctx is cancelled between batches, the remaining
+// segments are a prefix of the blob, and the removal can be completed
+// by calling Remove. Removing a blob that does not exist is not an
+// error. If the store is in DryRun mode, nothing is removed.
+func (store *Store) RemoveProgress(ctx context.Context, blobID string, report func(deleted int64)) error {
+	if store.WriteOnce {
+		if err := store.checkWritable(ctx, blobID); err != nil {
 			return err
 		}
-		segment.Seq++
 	}
-	// Remove remaining segments
-	_, err := store.Collection.DeleteMany(ctx, bson.M{"blobId": segment.ID, "seq": bson.M{"$gte": segment.Seq}})
+	if store.DryRun {
+		return nil
+	}
+	var deleted int64
+	last, err := store.lastSegment(ctx, segmentFilter(blobID))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		for hi := last.Seq + 1; hi > 0; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			lo := uint64(0)
+			if hi > RemoveBatchSize {
+				lo = hi - RemoveBatchSize
+			}
+			n, err := store.deleteSegments(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": lo, "$lt": hi}})
+			if err != nil {
+				return err
+			}
+			deleted += n
+			if report != nil {
+				report(deleted)
+			}
+			hi = lo
+		}
+	}
+	// Remove the header, and any segments written since
+	n, err := store.deleteSegments(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$ne": lockSeq}})
+	if err != nil {
+		return err
+	}
+	if n > 0 && report != nil {
+		report(deleted + n)
+	}
+	return nil
+}
+
+// WriteOption configures a single write operation
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	chunkSize    int
+	chunkSizeSet bool
+	flushEvery   time.Duration
+	flushBytes   int
+	flushMargin  time.Duration
+	newSegment   bool
+	meta         bson.M
+	metaSet      bool
+	codec        Codec
+	codecSet     bool
+	expireAt     time.Time
+}
+
+// WithChunkSize sets the chunk size for a single write, overriding
+// the chunk size of the store. The chunk size must be positive.
+func WithChunkSize(n int) WriteOption {
+	return func(o *writeOptions) {
+		o.chunkSize = n
+		o.chunkSizeSet = true
+	}
+}
+
+// WithFlushEvery makes a writer persist buffered data at least every
+// d, instead of only when a chunk is full. The check is done when data
+// is written to the writer, there is no background flush. The buffered
+// data is written as a partial segment, which is completed by later
+// writes, or by Append if the writer is not closed.
+func WithFlushEvery(d time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.flushEvery = d
+	}
+}
+
+// WithFlushBytes makes a writer persist buffered data whenever n bytes
+// are written since the last flush, instead of only when a chunk is
+// full. Like WithFlushEvery, this may write a partial segment.
+func WithFlushBytes(n int) WriteOption {
+	return func(o *writeOptions) {
+		o.flushBytes = n
+	}
+}
+
+// WithDeadlineFlush makes a writer whose context has a deadline persist
+// buffered data once the deadline is within margin, so a slow producer
+// does not lose a whole buffered chunk when the context times out. As
+// with WithFlushEvery, the check is done when data is written to the
+// writer. If Close is called within margin of the deadline, or after
+// it, the writer is closed using a detached context with a timeout of
+// margin, so the buffered data is written and the stale segments of the
+// previous version are removed.
+func WithDeadlineFlush(margin time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.flushMargin = margin
+	}
+}
+
+// WithNewSegment makes Append start a new segment instead of
+// completing the partial last segment of the blob. This avoids reading
+// back the last segment, but leaves a segment smaller than the chunk
+// size in the middle of the blob. Use Compact to rewrite the blob with
+// full segments.
+func WithNewSegment() WriteOption {
+	return func(o *writeOptions) {
+		o.newSegment = true
+	}
+}
+
+// WithMeta makes a write replace the user metadata of the blob with
+// meta when the writer is closed. Without it, the metadata of the
+// previous version is kept.
+func WithMeta(meta bson.M) WriteOption {
+	return func(o *writeOptions) {
+		if meta == nil {
+			meta = bson.M{}
+		}
+		o.meta = meta
+		o.metaSet = true
+	}
+}
+
+// WithCodec compresses a single write with codec instead of the codec
+// of the store. A nil codec stores the blob uncompressed. To read the
+// blob back, the codec must be registered with RegisterCodec, unless it
+// is the codec of the store. Appending to or resuming a blob continues
+// with the codec the blob was written with, ignoring this option.
+func WithCodec(codec Codec) WriteOption {
+	return func(o *writeOptions) {
+		o.codec = codec
+		o.codecSet = true
+	}
+}
+
+// WithExpiry makes the blob written expire at t. The segments and the
+// header of the blob are stamped with t, and the TTL index created by
+// EnsureIndex removes them once t passes. The server removes expired
+// documents in the background, so an expired blob may be partially
+// removed for a while; GC removes expired blobs at once. Appending to
+// or resuming a blob keeps its expiration time, ignoring this option.
+func WithExpiry(t time.Time) WriteOption {
+	return func(o *writeOptions) {
+		o.expireAt = t
+	}
+}
+
+// chunkSize returns the effective chunk size for a write
+func (store *Store) chunkSize(opts writeOptions) (int, error) {
+	size := store.ChunkSize
+	if opts.chunkSizeSet {
+		if opts.chunkSize <= 0 {
+			return 0, ErrInvalidChunkSize
+		}
+		size = opts.chunkSize
+	} else if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if size > MaxChunkSize {
+		return 0, ErrChunkTooLarge
+	}
+	return size, nil
+}
+
+// Write blob data. Data can be nil, if so, a truncated blob will be
+// written. If the blob needs more than MaxChunks segments, it is
+// removed, and an error wrapping ErrTooManyChunks is returned.
+func (store *Store) Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	_, err := store.write(ctx, blobID, data, opts...)
 	return err
 }
 
-// Read blob data. To stop reading, close the returned readCloser. You
-// must close the returned stream, otherwise the goroutine streaming
-// the data will leak.
-func (store *Store) Read(ctx context.Context, blobID string) (io.ReadCloser, error) {
-	rd, wr := io.Pipe()
-	cursor, err := store.Collection.Find(ctx, bson.M{"blobId": blobID}, options.Find().SetSort(map[string]interface{}{"seq": 1}))
+// WriteMulti writes the concatenation of the data of readers as the
+// blob, and returns the size of the blob. Segments span reader
+// boundaries, so the blob is stored as if it was written from a single
+// reader.
+func (store *Store) WriteMulti(ctx context.Context, blobID string, readers ...io.Reader) (int64, error) {
+	w, err := store.write(ctx, blobID, io.MultiReader(readers...))
+	if err != nil {
+		return 0, err
+	}
+	return int64(w.start), nil
+}
+
+// DefaultMaxEmptyReads is the default number of consecutive empty
+// reads after which a write fails with io.ErrNoProgress
+const DefaultMaxEmptyReads = 100
+
+// progressReader fails with io.ErrNoProgress after max consecutive
+// reads returning no data and no error
+type progressReader struct {
+	r     io.Reader
+	max   int
+	empty int
+}
+
+// progressReader returns r guarded against reads that make no progress
+func (store *Store) progressReader(r io.Reader) io.Reader {
+	max := store.MaxEmptyReads
+	if max <= 0 {
+		max = DefaultMaxEmptyReads
+	}
+	return &progressReader{r: r, max: max}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 || err != nil || len(b) == 0 {
+		p.empty = 0
+		return n, err
+	}
+	p.empty++
+	if p.empty >= p.max {
+		return 0, io.ErrNoProgress
+	}
+	return 0, nil
+}
+
+// write writes the blob, and returns the closed writer
+func (store *Store) write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) (*Writer, error) {
+	var retry *conflictRetry
+	if store.DetectConflicts && store.ConflictPolicy == ConflictRetry {
+		var err error
+		if retry, err = store.beginConflictRetry(ctx, blobID, data); err != nil {
+			return nil, err
+		}
+	}
+	if store.AtomicWrites {
+		return store.writeStaged(ctx, blobID, data, opts...)
+	}
+	w, err := store.NewWriter(ctx, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		_, err = w.ReadFrom(data)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if errors.Is(err, ErrConflict) && retry != nil {
+		return store.retryConflict(ctx, blobID, retry, opts...)
+	}
+	if errors.Is(err, ErrTooManyChunks) {
+		// Remove the segments written so far
+		if rerr := store.remove(ctx, blobID); rerr != nil {
+			return nil, rerr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeStaged writes the blob as an upload, and returns the closed
+// writer. The staged data is removed if the write fails.
+func (store *Store) writeStaged(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) (*Writer, error) {
+	u, err := store.BeginUpload(ctx, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if _, err := u.w.ReadFrom(data); err != nil {
+			u.Abort()
+			return nil, err
+		}
+	}
+	if err := u.Commit(); err != nil {
+		if rerr := store.remove(ctx, u.stagingID); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	// The writer is closed, so this only changes the ID reported by
+	// the writer's info
+	u.w.blobID = blobID
+	return u.w, nil
+}
+
+// Read blob data. Segments are fetched as the returned reader is
+// read. Close the reader to release the underlying cursor. A reader
+// that is not closed does not leak goroutines, but the cursor stays
+// open on the server until it times out.
+//
+// Segments compressed by a codec are decompressed. If
+// DetectCompression is set, blobs stored uncompressed whose data is a
+// gzip or zstd stream are decompressed as well.
+func (store *Store) Read(ctx context.Context, blobID string) (*Reader, error) {
+	rd, err := store.read(ctx, blobID, false)
+	if err != nil {
+		return nil, err
+	}
+	return store.prepareRead(rd)
+}
+
+// ReadKnown reads a blob whose size is already known, for instance
+// from a previous Stat. This saves the query Read runs when the blob
+// is opened, and Size of the returned reader returns size. The blob is
+// not probed for existence: the segments are queried by the first
+// Read, which fails with ErrNotFound if the blob has no segments,
+// unless size is 0. If the blob changed since its size was obtained,
+// Size may be wrong, but the data returned is the data of the blob.
+func (store *Store) ReadKnown(ctx context.Context, blobID string, size int64) (*Reader, error) {
+	rd, err := store.limitRead(ctx, func() (*Reader, error) {
+		enc, err := store.blobEncrypter(ctx, blobID)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{ctx: ctx, store: store, blobID: blobID, enc: enc, size: size, filter: segmentFilter(blobID), checkFinal: true, lazy: true}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.prepareRead(rd)
+}
+
+// prepareRead sets up content verification and compression detection
+// for a reader returned by Read
+func (store *Store) prepareRead(rd *Reader) (*Reader, error) {
+	if store.VerifyOnRead {
+		if err := rd.startVerify(); err != nil {
+			rd.Close()
+			return nil, err
+		}
+	}
+	if store.DetectCompression {
+		if err := rd.detectCompression(); err != nil {
+			rd.Close()
+			return nil, err
+		}
+	}
+	return rd, nil
+}
+
+// ReadRaw reads the stored blob data without decompressing it.
+// Encrypted segments are decrypted. For a blob compressed with gzip,
+// the concatenation of the compressed segments is a valid multi-member
+// gzip stream. The Size of the returned reader is -1.
+func (store *Store) ReadRaw(ctx context.Context, blobID string) (*Reader, error) {
+	return store.read(ctx, blobID, true)
+}
+
+func (store *Store) read(ctx context.Context, blobID string, raw bool) (*Reader, error) {
+	return store.limitRead(ctx, func() (*Reader, error) {
+		// The header sorts before the segments, so the size recorded in
+		// it arrives with the first batch
+		cursor, err := store.openSegments(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": headerSeq}})
+		if errors.Is(err, ErrNotFound) {
+			return store.openEmpty(ctx, blobID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, sized := int64(-1), false
+		if seq, _ := cursor.Current.Lookup("seq").AsInt64OK(); seq == headerSeq {
+			size, sized = recordedSize(cursor.Current)
+			if !cursor.Next(ctx) {
+				err := cursor.Err()
+				cursor.Close(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return store.openEmpty(ctx, blobID)
+			}
+		}
+		if raw {
+			size = -1
+		} else if !sized {
+			// Blobs without a header, or being written for the first
+			// time, are sized from the last segment
+			last, err := store.lastSegment(ctx, segmentFilter(blobID))
+			if err != nil {
+				cursor.Close(ctx)
+				return nil, err
+			}
+			size = int64(last.Start + last.N)
+		}
+		rd, err := store.newReader(ctx, blobID, cursor, size, raw)
+		if err != nil {
+			return nil, err
+		}
+		rd.filter = segmentFilter(blobID)
+		rd.checkFinal = true
+		return rd, nil
+	})
+}
+
+// openSegments returns a cursor over the segments matching filter in
+// seq order, positioned on the first segment. Returns ErrNotFound if
+// there are no matching segments.
+func (store *Store) openSegments(ctx context.Context, filter bson.M) (*mongo.Cursor, error) {
+	cursor, err := store.Collection.Find(ctx, filter, store.findSorted(1))
 	if err != nil {
 		return nil, err
 	}
@@ -104,35 +1135,145 @@ func (store *Store) Read(ctx context.Context, blobID string) (io.ReadCloser, err
 		cursor.Close(ctx)
 		return nil, ErrNotFound
 	}
-	go func() {
-		defer wr.Close()
-		defer cursor.Close(context.Background())
-		var segment blobSegment
-		cursor.Decode(&segment)
-		if _, err := wr.Write(segment.Data); err != nil {
-			return
-		}
-		for cursor.Next(ctx) {
-			cursor.Decode(&segment)
-			if _, err := wr.Write(segment.Data); err != nil {
-				return
-			}
-		}
-	}()
-	return rd, nil
+	return cursor, nil
+}
+
+// findSorted returns the options of a segment query sorted by seq in
+// the given direction
+func (store *Store) findSorted(dir int) *options.FindOptions {
+	opts := options.Find().SetSort(bson.M{"seq": dir})
+	if store.HintIndex {
+		opts.SetHint(segmentIndexKeys)
+	}
+	if store.AllowDiskUse {
+		opts.SetAllowDiskUse(true)
+	}
+	return opts
 }
 
-// Size returns the size of the object
+// lastSegment returns the position of the last segment matching
+// filter, without the data
+func (store *Store) lastSegment(ctx context.Context, filter bson.M) (segmentPos, error) {
+	var last segmentPos
+	opts := options.FindOne().
+		SetSort(bson.M{"seq": -1}).
+		SetProjection(bson.M{"seq": 1, "s": 1, "n": 1})
+	if store.HintIndex {
+		opts.SetHint(segmentIndexKeys)
+	}
+	err := store.Collection.FindOne(ctx, filter, opts).Decode(&last)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return last, ErrNotFound
+	}
+	return last, err
+}
+
+// Size returns the size of the object. The size is computed from the
+// last segment, fetched without its data, so while a writer
+// overwrites the blob with shorter data, Size can return the size of
+// the previous version until the writer is closed. If ConsistentSize
+// is set, the size is that of the longest contiguous run of segments,
+// as in Repair.
 func (store *Store) Size(ctx context.Context, blobID string) (int64, error) {
-	cursor, err := store.Collection.Find(ctx, bson.M{"blobId": blobID}, options.Find().SetSort(map[string]interface{}{"seq": -1}))
+	if store.ConsistentSize {
+		return store.consistentSize(ctx, blobID)
+	}
+	return store.blobEnd(ctx, blobID)
+}
+
+// consistentSize returns the size of the longest contiguous run of
+// segments of a blob starting at seq 0
+func (store *Store) consistentSize(ctx context.Context, blobID string) (int64, error) {
+	count, size, _, err := store.contiguousPrefix(ctx, blobID)
 	if err != nil {
 		return 0, err
 	}
+	if count == 0 {
+		if empty, err := store.isEmpty(ctx, blobID); err != nil || empty {
+			return 0, err
+		}
+		return 0, notFound(blobID)
+	}
+	return int64(size), nil
+}
+
+// SumSize returns the total size of the given blobs, computed with a
+// single aggregation. Blobs that do not exist contribute 0.
+func (store *Store) SumSize(ctx context.Context, blobIDs []string) (int64, error) {
+	if len(blobIDs) == 0 {
+		return 0, nil
+	}
+	return store.sumSizes(ctx, bson.M{"blobId": bson.M{"$in": blobIDs}, "seq": bson.M{"$gte": 0}})
+}
+
+// sumSizes returns the total size of the blobs whose segments match
+// filter
+func (store *Store) sumSizes(ctx context.Context, filter bson.M) (int64, error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  "$blobId",
+			"size": bson.M{"$max": bson.M{"$add": bson.A{"$s", "$n"}}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"total": bson.M{"$sum": "$size"},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
 	if !cursor.Next(ctx) {
-		cursor.Close(ctx)
-		return 0, ErrNotFound
+		return 0, cursor.Err()
+	}
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Total, nil
+}
+
+// PrefixSize returns the total logical size of all blobs whose ID
+// starts with prefix. Uncommitted uploads are not included.
+func (store *Store) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return store.sumSizes(ctx, bson.M{
+		"$and": bson.A{
+			bson.M{"blobId": prefixFilter(prefix)},
+			bson.M{"blobId": notInternal()},
+		},
+		"seq": bson.M{"$gte": 0},
+	})
+}
+
+// internalPrefixes are the prefixes of the IDs the store uses for
+// staged uploads and saved versions. They are not listed as blobs.
+var internalPrefixes = []string{stagingPrefix, versionPrefix}
+
+// isInternal returns if blobID is used by the store internally
+func isInternal(blobID string) bool {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(blobID, prefix) {
+			return true
+		}
 	}
-	var last blobSegment
-	cursor.Decode(&last)
-	return int64(last.Start + last.N), nil
+	return false
+}
+
+// notInternal returns a filter that matches the blob IDs that are not
+// used by the store internally
+func notInternal() bson.M {
+	quoted := make([]string, len(internalPrefixes))
+	for i, prefix := range internalPrefixes {
+		quoted[i] = regexp.QuoteMeta(prefix)
+	}
+	return bson.M{"$not": bson.M{"$regex": "^(" + strings.Join(quoted, "|") + ")"}}
+}
+
+// prefixFilter returns a filter that matches strings starting with
+// prefix. An anchored regular expression can use the blobId index.
+func prefixFilter(prefix string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
 }
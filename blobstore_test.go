@@ -3,13 +3,22 @@ package blobstore
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -75,6 +84,9 @@ func TestBlob(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if rd.Size() != int64(size) {
+		t.Errorf("Wrong reader size: %d", rd.Size())
+	}
 	read, err := io.ReadAll(rd)
 	if err != nil {
 		t.Error(err)
@@ -99,3 +111,2109 @@ func TestBlob(t *testing.T) {
 		t.Errorf("Error expected")
 	}
 }
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	return data
+}
+
+func setupTestStore(t *testing.T) *Store {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+		ChunkSize:  1024,
+	}
+	if err := store.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func readBlob(t *testing.T, store *Store, blobID string) []byte {
+	rd, err := store.Read(context.Background(), blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWriter(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	w, err := store.NewWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(w, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("Wrong count: %d", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+}
+
+func TestWriterFlushBytes(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(1500)
+	w, err := store.NewWriter(context.Background(), "1", WithFlushBytes(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The partial second chunk is persisted before Close
+	size, err := store.Size(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1500 {
+		t.Errorf("Wrong size before close: %d", size)
+	}
+	// Continue the blob as if the writer was lost
+	more := randomData(700)
+	if err := store.Append(context.Background(), "1", bytes.NewReader(more)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), append(data, more...)) {
+		t.Errorf("Not equal")
+	}
+}
+
+func TestWriterFlushEvery(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	data := randomData(1500)
+	w, err := store.NewWriter(context.Background(), "1", WithFlushEvery(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Within the interval, only the full chunk is written
+	if _, err := w.Write(data[:1200]); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 1024 {
+		t.Errorf("Wrong size within the interval: %d %v", size, err)
+	}
+	// Once the interval passed, the partial chunk is persisted
+	now = now.Add(time.Minute)
+	if _, err := w.Write(data[1200:]); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 1500 {
+		t.Errorf("Wrong size after the interval: %d %v", size, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	w, err := store.NewWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed, got %v", err)
+	}
+	if _, err := w.ReadFrom(bytes.NewReader([]byte("data"))); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed, got %v", err)
+	}
+	if err := w.Abort(); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed, got %v", err)
+	}
+
+	w, err = store.NewWriter(context.Background(), "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Expected ErrWriterClosed, got %v", err)
+	}
+	if _, err := store.Read(context.Background(), "2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// A failed Close is not reported as success when repeated
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err = store.NewWriter(ctx, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := w.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled again, got %v", err)
+	}
+}
+
+func BenchmarkReadRange(b *testing.B) {
+	cli := setupTestConnection()
+	const size, offset, length = 16 * 1024 * 1024, 5*1024*1024 + 100, 4096
+	data := randomData(size)
+	for _, chunkSize := range []int{64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprint(chunkSize), func(b *testing.B) {
+			var transferred int64
+			store := &Store{
+				Collection: cli.Database("test").Collection("blob"),
+				ChunkSize:  chunkSize,
+				OnBytes: func(op string, n int) {
+					if op == "read" {
+						transferred += int64(n)
+					}
+				},
+			}
+			defer cleanupBlobs(store)
+			if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+			transferred = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rd, err := store.ReadRange(context.Background(), "1", offset, length)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+				rd.Close()
+			}
+			b.ReportMetric(float64(transferred)/float64(b.N), "transferred-bytes/op")
+		})
+	}
+}
+
+func BenchmarkReadSmall(b *testing.B) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+	}
+	defer cleanupBlobs(store)
+	size := 4096
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(size))); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Read", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rd, err := store.Read(context.Background(), "1")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadAll(rd); err != nil {
+				b.Fatal(err)
+			}
+			rd.Close()
+		}
+	})
+	b.Run("ReadBytes", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.ReadBytes(context.Background(), "1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSize(b *testing.B) {
+	adr := os.Getenv("mongo_uri")
+	if len(adr) == 0 {
+		adr = "mongodb://127.0.0.1:27017"
+	}
+	var wire int64
+	monitor := &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			atomic.AddInt64(&wire, int64(len(e.Reply)))
+		},
+	}
+	cli, err := mongo.Connect(context.Background(), options.Client().ApplyURI(adr).SetMonitor(monitor))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Disconnect(context.Background())
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+		ChunkSize:  4 * 1024 * 1024,
+	}
+	defer cleanupBlobs(store)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(10*1024*1024))); err != nil {
+		b.Fatal(err)
+	}
+	// Find fetches the whole last segment, as Size used to
+	b.Run("Find", func(b *testing.B) {
+		atomic.StoreInt64(&wire, 0)
+		for i := 0; i < b.N; i++ {
+			var last blobSegment
+			if err := store.Collection.FindOne(context.Background(), segmentFilter("1"), options.FindOne().SetSort(bson.M{"seq": -1})).Decode(&last); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&wire))/float64(b.N), "wire-bytes/op")
+	})
+	b.Run("Size", func(b *testing.B) {
+		atomic.StoreInt64(&wire, 0)
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Size(context.Background(), "1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&wire))/float64(b.N), "wire-bytes/op")
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+	}
+	defer cleanupBlobs(store)
+	size := 64 * 1024 * 1024
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(size))); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Read", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		buf := make([]byte, 32*1024)
+		for i := 0; i < b.N; i++ {
+			rd, err := store.Read(context.Background(), "1")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{rd}, buf); err != nil {
+				b.Fatal(err)
+			}
+			rd.Close()
+		}
+	})
+	b.Run("WriteTo", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rd, err := store.Read(context.Background(), "1")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, rd); err != nil {
+				b.Fatal(err)
+			}
+			rd.Close()
+		}
+	})
+}
+
+func TestResume(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	for _, written := range []int{1024, 2500, 5005} {
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data[:written])); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Resume(context.Background(), "1", bytes.NewReader(data[written:]), int64(written)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readBlob(t, store, "1"), data) {
+			t.Errorf("Not equal after resuming at %d", written)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	old := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(5005)
+	upload, err := store.BeginUpload(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), old) {
+		t.Errorf("Uncommitted upload is visible")
+	}
+	if err := upload.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+
+	upload, err = store.BeginUpload(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.Write(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Aborted upload changed the blob")
+	}
+}
+
+func TestAtomicWrites(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.AtomicWrites = true
+
+	ctx := context.Background()
+	old := randomData(3000)
+	if err := store.Write(ctx, "1", bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	// A write failing midway leaves the old blob intact
+	failed := io.MultiReader(bytes.NewReader(randomData(2500)), iotest.ErrReader(errors.New("Read failed")))
+	if err := store.Write(ctx, "1", failed); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), old) {
+		t.Errorf("Failed write changed the blob")
+	}
+	data := randomData(5005)
+	info, err := store.WriteReader(ctx, "1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "1" || info.Size != int64(len(data)) {
+		t.Errorf("Wrong info: %+v", info)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+	if n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": prefixFilter(stagingPrefix)}); err != nil || n != 0 {
+		t.Errorf("Staged data left: %d %v", n, err)
+	}
+}
+
+func TestAtomicWritesKeepHeader(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	if err := store.WriteWithMeta(ctx, "1", bytes.NewReader(randomData(3000)), bson.M{"owner": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := store.Stat(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AtomicWrites = true
+	data := randomData(2000)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Meta["owner"] != "a" {
+		t.Errorf("Metadata not kept: %v", info.Meta)
+	}
+	if !info.CreateTime.Equal(before.CreateTime) {
+		t.Errorf("Creation time not kept: %v %v", info.CreateTime, before.CreateTime)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+	// WithMeta still replaces the metadata
+	if err := store.Write(ctx, "1", bytes.NewReader(data), WithMeta(bson.M{"owner": "b"})); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := store.Metadata(ctx, "1"); err != nil || !reflect.DeepEqual(meta, bson.M{"owner": "b"}) {
+		t.Errorf("Wrong metadata: %v %v", meta, err)
+	}
+}
+
+func TestWithTransaction(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.AtomicWrites = true
+
+	ctx := context.Background()
+	if err := store.Write(ctx, "old", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(3000)
+	// The commit of the staged write takes part in the transaction
+	// instead of starting a nested one
+	err := store.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := store.Write(ctx, "new", bytes.NewReader(data)); err != nil {
+			return err
+		}
+		return store.Remove(ctx, "old")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "new"), data) {
+		t.Errorf("Not equal")
+	}
+	if n, err := store.Size(ctx, "old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Blob not removed: %d %v", n, err)
+	}
+}
+
+func TestUploader(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := append([]byte("<html><body>"), randomData(3000)...)
+	up := store.NewUploader(context.Background(), "1")
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := up.Write(data[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exists, _ := store.Exists(context.Background(), "1"); exists {
+		t.Errorf("Blob visible before Close")
+	}
+	if err := up.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info := up.Info()
+	sum := sha256.Sum256(data)
+	if info.ID != "1" || info.Size != int64(len(data)) || info.SHA256 != hex.EncodeToString(sum[:]) ||
+		info.ContentType != "text/html; charset=utf-8" || info.ModTime.IsZero() {
+		t.Errorf("Wrong info: %+v", info)
+	}
+	if info.ETag() != `"`+info.SHA256+`"` {
+		t.Errorf("Wrong ETag: %s", info.ETag())
+	}
+	hdr, err := store.getHeader(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr == nil || hdr.ContentType != info.ContentType || hdr.SHA256 != info.SHA256 {
+		t.Errorf("Wrong header: %+v", hdr)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+
+	up = store.NewUploader(context.Background(), "1")
+	if _, err := up.Write(randomData(100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Aborted upload changed the blob")
+	}
+}
+
+func TestMaxConcurrentReads(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.MaxConcurrentReads = 1
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(5005))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := store.Read(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	// Reading to the end releases the slot
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	readBlob(t, store, "1")
+	rd.Close()
+}
+
+func TestRemove(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Remove(context.Background(), "missing"); err != nil {
+		t.Errorf("Remove of missing blob: %v", err)
+	}
+	if err := store.RemoveStrict(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveStrict(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteWithMeta(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	if err := store.WriteWithMeta(ctx, "1", bytes.NewReader(randomData(3000)), bson.M{"owner": "a", "source": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	// Rewriting without WithMeta keeps the metadata
+	data := randomData(2000)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := store.Metadata(ctx, "1"); err != nil || meta["owner"] != "a" || meta["source"] != "x" {
+		t.Errorf("Wrong metadata: %v %v", meta, err)
+	}
+	if err := store.SetMeta(ctx, "1", bson.M{"owner": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.Metadata(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, bson.M{"owner": "b"}) {
+		t.Errorf("Wrong metadata: %v", meta)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	if err := store.SetMeta(ctx, "missing", bson.M{"owner": "b"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestEnsureMetadataIndex(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	if err := store.EnsureMetadataIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Creating the indexes again is a no-op
+	for i := 0; i < 2; i++ {
+		if err := store.EnsureMetadataIndex(ctx, "owner", "source"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err := store.Collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []bson.M
+	if err := cursor.All(ctx, &indexes); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, ix := range indexes {
+		keys, _ := ix["key"].(bson.M)
+		for key := range keys {
+			if key != "meta.owner" && key != "meta.source" {
+				continue
+			}
+			if partial, _ := ix["partialFilterExpression"].(bson.M); fmt.Sprint(partial["seq"]) != fmt.Sprint(headerSeq) {
+				t.Errorf("%s: wrong partial filter %v", key, ix["partialFilterExpression"])
+			}
+			found[key] = true
+		}
+	}
+	if !found["meta.owner"] || !found["meta.source"] {
+		t.Errorf("Missing indexes: %v", indexes)
+	}
+
+	for id, owner := range map[string]string{"1": "a", "2": "b"} {
+		if err := store.WriteWithMeta(ctx, id, bytes.NewReader(randomData(100)), bson.M{"owner": owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := store.Query(ctx, bson.M{"seq": headerSeq, "meta.owner": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"2"}) {
+		t.Errorf("Wrong ids: %v", ids)
+	}
+}
+
+func TestStat(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Now = func() time.Time { return created }
+	if err := store.WriteWithMeta(ctx, "1", bytes.NewReader(randomData(3000)), bson.M{"owner": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	modified := created.Add(time.Hour)
+	store.Now = func() time.Time { return modified }
+	if err := store.Write(ctx, "1", bytes.NewReader(randomData(2500))); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 2500 || info.Chunks != 3 || info.Meta["owner"] != "a" {
+		t.Errorf("Wrong info: %+v", info)
+	}
+	if !info.CreateTime.Equal(created) || !info.ModTime.Equal(modified) {
+		t.Errorf("Wrong times: %v %v", info.CreateTime, info.ModTime)
+	}
+	if _, err := store.Stat(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.Reserve(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a reserved blob, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMetadata(context.Background(), "1", bson.M{"tags": bson.A{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	version, err := store.SaveVersion(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "2", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Rename(context.Background(), "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.Exists(context.Background(), "1"); err != nil || exists {
+		t.Errorf("Old blob exists: %v %v", exists, err)
+	}
+	if !bytes.Equal(readBlob(t, store, "2"), data) {
+		t.Errorf("Wrong data")
+	}
+	meta, err := store.Metadata(context.Background(), "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta["tags"], bson.A{"a", "b"}) {
+		t.Errorf("Tags did not follow: %v", meta)
+	}
+	if versions, err := store.Versions(context.Background(), "2"); err != nil || len(versions) != 1 || versions[0] != version {
+		t.Errorf("Versions did not follow: %v %v", versions, err)
+	}
+	if versions, _ := store.Versions(context.Background(), "1"); len(versions) != 0 {
+		t.Errorf("Versions left under the old ID: %v", versions)
+	}
+	if err := store.Rename(context.Background(), "missing", "3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRemoveProgress(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	defer func(n uint64) { RemoveBatchSize = n }(RemoveBatchSize)
+	RemoveBatchSize = 2
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(5000))); err != nil {
+		t.Fatal(err)
+	}
+	var reports []int64
+	if err := store.RemoveProgress(context.Background(), "1", func(n int64) { reports = append(reports, n) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) < 3 || reports[0] != 2 || reports[1] != 4 || reports[2] != 5 {
+		t.Errorf("Wrong reports: %v", reports)
+	}
+	if exists, err := store.Exists(context.Background(), "1"); err != nil || exists {
+		t.Errorf("Blob not removed: %v %v", exists, err)
+	}
+
+	// A cancelled removal leaves a prefix of the blob
+	data := randomData(5000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := store.RemoveProgress(ctx, "1", func(n int64) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	rd, err := store.ReadRaw(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := io.ReadAll(rd)
+	rd.Close()
+	if len(read) == 0 || !bytes.Equal(read, data[:len(read)]) {
+		t.Errorf("Remaining data is not a prefix: %d", len(read))
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.WriteOnce = true
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Expected ErrImmutable on write, got %v", err)
+	}
+	if err := store.Remove(context.Background(), "1"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Expected ErrImmutable on remove, got %v", err)
+	}
+	if err := store.Remove(context.Background(), "missing"); err != nil {
+		t.Errorf("Remove of missing blob: %v", err)
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.AppendOnly = true
+
+	data := randomData(3000)
+	if err := store.Append(context.Background(), "1", bytes.NewReader(data[:1500])); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(context.Background(), "1", bytes.NewReader(data[1500:])); err != nil {
+		t.Fatal(err)
+	}
+	if read := readBlob(t, store, "1"); !bytes.Equal(read, data) {
+		t.Errorf("Wrong data after append")
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected ErrAppendOnly on write, got %v", err)
+	}
+	if err := store.Resume(context.Background(), "1", bytes.NewReader(data), 100); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Expected ErrAppendOnly on resume, got %v", err)
+	}
+}
+
+func TestDetectConflicts(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.DetectConflicts = true
+
+	w1, err := store.NewWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := store.NewWriter(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w1.Write(randomData(1500)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.Write(randomData(1500)); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Errorf("Append: %v", err)
+	}
+}
+
+func TestDetectConflictsSameData(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.DetectConflicts = true
+
+	data := randomData(10000)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.Write(context.Background(), "1", bytes.NewReader(data))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Write of identical data: %v", err)
+		}
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestConflictRetry(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.DetectConflicts = true
+	store.ConflictPolicy = ConflictRetry
+
+	inputs := [][]byte{randomData(10000), randomData(10000)}
+	var wg sync.WaitGroup
+	errs := make([]error, len(inputs))
+	for i := range inputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.Write(context.Background(), "1", bytes.NewReader(inputs[i]))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}
+	result := readBlob(t, store, "1")
+	if !bytes.Equal(result, inputs[0]) && !bytes.Equal(result, inputs[1]) {
+		t.Errorf("Blob is not one of the writes")
+	}
+	if err := store.DeepVerify(context.Background(), "1"); err != nil {
+		t.Errorf("DeepVerify: %v", err)
+	}
+
+	// An existing blob is replaced
+	data := randomData(500)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Blob not replaced")
+	}
+}
+
+func TestReadFromOffset(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, 1023, 1024, 1025, 4096, 5004, 5005} {
+		rd, err := store.ReadFromOffset(context.Background(), "1", offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data[offset:]) {
+			t.Errorf("Wrong data at offset %d", offset)
+		}
+	}
+	if _, err := store.ReadFromOffset(context.Background(), "1", 5006); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestReadBytes(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for _, size := range []int{0, 100, 5005} {
+		id := fmt.Sprint(size)
+		data := randomData(size)
+		if err := store.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		read, err := store.ReadBytes(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("Wrong data for size %d: %d bytes", size, len(read))
+		}
+	}
+	if _, err := store.ReadBytes(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestReadChunks(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var read []byte
+	chunks := 0
+	err := store.ReadChunks(context.Background(), "1", func(chunk []byte) error {
+		chunks++
+		read = append(read, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 5 || !bytes.Equal(read, data) {
+		t.Errorf("Wrong data: %d chunks, %d bytes", chunks, len(read))
+	}
+	stop := errors.New("stop")
+	chunks = 0
+	err = store.ReadChunks(context.Background(), "1", func(chunk []byte) error {
+		chunks++
+		return stop
+	})
+	if err != stop || chunks != 1 {
+		t.Errorf("Expected stop after 1 chunk, got %v after %d", err, chunks)
+	}
+}
+
+func TestReadSize(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string) {
+		rd, err := store.Read(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || rd.Size() != 5005 || !bytes.Equal(read, data) {
+			t.Errorf("%s: wrong data, size %d, %v", what, rd.Size(), err)
+		}
+	}
+	// The size is recorded in the header
+	check("header")
+	// Blobs without a size in the header are sized by their last
+	// segment
+	if _, err := store.Collection.UpdateOne(context.Background(), headerFilter("1"), bson.M{"$unset": bson.M{"size": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	check("no size")
+	if _, err := store.Collection.DeleteOne(context.Background(), headerFilter("1")); err != nil {
+		t.Fatal(err)
+	}
+	check("no header")
+}
+
+func TestReadKnown(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.ReadKnown(context.Background(), "1", 5005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.Size() != 5005 || !bytes.Equal(read, data) {
+		t.Errorf("Wrong data: %d", rd.Size())
+	}
+
+	rd, err = store.ReadKnown(context.Background(), "missing", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rd); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	rd.Close()
+
+	// The segments are queried by the first read, not when the reader
+	// is opened
+	rd, err = store.ReadKnown(context.Background(), "2", 5005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "2", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	read, err = io.ReadAll(rd)
+	rd.Close()
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Wrong data: %v", err)
+	}
+	// A reader closed before reading does not query the segments
+	rd, err = store.ReadKnown(context.Background(), "1", 5005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := rd.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Read after close succeeded")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// A length of zero or less reads to the end, and an offset at or
+	// beyond the end returns an empty reader
+	for _, r := range [][2]int64{{0, 0}, {0, 10}, {1000, 100}, {1020, 10}, {1024, 1024}, {100, 3000}, {5000, 100}, {5005, 10}, {0, 5005}, {1020, 0}, {3000, -1}, {5006, 1}, {9000, 0}} {
+		rd, err := store.ReadRange(context.Background(), "1", r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, end := r[0], r[0]+r[1]
+		if r[1] <= 0 || end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if start > end {
+			start = end
+		}
+		if !bytes.Equal(read, data[start:end]) {
+			t.Errorf("Wrong data for range %v", r)
+		}
+	}
+	if _, err := store.ReadRange(context.Background(), "1", -1, 10); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+	if _, err := store.ReadRange(context.Background(), "2", 5006, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestReadPlan(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(5005))); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		offset, length int64
+		segments       int
+		bytes          int64
+	}{
+		{0, 0, 5, 5005},
+		{0, 10, 1, 1024},
+		{3000, -1, 3, 2957},
+		{1020, 10, 2, 2048},
+		{1024, 1024, 1, 1024},
+		{100, 5000, 5, 5005},
+		{5000, 100, 1, 909},
+		{5005, 10, 0, 0},
+		{5006, 1, 0, 0},
+	} {
+		segments, bytes, err := store.ReadPlan(context.Background(), "1", c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segments != c.segments || bytes != c.bytes {
+			t.Errorf("Range %d+%d: got %d segments %d bytes, expected %d %d", c.offset, c.length, segments, bytes, c.segments, c.bytes)
+		}
+	}
+	if _, _, err := store.ReadPlan(context.Background(), "1", -1, 1); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+	if _, _, err := store.ReadPlan(context.Background(), "2", 0, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestReadSegments(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]uint64{{1, 3}, {0, 1}, {3, 10}, {0, 5}} {
+		rd, err := store.ReadSegments(context.Background(), "1", r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := r[1] * 1024
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		if !bytes.Equal(read, data[r[0]*1024:end]) {
+			t.Errorf("Wrong data for segments %v", r)
+		}
+	}
+	if _, err := store.ReadSegments(context.Background(), "1", 5, 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.ReadSegments(context.Background(), "2", 0, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	for _, r := range [][2]uint64{{3, 3}, {4, 2}} {
+		if _, err := store.ReadSegments(context.Background(), "1", r[0], r[1]); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("Segments %v: expected ErrInvalidRange, got %v", r, err)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// Within the first segment, across segments, beyond the end, and
+	// nothing
+	for _, n := range []int{100, 1500, 10000, 0} {
+		head, err := store.Peek(context.Background(), "1", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := n
+		if end > len(data) {
+			end = len(data)
+		}
+		if !bytes.Equal(head, data[:end]) {
+			t.Errorf("Wrong data for %d bytes", n)
+		}
+	}
+	if _, err := store.Peek(context.Background(), "2", 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Peek(context.Background(), "2", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Peek(context.Background(), "1", -1); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestReadAllInto(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{3000, 4000} {
+		dst := make([]byte, size)
+		n, err := store.ReadAllInto(context.Background(), "1", dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dst[:n], data) {
+			t.Errorf("Wrong data")
+		}
+	}
+	if _, err := store.ReadAllInto(context.Background(), "1", make([]byte, 2999)); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Expected io.ErrShortBuffer, got %v", err)
+	}
+}
+
+func TestReadConcat(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	a, b := randomData(1500), randomData(700)
+	if err := store.Write(context.Background(), "a", bytes.NewReader(a)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "b", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.ReadConcat(context.Background(), []string{"b", "a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, append(append(append([]byte{}, b...), a...), b...)) {
+		t.Errorf("Wrong data")
+	}
+
+	rd, err = store.ReadConcat(context.Background(), []string{"a", "missing", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	read, err = io.ReadAll(rd)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if !bytes.Equal(read, a) {
+		t.Errorf("Wrong data before the missing blob")
+	}
+}
+
+func TestReaderProgress(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if _, err := io.ReadFull(rd, make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if read, total := rd.Progress(); read != 1500 || total != 3000 {
+		t.Errorf("Wrong progress: %d/%d", read, total)
+	}
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Fatal(err)
+	}
+	if read, total := rd.Progress(); read != 3000 || total != 3000 {
+		t.Errorf("Wrong progress: %d/%d", read, total)
+	}
+}
+
+func TestReadPrefetch(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.ReadPrefetch = 2
+
+	data := randomData(10000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	// Close before reading everything
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rd, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderDoubleClose(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.ReadPrefetch = 2
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(10000))); err != nil {
+		t.Fatal(err)
+	}
+	// Close before reading, concurrently
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rd.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := rd.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-rd.prefetchDone:
+	default:
+		t.Errorf("Prefetch goroutine still running")
+	}
+	if _, err := rd.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Read after Close succeeded")
+	}
+}
+
+func TestTail(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, 981, 982, 2000, 5005, 10000} {
+		rd, err := store.Tail(context.Background(), "1", int64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := data
+		if n < len(data) {
+			expected = data[len(data)-n:]
+		}
+		if !bytes.Equal(read, expected) {
+			t.Errorf("Wrong tail for %d", n)
+		}
+	}
+}
+
+func TestPrefixSize(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for id, size := range map[string]int{"a/1": 100, "a/2": 2000, "b/1": 3000} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total, err := store.SumSize(context.Background(), []string{"a/1", "b/1", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3100 {
+		t.Errorf("Wrong sum: %d", total)
+	}
+	total, err = store.PrefixSize(context.Background(), "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2100 {
+		t.Errorf("Wrong prefix size: %d", total)
+	}
+}
+
+func TestLock(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	unlock, err := store.Lock(context.Background(), "1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lock(context.Background(), "1", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = store.Lock(context.Background(), "1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestHintIndex(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.HintIndex = true
+	store.AllowDiskUse = true
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if read := readBlob(t, store, "1"); !bytes.Equal(read, data) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count < 3 || stats.Size < 3000 || stats.Indexes < 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "small", bytes.NewReader(randomData(3000)), WithChunkSize(100)); err != nil {
+		t.Fatal(err)
+	}
+	data, stored, err := store.Overhead(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != 3000 || stored <= 3000 {
+		t.Errorf("Unexpected overhead: %d %d", data, stored)
+	}
+	smallData, smallStored, err := store.Overhead(context.Background(), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smallData != 3000 || smallStored-smallData <= stored-data {
+		t.Errorf("Smaller chunks should have more overhead: %d %d", smallStored-smallData, stored-data)
+	}
+	if _, _, err := store.Overhead(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCausalSession(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx, done, err := store.WithCausalSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	data := randomData(3000)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	read, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Not equal")
+	}
+}
+
+func TestReadOrder(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.ChunkSize = 100
+
+	data := randomData(100*500 + 17)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 10; k++ {
+				rd, err := store.Read(context.Background(), "1")
+				if err != nil {
+					errs <- err
+					return
+				}
+				read, err := io.ReadAll(rd)
+				rd.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(read, data) {
+					errs <- errors.New("Data read out of order")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// A segment that does not follow the previous one is detected
+	if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": "1", "seq": 10}, bson.M{"$inc": bson.M{"s": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if _, err := io.ReadAll(rd); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestReadDecodeError(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	for _, id := range []string{"ok", "middle", "first"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, seq := range map[string]int{"middle": 2, "first": 0} {
+		if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": id, "seq": seq}, bson.M{"$set": bson.M{"codec": "unknown"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, expected := range map[string]error{"ok": nil, "middle": ErrUnknownCodec, "first": ErrUnknownCodec} {
+		rd, err := store.Read(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if expected == nil && (err != nil || !bytes.Equal(read, data)) {
+			t.Errorf("%s: %v", id, err)
+		}
+		if expected != nil && !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", id, expected, err)
+		}
+	}
+}
+
+func TestChunkTooLarge(t *testing.T) {
+	store := &Store{ChunkSize: 16 * 1024 * 1024}
+	if _, err := store.NewWriter(context.Background(), "1"); !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("Expected ErrChunkTooLarge, got %v", err)
+	}
+	store.ChunkSize = 0
+	if _, err := store.NewWriter(context.Background(), "1", WithChunkSize(MaxChunkSize+1)); !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("Expected ErrChunkTooLarge, got %v", err)
+	}
+}
+
+func TestAutoIndex(t *testing.T) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+		ChunkSize:  1024,
+		AutoIndex:  true,
+	}
+	cleanupBlobs(store)
+	defer cleanupBlobs(store)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// _id, (blobId, seq), expireAt and updatedAt
+	if stats.Indexes != 4 {
+		t.Errorf("Expected 4 indexes, got %d", stats.Indexes)
+	}
+}
+
+func TestRequireIndex(t *testing.T) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection:   cli.Database("test").Collection("blob"),
+		ChunkSize:    1024,
+		RequireIndex: true,
+	}
+	cleanupBlobs(store)
+	defer cleanupBlobs(store)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Expected ErrNoIndex, got %v", err)
+	}
+	if err := store.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmptyBlob(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "empty", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]bool{"empty": true, "missing": false} {
+		exists, err := store.Exists(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expected {
+			t.Errorf("Exists(%s): %v", id, exists)
+		}
+	}
+	if size, err := store.Size(context.Background(), "empty"); err != nil || size != 0 {
+		t.Errorf("Wrong size of empty blob: %d %v", size, err)
+	}
+	if read := readBlob(t, store, "empty"); len(read) != 0 {
+		t.Errorf("Empty blob has data")
+	}
+	if _, err := store.Read(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Size(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	rd, err := store.ReadFromOffset(context.Background(), "empty", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+}
+
+func TestMaxChunks(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.MaxChunks = 3
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3072))); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Write(context.Background(), "2", bytes.NewReader(randomData(3073)))
+	if !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("Expected ErrTooManyChunks, got %v", err)
+	}
+	if exists, err := store.Exists(context.Background(), "2"); err != nil || exists {
+		t.Errorf("Blob not removed: %v %v", exists, err)
+	}
+}
+
+func TestWriteReader(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(2500)
+	info, err := store.WriteReader(context.Background(), "1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if info.Size != 2500 || info.Chunks != 3 || info.ChunkSize != 1024 || info.StoredSize != 2500 || info.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Wrong info: %+v", info)
+	}
+	hdr, err := store.getHeader(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Size != info.Size || hdr.SHA256 != info.SHA256 || hdr.Version != info.Version {
+		t.Errorf("Info does not match header: %+v %+v", info, hdr)
+	}
+}
+
+func TestNotFoundError(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	_, err := store.Read(context.Background(), "missing")
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || nf.BlobID != "missing" {
+		t.Errorf("Expected NotFoundError for missing, got %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("NotFoundError does not match ErrNotFound")
+	}
+}
+
+func TestSync(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteMulti(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	header := randomData(100)
+	body := randomData(3000)
+	n, err := store.WriteMulti(context.Background(), "1", bytes.NewReader(header), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3100 {
+		t.Errorf("Wrong size: %d", n)
+	}
+	sizes, err := store.SegmentSizes(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []uint64{1024, 1024, 1024, 28}) {
+		t.Errorf("Wrong segments: %v", sizes)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), append(header, body...)) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestClock(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	store.UploadTTL = time.Hour
+
+	upload, err := store.BeginUpload(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Abort()
+	if _, err := upload.Write(randomData(2000)); err != nil {
+		t.Fatal(err)
+	}
+	var segment blobSegment
+	if err := store.Collection.FindOne(context.Background(), bson.M{"blobId": upload.stagingID, "seq": 0}).Decode(&segment); err != nil {
+		t.Fatal(err)
+	}
+	if !segment.ExpireAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Wrong expiration: %v", segment.ExpireAt)
+	}
+}
+
+func TestDeleteOlderThan(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+
+	for _, id := range []string{"1", "2"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(3000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime, err := store.ModTime(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.Equal(now) {
+		t.Errorf("Wrong modification time: %v", modTime)
+	}
+	now = now.Add(time.Hour)
+	if err := store.Write(context.Background(), "3", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+
+	store.DryRun = true
+	n, err := store.DeleteOlderThan(context.Background(), 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Dry run: %d blobs", n)
+	}
+	store.DryRun = false
+	if n, err = store.DeleteOlderThan(context.Background(), 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Removed %d blobs", n)
+	}
+	for id, want := range map[string]bool{"1": false, "2": false, "3": true} {
+		exists, err := store.Exists(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("%s: exists %v", id, exists)
+		}
+	}
+	if _, err := store.ModTime(context.Background(), "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(&Store{Collection: store.Collection})
+
+	coll := store.Collection.Database().Collection("blob2")
+	coll.Drop(context.Background())
+	store.Reset(coll)
+	defer cleanupBlobs(store)
+	if err := store.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := coll.Indexes().List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []bson.M
+	if err := cursor.All(context.Background(), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	// _id, (blobId, seq) and expireAt
+	if len(indexes) != 3 {
+		t.Errorf("Expected 3 indexes, got %v", indexes)
+	}
+}
+
+func TestConsistentSize(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.ConsistentSize = true
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(5000))); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 5000 {
+		t.Errorf("Wrong size: %d %v", size, err)
+	}
+	// Overwrite with shorter data without closing the writer
+	w, err := store.NewWriter(context.Background(), "1", WithFlushBytes(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(randomData(1500)); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 1500 {
+		t.Errorf("Wrong size during overwrite: %d %v", size, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 1500 {
+		t.Errorf("Wrong size: %d %v", size, err)
+	}
+}
+
+func TestDeadlineFlush(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	store.Now = func() time.Time { return deadline.Add(-time.Second) }
+
+	w, err := store.NewWriter(ctx, "1", WithDeadlineFlush(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(100)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The partial chunk is persisted before the deadline
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Buffered data not flushed")
+	}
+	// Close succeeds after the context is done
+	cancel()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Size(context.Background(), "1"); err != nil || size != 100 {
+		t.Errorf("Wrong size: %d %v", size, err)
+	}
+}
+
+func TestWriteNil(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data := readBlob(t, store, "1"); len(data) != 0 {
+		t.Errorf("Expected an empty blob, got %d bytes", len(data))
+	}
+	segments, err := store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("Old segments not removed: %v", segments)
+	}
+	if exists, err := store.Exists(context.Background(), "1"); err != nil || !exists {
+		t.Errorf("Empty blob does not exist: %v", err)
+	}
+}
+
+// stallReader returns (0, nil) after its data is read
+type stallReader struct {
+	data []byte
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestProgressReader(t *testing.T) {
+	store := &Store{MaxEmptyReads: 3}
+	r := store.progressReader(&stallReader{data: []byte("abc")})
+	buf := make([]byte, 10)
+	if n, err := r.Read(buf); n != 3 || err != nil {
+		t.Errorf("Expected 3, nil, got %d %v", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := r.Read(buf); n != 0 || err != nil {
+			t.Errorf("Expected 0, nil, got %d %v", n, err)
+		}
+	}
+	if _, err := r.Read(buf); err != io.ErrNoProgress {
+		t.Errorf("Expected io.ErrNoProgress, got %v", err)
+	}
+}
+
+func TestWriteNoProgress(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	err := store.Write(context.Background(), "1", &stallReader{data: randomData(1500)})
+	if !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("Expected io.ErrNoProgress, got %v", err)
+	}
+	store.MaxEmptyReads = 1
+	err = store.Write(context.Background(), "1", &stallReader{data: randomData(1500)}, WithFlushBytes(100))
+	if !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("Expected io.ErrNoProgress, got %v", err)
+	}
+}
+
+func TestEmptyRead(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "empty", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(10))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if n, err := rd.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Expected 0, EOF, got %d %v", n, err)
+	}
+	rd, err = store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if n, err := rd.Read(nil); n != 0 || err != nil {
+		t.Errorf("Expected 0, nil for an empty read, got %d %v", n, err)
+	}
+	if n, err := rd.Read(make([]byte, 20)); n != 10 || err != nil {
+		t.Errorf("Expected 10, nil, got %d %v", n, err)
+	}
+	if n, err := rd.Read(make([]byte, 20)); n != 0 || err != io.EOF {
+		t.Errorf("Expected 0, EOF, got %d %v", n, err)
+	}
+}
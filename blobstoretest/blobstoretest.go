@@ -0,0 +1,176 @@
+// Package blobstoretest checks that a configured blobstore.Store
+// behaves as expected. Use it to test a store with the codecs,
+// encryption, chunk collection and other options of an application.
+package blobstoretest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/bserdar/blobstore"
+)
+
+// prefix is the prefix of the blob IDs written by TestStore
+const prefix = "blobstoretest/"
+
+// blobNames are the names of the blobs written by TestStore
+var blobNames = []string{"roundtrip", "empty", "truncate", "shrink", "range"}
+
+// TestStore runs round-trip, empty blob, truncation, overwrite and
+// range read checks against s. The blobs written are under the
+// "blobstoretest/" prefix, and they are removed when the test ends.
+// The indexes of s must exist, or s must have AutoIndex set.
+func TestStore(t *testing.T, s *blobstore.Store) {
+	t.Cleanup(func() {
+		ids := make([]string, 0, len(blobNames))
+		for _, name := range blobNames {
+			ids = append(ids, prefix+name)
+		}
+		if err := s.Remove(context.Background(), ids...); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, s) })
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, s) })
+	t.Run("Truncate", func(t *testing.T) { testTruncate(t, s) })
+	t.Run("OverwriteShrink", func(t *testing.T) { testOverwriteShrink(t, s) })
+	t.Run("ReadRange", func(t *testing.T) { testReadRange(t, s) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, s) })
+}
+
+// sizes returns blob sizes around the chunk size of s
+func sizes(s *blobstore.Store) []int {
+	chunk := s.ChunkSize
+	if chunk <= 0 {
+		chunk = blobstore.DefaultChunkSize
+	}
+	return []int{1, chunk - 1, chunk, chunk + 1, 3*chunk + chunk/2}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func write(t *testing.T, s *blobstore.Store, id string, data []byte) {
+	t.Helper()
+	if err := s.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Write %s: %v", id, err)
+	}
+}
+
+// check reads the blob and compares it with data
+func check(t *testing.T, s *blobstore.Store, id string, data []byte) {
+	t.Helper()
+	rd, err := s.Read(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Read %s: %v", id, err)
+	}
+	defer rd.Close()
+	read, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("Read %s: %v", id, err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("%s: read %d bytes, expected %d bytes", id, len(read), len(data))
+	}
+	size, err := s.Size(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Size %s: %v", id, err)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("%s: size %d, expected %d", id, size, len(data))
+	}
+}
+
+func testRoundTrip(t *testing.T, s *blobstore.Store) {
+	for _, n := range sizes(s) {
+		data := randomData(n)
+		id := prefix + "roundtrip"
+		write(t, s, id, data)
+		check(t, s, id, data)
+	}
+}
+
+func testEmpty(t *testing.T, s *blobstore.Store) {
+	id := prefix + "empty"
+	write(t, s, id, nil)
+	check(t, s, id, []byte{})
+	exists, err := s.Exists(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("Empty blob does not exist")
+	}
+}
+
+func testTruncate(t *testing.T, s *blobstore.Store) {
+	id := prefix + "truncate"
+	write(t, s, id, randomData(sizes(s)[4]))
+	if err := s.Write(context.Background(), id, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, id, []byte{})
+}
+
+func testOverwriteShrink(t *testing.T, s *blobstore.Store) {
+	id := prefix + "shrink"
+	all := sizes(s)
+	for i := len(all) - 1; i >= 0; i-- {
+		data := randomData(all[i])
+		write(t, s, id, data)
+		check(t, s, id, data)
+	}
+}
+
+func testReadRange(t *testing.T, s *blobstore.Store) {
+	id := prefix + "range"
+	all := sizes(s)
+	data := randomData(all[4])
+	write(t, s, id, data)
+	for _, offset := range []int{0, 1, all[1], all[2], all[3], len(data) - 1, len(data)} {
+		for _, length := range []int{0, 1, all[2], len(data)} {
+			rd, err := s.ReadRange(context.Background(), id, int64(offset), int64(length))
+			if err != nil {
+				t.Fatalf("ReadRange %d %d: %v", offset, length, err)
+			}
+			read, err := io.ReadAll(rd)
+			rd.Close()
+			if err != nil {
+				t.Fatalf("ReadRange %d %d: %v", offset, length, err)
+			}
+			end := offset + length
+			if length == 0 || end > len(data) {
+				end = len(data)
+			}
+			if !bytes.Equal(read, data[offset:end]) {
+				t.Errorf("ReadRange %d %d: wrong data", offset, length)
+			}
+		}
+	}
+	rd, err := s.ReadRange(context.Background(), id, int64(len(data)+1), 1)
+	if err != nil {
+		t.Fatalf("ReadRange beyond the end: %v", err)
+	}
+	read, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil || len(read) != 0 {
+		t.Errorf("ReadRange beyond the end: %d bytes, %v", len(read), err)
+	}
+}
+
+func testNotFound(t *testing.T, s *blobstore.Store) {
+	id := prefix + "missing"
+	if _, err := s.Read(context.Background(), id); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Read: expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Size(context.Background(), id); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Size: expected ErrNotFound, got %v", err)
+	}
+}
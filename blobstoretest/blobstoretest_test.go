@@ -0,0 +1,37 @@
+package blobstoretest
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/bserdar/blobstore"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This test requires a DB connection to a mongodb instance, given in
+// the mongo_uri environment variable. If not given,
+// mongodb://127.0.0.1:27017 is assumed.
+
+func TestStoreConformance(t *testing.T) {
+	adr := os.Getenv("mongo_uri")
+	if len(adr) == 0 {
+		adr = "mongodb://127.0.0.1:27017"
+	}
+	cli, err := mongo.Connect(context.Background(), options.Client().ApplyURI(adr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Disconnect(context.Background())
+	collection := cli.Database("test").Collection("blobstoretest")
+	defer collection.Drop(context.Background())
+	for name, store := range map[string]*blobstore.Store{
+		"Default": {Collection: collection, ChunkSize: 1024, AutoIndex: true},
+		"Gzip":    {Collection: collection, ChunkSize: 1024, AutoIndex: true, Codec: blobstore.GzipCodec{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			TestStore(t, store)
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultMaxBucketBlobSize is the default size of the largest blob
+// packed into a bucket
+const DefaultMaxBucketBlobSize = 16 * 1024
+
+// DefaultBucketBytes is the default number of data bytes written to a
+// bucket before a new bucket is started
+const DefaultBucketBytes = 1024 * 1024
+
+// BucketStore is a store that packs small blobs into bucket documents,
+// reducing the number of documents and index entries for workloads
+// writing many small blobs. A packed blob is an element of the blobs
+// array of a bucket, instead of a header and a segment in the blob
+// collection. Blobs larger than MaxBlobSize are written by Store.
+//
+// Write, Read, Open, Size, Exists, Remove and RemoveStrict work with
+// both packed blobs and blobs stored by Store. Other operations are
+// available through the Store field, and only see blobs stored by
+// Store, so Store is not embedded. Packed blobs are not compressed, and
+// write options do not apply to them. If the store encrypts blobs, or
+// detects conflicts, all blobs are written by Store.
+//
+// Blobs are appended to the bucket being filled. Removing or
+// rewriting a packed blob removes it from its bucket, but the space is
+// not reused; a bucket is removed when its last blob is removed.
+type BucketStore struct {
+	// Store stores the blobs that are not packed
+	Store *Store
+
+	// Buckets is the collection of bucket documents
+	Buckets *mongo.Collection
+
+	// MaxBlobSize is the size of the largest blob packed into a
+	// bucket. If zero, DefaultMaxBucketBlobSize is used.
+	MaxBlobSize int
+
+	// BucketBytes is the number of data bytes written to a bucket
+	// before a new bucket is started. It must be well below the
+	// maximum document size. If zero, DefaultBucketBytes is used.
+	BucketBytes int
+}
+
+// bucketBlob is a blob packed into a bucket
+type bucketBlob struct {
+	ID   string `bson:"id"`
+	Data []byte `bson:"data"`
+}
+
+// bucketDoc is a bucket with the blobs matched by a query. Bytes is
+// the number of bytes written to the bucket, and N is the number of
+// blobs in it.
+type bucketDoc struct {
+	ID    interface{}  `bson:"_id"`
+	Bytes int          `bson:"bytes"`
+	N     int          `bson:"n"`
+	Blobs []bucketBlob `bson:"blobs"`
+}
+
+// EnsureIndex creates the indexes of the store, and the indexes of the
+// bucket collection: a unique index of packed blob IDs, and an index
+// to find the bucket being filled
+func (store *BucketStore) EnsureIndex(ctx context.Context) error {
+	if err := store.Store.EnsureIndex(ctx); err != nil {
+		return err
+	}
+	_, err := store.Buckets.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "blobs.id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "bytes", Value: 1}},
+		},
+	})
+	return err
+}
+
+// autoIndex creates the indexes if AutoIndex is set
+func (store *BucketStore) autoIndex(ctx context.Context) error {
+	if !store.Store.AutoIndex {
+		return nil
+	}
+	return store.EnsureIndex(ctx)
+}
+
+func (store *BucketStore) maxBlobSize() int {
+	if store.MaxBlobSize > 0 {
+		return store.MaxBlobSize
+	}
+	return DefaultMaxBucketBlobSize
+}
+
+func (store *BucketStore) bucketBytes() int {
+	if store.BucketBytes > 0 {
+		return store.BucketBytes
+	}
+	return DefaultBucketBytes
+}
+
+// packs returns if the store packs small blobs
+func (store *BucketStore) packs() bool {
+	return store.Store.Encrypter == nil && store.Store.KeyProvider == nil && !store.Store.DetectConflicts
+}
+
+// Write writes the blob. If it is not larger than MaxBlobSize, it is
+// packed into a bucket. The blob is replaced in a transaction if the
+// deployment supports transactions.
+func (store *BucketStore) Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	if !store.packs() {
+		return store.Store.Write(ctx, blobID, data, opts...)
+	}
+	if err := store.autoIndex(ctx); err != nil {
+		return err
+	}
+	if err := store.checkPackedWritable(ctx, blobID); err != nil {
+		return err
+	}
+	if data == nil {
+		data = bytes.NewReader(nil)
+	}
+	data = store.Store.progressReader(data)
+	buf := make([]byte, store.maxBlobSize()+1)
+	n, err := io.ReadFull(data, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n > store.maxBlobSize() {
+		if err := store.Store.Write(ctx, blobID, io.MultiReader(bytes.NewReader(buf[:n]), data), opts...); err != nil {
+			return err
+		}
+		_, err := store.unpack(ctx, blobID)
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := store.Store.inTransaction(ctx, func(ctx context.Context) error {
+			if _, err := store.unpack(ctx, blobID); err != nil {
+				return err
+			}
+			if err := store.pack(ctx, blobID, buf[:n]); err != nil {
+				return err
+			}
+			return store.Store.remove(ctx, blobID)
+		})
+		// Without transactions, a concurrent writer can pack the blob
+		// between unpack and pack. Retry, so the last writer wins.
+		if !errors.Is(err, ErrConflict) || attempt == bucketWriteAttempts-1 {
+			return err
+		}
+	}
+}
+
+// bucketWriteAttempts is the number of times a packed blob is written
+// if it conflicts with concurrent writers
+const bucketWriteAttempts = 3
+
+// checkPackedWritable checks that a packed blob can be overwritten in
+// a write-once or append-only store
+func (store *BucketStore) checkPackedWritable(ctx context.Context, blobID string) error {
+	if !store.Store.WriteOnce && !store.Store.AppendOnly {
+		return nil
+	}
+	exists, err := store.Exists(ctx, blobID)
+	if err != nil || !exists {
+		return err
+	}
+	if store.Store.WriteOnce {
+		return ErrImmutable
+	}
+	return ErrAppendOnly
+}
+
+// pack adds a blob to the bucket being filled, or starts a new bucket.
+// The unique index does not apply within a bucket, so a bucket that
+// already has the blob is not filled; the upsert then fails with a
+// duplicate key instead.
+func (store *BucketStore) pack(ctx context.Context, blobID string, data []byte) error {
+	_, err := store.Buckets.UpdateOne(ctx, bson.M{
+		"bytes":    bson.M{"$lte": store.bucketBytes() - len(data)},
+		"blobs.id": bson.M{"$ne": blobID},
+	}, bson.M{
+		"$push": bson.M{"blobs": bucketBlob{ID: blobID, Data: data}},
+		"$inc":  bson.M{"bytes": len(data), "n": 1},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// Packed concurrently by another writer
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	store.Store.countBytes("write", len(data))
+	return nil
+}
+
+// unpack removes a packed blob from its bucket, and removes the bucket
+// if it is empty. Returns if the blob was packed.
+func (store *BucketStore) unpack(ctx context.Context, blobID string) (bool, error) {
+	var bucket bucketDoc
+	err := store.Buckets.FindOneAndUpdate(ctx, bson.M{"blobs.id": blobID}, bson.M{
+		"$pull": bson.M{"blobs": bson.M{"id": blobID}},
+		"$inc":  bson.M{"n": -1},
+	}, options.FindOneAndUpdate().SetProjection(bson.M{"_id": 1})).Decode(&bucket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := store.Buckets.DeleteOne(ctx, bson.M{"_id": bucket.ID, "n": bson.M{"$lte": 0}}); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// packed returns the data of a packed blob. Returns nil if the blob is
+// not packed.
+func (store *BucketStore) packed(ctx context.Context, blobID string) ([]byte, error) {
+	var bucket bucketDoc
+	err := store.Buckets.FindOne(ctx, bson.M{"blobs.id": blobID}, options.FindOne().SetProjection(bson.M{"blobs.$": 1})).Decode(&bucket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bucket.Blobs) != 1 {
+		return nil, ErrCorrupted
+	}
+	data := bucket.Blobs[0].Data
+	if data == nil {
+		data = []byte{}
+	}
+	store.Store.countBytes("read", len(data))
+	return data, nil
+}
+
+// Read returns a reader for the blob. A packed blob is fetched when it
+// is opened, holding a read slot if MaxConcurrentReads is set.
+func (store *BucketStore) Read(ctx context.Context, blobID string) (*Reader, error) {
+	if err := store.autoIndex(ctx); err != nil {
+		return nil, err
+	}
+	release, err := store.Store.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.packed(ctx, blobID)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return store.Store.Read(ctx, blobID)
+	}
+	return &Reader{ctx: ctx, store: store.Store, blobID: blobID, buf: data, size: int64(len(data)), err: io.EOF}, nil
+}
+
+// Size returns the size of the blob
+func (store *BucketStore) Size(ctx context.Context, blobID string) (int64, error) {
+	data, err := store.packed(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		return store.Store.Size(ctx, blobID)
+	}
+	return int64(len(data)), nil
+}
+
+// Exists returns if the blob exists
+func (store *BucketStore) Exists(ctx context.Context, blobID string) (bool, error) {
+	n, err := store.Buckets.CountDocuments(ctx, bson.M{"blobs.id": blobID}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+	return store.Store.Exists(ctx, blobID)
+}
+
+// Remove removes the blobs. Removing a blob that does not exist is not
+// an error.
+func (store *BucketStore) Remove(ctx context.Context, blobIDs ...string) error {
+	if store.Store.WriteOnce {
+		for _, blobID := range blobIDs {
+			if err := store.checkPackedWritable(ctx, blobID); err != nil {
+				return err
+			}
+		}
+	}
+	if store.Store.DryRun {
+		return nil
+	}
+	for _, blobID := range blobIDs {
+		if _, err := store.unpack(ctx, blobID); err != nil {
+			return err
+		}
+	}
+	return store.Store.Remove(ctx, blobIDs...)
+}
+
+// RemoveStrict removes the blob. Returns ErrNotFound if the blob does
+// not exist.
+func (store *BucketStore) RemoveStrict(ctx context.Context, blobID string) error {
+	if store.Store.WriteOnce {
+		if err := store.checkPackedWritable(ctx, blobID); err != nil {
+			return err
+		}
+	}
+	if store.Store.DryRun {
+		exists, err := store.Exists(ctx, blobID)
+		if err == nil && !exists {
+			err = notFound(blobID)
+		}
+		return err
+	}
+	unpacked, err := store.unpack(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	err = store.Store.RemoveStrict(ctx, blobID)
+	if unpacked && errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
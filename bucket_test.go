@@ -0,0 +1,166 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func setupBucketStore(t *testing.T) *BucketStore {
+	store := setupTestStore(t)
+	buckets := store.Collection.Database().Collection("bucket")
+	buckets.Drop(context.Background())
+	bs := &BucketStore{Store: store, Buckets: buckets, MaxBlobSize: 2000, BucketBytes: 5000}
+	if err := bs.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func cleanupBucketStore(store *BucketStore) {
+	store.Buckets.Drop(context.Background())
+	cleanupBlobs(store.Store)
+}
+
+func TestBucketStore(t *testing.T) {
+	store := setupBucketStore(t)
+	defer cleanupBucketStore(store)
+
+	blobs := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprint(i)
+		blobs[id] = randomData(1000)
+		if err := store.Write(context.Background(), id, bytes.NewReader(blobs[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs["large"] = randomData(3000)
+	blobs["empty"] = []byte{}
+	for _, id := range []string{"large", "empty"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(blobs[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Five blobs fit in a bucket, and the empty blob in any of them
+	if n, err := store.Buckets.CountDocuments(context.Background(), struct{}{}); err != nil || n != 2 {
+		t.Errorf("Expected 2 buckets, got %d %v", n, err)
+	}
+	if segments, err := store.Store.DumpSegments(context.Background(), "large"); err != nil || len(segments) != 3 {
+		t.Errorf("Large blob not stored as segments: %v %v", segments, err)
+	}
+	check := func() {
+		for id, data := range blobs {
+			rd, err := store.Read(context.Background(), id)
+			if err != nil {
+				t.Fatalf("%s: %v", id, err)
+			}
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(rd); err != nil {
+				t.Fatal(err)
+			}
+			rd.Close()
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("%s: wrong data", id)
+			}
+			if size, err := store.Size(context.Background(), id); err != nil || size != int64(len(data)) {
+				t.Errorf("%s: wrong size %d %v", id, size, err)
+			}
+			if exists, err := store.Exists(context.Background(), id); err != nil || !exists {
+				t.Errorf("%s: exists %v %v", id, exists, err)
+			}
+		}
+	}
+	check()
+
+	// Move blobs between the layouts
+	blobs["1"] = randomData(2500)
+	blobs["large"] = randomData(100)
+	for _, id := range []string{"1", "large"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(blobs[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+	if segments, err := store.Store.DumpSegments(context.Background(), "large"); err != nil || len(segments) != 0 {
+		t.Errorf("Old segments not removed: %v %v", segments, err)
+	}
+
+	if err := store.Remove(context.Background(), "0", "1", "2", "4", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveStrict(context.Background(), "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveStrict(context.Background(), "3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	for _, id := range []string{"0", "1", "2", "3", "4", "empty"} {
+		delete(blobs, id)
+		if exists, err := store.Exists(context.Background(), id); err != nil || exists {
+			t.Errorf("%s: exists after remove %v %v", id, exists, err)
+		}
+	}
+	check()
+	// The first bucket is removed with its last blob, and the small
+	// version of "large" is in a new bucket
+	if n, err := store.Buckets.CountDocuments(context.Background(), struct{}{}); err != nil || n != 2 {
+		t.Errorf("Expected 2 buckets, got %d %v", n, err)
+	}
+}
+
+func TestBucketPackDuplicate(t *testing.T) {
+	store := setupBucketStore(t)
+	defer cleanupBucketStore(store)
+
+	if err := store.pack(context.Background(), "a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// The bucket being filled already has the blob
+	if err := store.pack(context.Background(), "a", []byte("second")); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	var bucket bucketDoc
+	if err := store.Buckets.FindOne(context.Background(), struct{}{}).Decode(&bucket); err != nil {
+		t.Fatal(err)
+	}
+	if len(bucket.Blobs) != 1 || bucket.N != 1 || string(bucket.Blobs[0].Data) != "first" {
+		t.Errorf("Wrong bucket: %+v", bucket)
+	}
+	if n, err := store.Buckets.CountDocuments(context.Background(), struct{}{}); err != nil || n != 1 {
+		t.Errorf("Expected 1 bucket, got %d %v", n, err)
+	}
+}
+
+func BenchmarkBucketWrite(b *testing.B) {
+	cli := setupTestConnection()
+	data := randomData(1024)
+	run := func(b *testing.B, write func(id string) error) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := write(fmt.Sprint(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("Store", func(b *testing.B) {
+		store := &Store{Collection: cli.Database("test").Collection("blob")}
+		defer cleanupBlobs(store)
+		if err := store.EnsureIndex(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		run(b, func(id string) error { return store.Write(context.Background(), id, bytes.NewReader(data)) })
+	})
+	b.Run("BucketStore", func(b *testing.B) {
+		store := &BucketStore{
+			Store:   &Store{Collection: cli.Database("test").Collection("blob")},
+			Buckets: cli.Database("test").Collection("bucket"),
+		}
+		defer cleanupBucketStore(store)
+		if err := store.EnsureIndex(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		run(b, func(id string) error { return store.Write(context.Background(), id, bytes.NewReader(data)) })
+	})
+}
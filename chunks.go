@@ -0,0 +1,304 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrDedupEncrypted is returned when writing to a store that has both
+// a chunk collection and encryption configured. Chunks are shared
+// between blobs, so they cannot be encrypted with per-blob keys.
+var ErrDedupEncrypted = errors.New("Deduplication cannot be used with encryption")
+
+// ErrNoChunkCollection is returned by operations that require a chunk
+// collection if the store does not have one
+var ErrNoChunkCollection = errors.New("No chunk collection")
+
+// ChunkGracePeriod is the time since a chunk was last referenced
+// after which GCChunks removes it if no segment refers to it
+var ChunkGracePeriod = time.Hour
+
+// A chunk is the data of a segment stored once in the chunk collection,
+// keyed by the SHA-256 hash of the uncompressed data. Refs is the
+// number of segments referring to the chunk, and Touched is the last
+// time a reference was added. Segments referring to a chunk have a ref
+// field instead of data.
+type chunk struct {
+	ID      string    `bson:"_id"`
+	Data    []byte    `bson:"data"`
+	Codec   string    `bson:"codec,omitempty"`
+	Refs    int64     `bson:"refs"`
+	Touched time.Time `bson:"t"`
+}
+
+// checkDedup returns ErrDedupEncrypted if the store is configured with
+// both deduplication and encryption
+func (store *Store) checkDedup() error {
+	if store.ChunkCollection != nil && (store.Encrypter != nil || store.KeyProvider != nil) {
+		return ErrDedupEncrypted
+	}
+	return nil
+}
+
+// putChunk stores the encoded data of a chunk if it is not already
+// stored, and adds a reference to it
+func (store *Store) putChunk(ctx context.Context, ref string, data []byte, codec string) error {
+	update := bson.M{
+		"$setOnInsert": bson.M{"data": data, "codec": codec},
+		"$inc":         bson.M{"refs": 1},
+		"$set":         bson.M{"t": store.now()},
+	}
+	_, err := store.ChunkCollection.UpdateOne(ctx, bson.M{"_id": ref}, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent upsert inserted the chunk, so it is already
+		// stored. Retry to add the reference.
+		_, err = store.ChunkCollection.UpdateOne(ctx, bson.M{"_id": ref}, update, options.Update().SetUpsert(true))
+	}
+	return err
+}
+
+// retainChunks adds references to chunks
+func (store *Store) retainChunks(ctx context.Context, refs map[string]int64) error {
+	for ref, n := range refs {
+		result, err := store.ChunkCollection.UpdateOne(ctx, bson.M{"_id": ref}, bson.M{
+			"$inc": bson.M{"refs": n},
+			"$set": bson.M{"t": store.now()},
+		})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return ErrCorrupted
+		}
+	}
+	return nil
+}
+
+// releaseChunks removes references to chunks, and removes the chunks
+// that are no longer referenced. A chunk is removed only if it still
+// has no references, so a chunk that is referenced again concurrently
+// is kept, and a chunk being stored after it is removed is stored
+// again.
+func (store *Store) releaseChunks(ctx context.Context, refs map[string]int64) error {
+	for ref, n := range refs {
+		if _, err := store.ChunkCollection.UpdateOne(ctx, bson.M{"_id": ref}, bson.M{"$inc": bson.M{"refs": -n}}); err != nil {
+			return err
+		}
+		if _, err := store.ChunkCollection.DeleteOne(ctx, bson.M{"_id": ref, "refs": bson.M{"$lte": 0}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentRefs returns the number of references to each chunk from the
+// segments matching filter
+func (store *Store) segmentRefs(ctx context.Context, filter bson.M) (map[string]int64, error) {
+	match := bson.M{"ref": bson.M{"$exists": true}}
+	for k, v := range filter {
+		match[k] = v
+	}
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": "$ref", "n": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	refs := map[string]int64{}
+	for cursor.Next(ctx) {
+		var result struct {
+			Ref string `bson:"_id"`
+			N   int64  `bson:"n"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		refs[result.Ref] = result.N
+	}
+	return refs, cursor.Err()
+}
+
+// deleteSegments deletes the documents matching filter, releasing the
+// chunks referred to by deleted segments. References are released
+// after the segments are deleted, so an interruption can leave chunks
+// with too many references, but never with too few.
+func (store *Store) deleteSegments(ctx context.Context, filter bson.M) (int64, error) {
+	var refs map[string]int64
+	if store.ChunkCollection != nil {
+		var err error
+		if refs, err = store.segmentRefs(ctx, filter); err != nil {
+			return 0, err
+		}
+	}
+	result, err := store.Collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if len(refs) > 0 {
+		if err := store.releaseChunks(ctx, refs); err != nil {
+			return result.DeletedCount, err
+		}
+	}
+	return result.DeletedCount, nil
+}
+
+// resolveSegment returns the chunk document of a segment referring to
+// a chunk, or the segment itself if it has its own data. The returned
+// document has the data and codec fields of the segment.
+func (store *Store) resolveSegment(ctx context.Context, raw bson.Raw) (bson.Raw, error) {
+	val, err := raw.LookupErr("ref")
+	if err != nil {
+		return raw, nil
+	}
+	ref, ok := val.StringValueOK()
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	if store.ChunkCollection == nil {
+		return nil, ErrNoChunkCollection
+	}
+	chunkRaw, err := store.ChunkCollection.FindOne(ctx, bson.M{"_id": ref}).DecodeBytes()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCorrupted
+	}
+	return chunkRaw, err
+}
+
+// Clone creates dstID referring to the chunks of srcID, replacing any
+// existing blob with that ID. The data is not copied, only the
+// references to the chunks, so cloning a large blob is cheap. Later
+// writes to either blob store new chunks for the changed segments.
+// Returns ErrNoChunkCollection if the store does not deduplicate
+// chunks; use Snapshot to copy a blob in that case.
+func (store *Store) Clone(ctx context.Context, srcID, dstID string) error {
+	if store.ChunkCollection == nil {
+		return ErrNoChunkCollection
+	}
+	return store.Snapshot(ctx, srcID, dstID)
+}
+
+// GCChunks removes chunks that are no longer referenced, and returns
+// the number of chunks removed. Chunks are normally removed when their
+// last reference is released, but an interrupted removal can leave
+// chunks without references, and segments of abandoned uploads removed
+// by the TTL index do not release their chunks. GCChunks removes the
+// chunks with no references, and the chunks not referenced by any
+// segment that were last referenced more than ChunkGracePeriod ago.
+// The grace period protects chunks being written, since a chunk is
+// stored before the segment referring to it. GCChunks requires the
+// indexes created by EnsureIndex. If the store is in DryRun mode, the
+// chunks are counted, but not removed.
+func (store *Store) GCChunks(ctx context.Context) (int64, error) {
+	if store.ChunkCollection == nil {
+		return 0, ErrNoChunkCollection
+	}
+	removed, err := store.deleteMany(ctx, store.ChunkCollection, bson.M{"refs": bson.M{"$lte": 0}})
+	if err != nil {
+		return 0, err
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "t": 1})
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	cursor, err := store.ChunkCollection.Find(ctx, bson.M{"refs": bson.M{"$gt": 0}, "t": bson.M{"$lt": store.now().Add(-ChunkGracePeriod)}}, opts)
+	if err != nil {
+		return removed, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var c chunk
+		if err := cursor.Decode(&c); err != nil {
+			return removed, err
+		}
+		err := store.Collection.FindOne(ctx, bson.M{"ref": c.ID}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return removed, err
+		}
+		// Remove the chunk only if it was not referenced since
+		n, err := store.deleteMany(ctx, store.ChunkCollection, bson.M{"_id": c.ID, "t": c.Touched})
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, cursor.Err()
+}
+
+// MigrateChunks moves the data of segments stored inline into the
+// chunk collection, so blobs written before the store had a chunk
+// collection are deduplicated as well. Each segment is replaced by a
+// reference to the chunk with its data. Returns the number of segments
+// migrated. A segment changed while it is migrated is left as is, so
+// MigrateChunks can run while the store is in use, and it can be
+// resumed after an interruption.
+func (store *Store) MigrateChunks(ctx context.Context) (int64, error) {
+	if store.ChunkCollection == nil {
+		return 0, ErrNoChunkCollection
+	}
+	if err := store.checkDedup(); err != nil {
+		return 0, err
+	}
+	opts := options.Find()
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	cursor, err := store.Collection.Find(ctx, bson.M{
+		"seq":   bson.M{"$gte": 0},
+		"data":  bson.M{"$exists": true},
+		"nonce": bson.M{"$exists": false},
+	}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var migrated int64
+	for cursor.Next(ctx) {
+		var segment blobSegment
+		if err := cursor.Decode(&segment); err != nil {
+			return migrated, err
+		}
+		if len(segment.Hash) == 0 {
+			data, err := store.decodeSegment(ctx, nil, segment.ID, cursor.Current)
+			if err != nil {
+				return migrated, err
+			}
+			sum := sha256.Sum256(data)
+			segment.Hash = sum[:]
+		}
+		ref := hex.EncodeToString(segment.Hash)
+		if err := store.putChunk(ctx, ref, segment.Data, segment.Codec); err != nil {
+			return migrated, err
+		}
+		// The chunk is referenced before the segment refers to it
+		result, err := store.Collection.UpdateOne(ctx, bson.M{
+			"_id":  cursor.Current.Lookup("_id"),
+			"data": segment.Data,
+		}, bson.M{
+			"$set":   bson.M{"ref": ref, "h": segment.Hash},
+			"$unset": bson.M{"data": "", "codec": ""},
+		})
+		if err != nil {
+			return migrated, err
+		}
+		if result.MatchedCount == 0 {
+			if err := store.releaseChunks(ctx, map[string]int64{ref: 1}); err != nil {
+				return migrated, err
+			}
+			continue
+		}
+		migrated++
+	}
+	return migrated, cursor.Err()
+}
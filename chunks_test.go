@@ -0,0 +1,226 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func setupChunkStore(t *testing.T) *Store {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection:      cli.Database("test").Collection("blob"),
+		ChunkCollection: cli.Database("test").Collection("chunk"),
+		ChunkSize:       1024,
+	}
+	store.ChunkCollection.Drop(context.Background())
+	if err := store.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func chunkCount(t *testing.T, store *Store) int64 {
+	n, err := store.ChunkCollection.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestClone(t *testing.T) {
+	store := setupChunkStore(t)
+	defer cleanupBlobs(store)
+	defer store.ChunkCollection.Drop(context.Background())
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, store); n != 3 {
+		t.Errorf("Expected 3 chunks, got %d", n)
+	}
+	if err := store.Clone(context.Background(), "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, store); n != 3 {
+		t.Errorf("Clone should not add chunks, got %d", n)
+	}
+	if !bytes.Equal(readBlob(t, store, "2"), data) {
+		t.Errorf("Wrong cloned data")
+	}
+
+	// Overwriting the first segment of the clone adds a chunk and
+	// keeps the original
+	changed := append(randomData(1024), data[1024:]...)
+	if err := store.Write(context.Background(), "2", bytes.NewReader(changed)); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, store); n != 4 {
+		t.Errorf("Expected 4 chunks, got %d", n)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Original changed")
+	}
+	if !bytes.Equal(readBlob(t, store, "2"), changed) {
+		t.Errorf("Wrong clone data")
+	}
+
+	// Removing both releases all chunks
+	if err := store.Remove(context.Background(), "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, store); n != 0 {
+		t.Errorf("Expected no chunks, got %d", n)
+	}
+}
+
+func TestCloneNoChunkCollection(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	if err := store.Clone(context.Background(), "1", "2"); err != ErrNoChunkCollection {
+		t.Errorf("Expected ErrNoChunkCollection, got %v", err)
+	}
+}
+
+func TestChunkRefsConcurrent(t *testing.T) {
+	store := setupChunkStore(t)
+	defer cleanupBlobs(store)
+	defer store.ChunkCollection.Drop(context.Background())
+
+	// All blobs share the same chunks
+	data := randomData(4096)
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- store.Write(context.Background(), id, bytes.NewReader(data))
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	// Remove half of them while writing others
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs <- store.Remove(context.Background(), fmt.Sprint(i))
+			} else {
+				errs <- store.Write(context.Background(), fmt.Sprint(i+100), bytes.NewReader(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 10 left from the first batch, 10 written in the second
+	cursor, err := store.ChunkCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []chunk
+	if err := cursor.All(context.Background(), &chunks); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 4 chunks, got %d", len(chunks))
+	}
+	for _, c := range chunks {
+		if c.Refs != 20 {
+			t.Errorf("Expected 20 refs, got %d", c.Refs)
+		}
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	if n, err := store.GCChunks(context.Background()); err != nil || n != 0 {
+		t.Errorf("GC removed chunks in use: %d %v", n, err)
+	}
+}
+
+func TestGCChunks(t *testing.T) {
+	store := setupChunkStore(t)
+	defer cleanupBlobs(store)
+	defer store.ChunkCollection.Drop(context.Background())
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(2048))); err != nil {
+		t.Fatal(err)
+	}
+	// A chunk without references, and a chunk that is not referenced
+	// by any segment, as left by an expired upload
+	old := time.Now().Add(-2 * ChunkGracePeriod)
+	if _, err := store.ChunkCollection.InsertMany(context.Background(), []interface{}{
+		chunk{ID: "a", Data: []byte("a"), Refs: 0, Touched: time.Now()},
+		chunk{ID: "b", Data: []byte("b"), Refs: 1, Touched: old},
+		chunk{ID: "c", Data: []byte("c"), Refs: 1, Touched: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := store.GCChunks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 chunks removed, got %d", n)
+	}
+	// The chunks of blob 1, and c within the grace period
+	if n := chunkCount(t, store); n != 3 {
+		t.Errorf("Expected 3 chunks, got %d", n)
+	}
+}
+
+func TestMigrateChunks(t *testing.T) {
+	store := setupChunkStore(t)
+	defer cleanupBlobs(store)
+	defer store.ChunkCollection.Drop(context.Background())
+
+	// Write two blobs with the same data inline
+	data := randomData(3000)
+	chunks := store.ChunkCollection
+	store.ChunkCollection = nil
+	for _, id := range []string{"1", "2"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.ChunkCollection = chunks
+	n, err := store.MigrateChunks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("Expected 6 segments migrated, got %d", n)
+	}
+	if n := chunkCount(t, store); n != 3 {
+		t.Errorf("Expected 3 chunks, got %d", n)
+	}
+	for _, id := range []string{"1", "2"} {
+		if !bytes.Equal(readBlob(t, store, id), data) {
+			t.Errorf("%s: wrong data", id)
+		}
+	}
+	// Migrating again does nothing
+	if n, err := store.MigrateChunks(context.Background()); err != nil || n != 0 {
+		t.Errorf("Expected nothing migrated, got %d %v", n, err)
+	}
+	// Removing the blobs releases the chunks
+	for _, id := range []string{"1", "2"} {
+		if err := store.Remove(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := chunkCount(t, store); n != 0 {
+		t.Errorf("Expected no chunks, got %d", n)
+	}
+}
@@ -0,0 +1,225 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrUnknownCodec is returned when reading a segment compressed with a
+// codec that is not registered
+var ErrUnknownCodec = errors.New("Unknown codec")
+
+// DefaultIncompressibleRatio is the default compressed to uncompressed
+// size ratio of the first segment of a blob above which the blob is
+// stored uncompressed
+var DefaultIncompressibleRatio = 0.9
+
+// Codec compresses segment data. Each segment is compressed
+// independently, so a range of the blob can be read by decompressing
+// only the segments containing it. This compresses slightly worse than
+// compressing the whole blob as one stream, since every segment starts
+// with an empty compression window. The name of the codec is stored
+// with each compressed segment, so segments can be decompressed by a
+// codec with the same name regardless of the codec the store is
+// configured with.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(GzipCodec{})
+}
+
+// RegisterCodec registers a codec used to decompress segments
+// compressed with a codec of the same name. The gzip and zstd codecs
+// are registered by default.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// ContextCodec is a Codec that uses the context of the operation, for
+// instance to honor cancellation in a remote compression service. If
+// a codec implements ContextCodec, its context methods are called
+// instead of Compress and Decompress.
+type ContextCodec interface {
+	Codec
+	CompressContext(ctx context.Context, data []byte) ([]byte, error)
+	DecompressContext(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// compress compresses data using codec
+func compress(ctx context.Context, codec Codec, data []byte) ([]byte, error) {
+	if cc, ok := codec.(ContextCodec); ok {
+		return cc.CompressContext(ctx, data)
+	}
+	return codec.Compress(data)
+}
+
+// decompress decompresses data using codec
+func decompress(ctx context.Context, codec Codec, data []byte) ([]byte, error) {
+	if cc, ok := codec.(ContextCodec); ok {
+		return cc.DecompressContext(ctx, data)
+	}
+	return codec.Decompress(data)
+}
+
+// codec returns the codec with the given name. The codec of the store
+// is preferred over the registered codecs.
+func (store *Store) codec(name string) (Codec, error) {
+	if store.Codec != nil && store.Codec.Name() == name {
+		return store.Codec, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return codec, nil
+}
+
+// incompressible returns if a segment that compressed from n to
+// compressed bytes should be stored uncompressed
+func (store *Store) incompressible(n, compressed int) bool {
+	ratio := store.IncompressibleRatio
+	if ratio == 0 {
+		ratio = DefaultIncompressibleRatio
+	}
+	return ratio > 0 && float64(compressed) > ratio*float64(n)
+}
+
+// decodeSegment returns the data of a raw segment document, decrypting
+// and decompressing it as necessary
+func (store *Store) decodeSegment(ctx context.Context, enc Encrypter, blobID string, raw bson.Raw) ([]byte, error) {
+	data, err := segmentData(ctx, enc, blobID, raw)
+	if err != nil {
+		return nil, err
+	}
+	val, err := raw.LookupErr("codec")
+	if err != nil {
+		// Not compressed
+		return data, nil
+	}
+	name, ok := val.StringValueOK()
+	if !ok {
+		return nil, fmt.Errorf("Invalid segment codec type: %s", val.Type)
+	}
+	codec, err := store.codec(name)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(ctx, codec, data)
+}
+
+// GzipCodec compresses segments using gzip
+type GzipCodec struct {
+	// Level is the gzip compression level. If zero,
+	// gzip.DefaultCompression is used.
+	Level int
+}
+
+// Name returns "gzip"
+func (GzipCodec) Name() string { return "gzip" }
+
+// Compress compresses data using gzip
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses gzip data
+func (GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CompressionRatio returns the ratio of the logical size of a blob to
+// the number of bytes stored for it. A ratio of 2 means the blob takes
+// half its size in storage. Encryption overhead is included in the
+// stored size. The sizes recorded in the blob header are used if
+// available, otherwise they are computed from the segments. Returns 1
+// for an empty blob.
+func (store *Store) CompressionRatio(ctx context.Context, blobID string) (float64, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	var size, stored int64
+	if hdr != nil && hdr.Size > 0 && hdr.StoredSize > 0 {
+		size, stored = hdr.Size, hdr.StoredSize
+	} else {
+		cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: segmentFilter(blobID)}},
+			{{Key: "$group", Value: bson.M{
+				"_id":    nil,
+				"size":   bson.M{"$sum": "$n"},
+				"stored": bson.M{"$sum": bson.M{"$binarySize": "$data"}},
+			}}},
+		})
+		if err != nil {
+			return 0, err
+		}
+		defer cursor.Close(ctx)
+		if !cursor.Next(ctx) {
+			if err := cursor.Err(); err != nil {
+				return 0, err
+			}
+			if hdr == nil {
+				return 0, notFound(blobID)
+			}
+			return 1, nil
+		}
+		var result struct {
+			Size   int64 `bson:"size"`
+			Stored int64 `bson:"stored"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return 0, err
+		}
+		size, stored = result.Size, result.Stored
+	}
+	if stored == 0 {
+		return 1, nil
+	}
+	return float64(size) / float64(stored), nil
+}
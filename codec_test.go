@@ -0,0 +1,407 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGzipCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	for _, level := range []int{0, 1, 9} {
+		codec := GzipCodec{Level: level}
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("Not compressed at level %d", level)
+		}
+		decompressed, err := codec.Decompress(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("Not equal at level %d", level)
+		}
+	}
+}
+
+func TestZstdCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	codec, err := NewZstdCodec(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("Not compressed")
+	}
+	decompressed, err := codec.Decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Errorf("Not equal")
+	}
+	if _, err := NewZstdCodec([]byte("not a dictionary")); !errors.Is(err, ErrInvalidDictionary) {
+		t.Errorf("Expected ErrInvalidDictionary, got %v", err)
+	}
+	id, err := ZstdDictionaryID([]byte{0x37, 0xa4, 0x30, 0xec, 42, 0, 0, 0})
+	if err != nil || id != 42 {
+		t.Errorf("Wrong dictionary id: %d %v", id, err)
+	}
+}
+
+// zstdSample returns a small JSON record similar to the other samples
+func zstdSample(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order","customer":{"name":"customer %d","country":"NL"},"items":[{"sku":"item-%d","quantity":%d,"price":%d.99}],"status":"shipped"}`, i, i%17, i%31, i%5+1, i%100))
+}
+
+func TestBuildZstdDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 500; i++ {
+		samples = append(samples, zstdSample(i))
+	}
+	dict, err := BuildZstdDictionary(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dict) > 4096+1024 {
+		t.Errorf("Dictionary too large: %d", len(dict))
+	}
+	codec, err := NewZstdCodec(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewZstdCodec(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := zstdSample(1000)
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := plain.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(without) {
+		t.Errorf("Dictionary does not help: %d >= %d", len(compressed), len(without))
+	}
+	if decompressed, err := codec.Decompress(compressed); err != nil || !bytes.Equal(decompressed, data) {
+		t.Errorf("Wrong data: %v", err)
+	}
+	if _, err := BuildZstdDictionary([][]byte{{}}, 0); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("Expected ErrNoSamples, got %v", err)
+	}
+}
+
+func TestTrainZstdDictionary(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for i := 0; i < 200; i++ {
+		if err := store.Write(context.Background(), fmt.Sprintf("orders/%d", i), bytes.NewReader(zstdSample(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Write(context.Background(), "other", bytes.NewReader(randomData(1000))); err != nil {
+		t.Fatal(err)
+	}
+	dict, err := store.TrainZstdDictionary(context.Background(), ZstdTrainOptions{Prefix: "orders/", Samples: 100, DictionarySize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := NewZstdCodec(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blobs written with the dictionary read back
+	store.Codec = codec
+	if err := store.Write(context.Background(), "orders/new", bytes.NewReader(zstdSample(1000))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "orders/new"), zstdSample(1000)) {
+		t.Errorf("Wrong data")
+	}
+	if _, err := store.TrainZstdDictionary(context.Background(), ZstdTrainOptions{Prefix: "missing/"}); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("Expected ErrNoSamples, got %v", err)
+	}
+}
+
+func TestCompressedBlob(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.Codec = GzipCodec{}
+
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	if err := store.Write(context.Background(), "text", bytes.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	random := randomData(5005)
+	if err := store.Write(context.Background(), "random", bytes.NewReader(random)); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := store.getHeader(context.Background(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Codec != "gzip" {
+		t.Errorf("Text is not compressed")
+	}
+	hdr, err = store.getHeader(context.Background(), "random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Codec != "" {
+		t.Errorf("Random data is compressed")
+	}
+
+	store.Codec = nil
+	if !bytes.Equal(readBlob(t, store, "text"), text) {
+		t.Errorf("Text not equal")
+	}
+	if !bytes.Equal(readBlob(t, store, "random"), random) {
+		t.Errorf("Random data not equal")
+	}
+	n, err := store.Size(context.Background(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(text)) {
+		t.Errorf("Wrong size: %d", n)
+	}
+	ratio, err := store.CompressionRatio(context.Background(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio <= 1 {
+		t.Errorf("Wrong compression ratio: %f", ratio)
+	}
+}
+
+func TestMixedCompression(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	if err := store.Write(context.Background(), "plain", bytes.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = GzipCodec{}
+	if err := store.Write(context.Background(), "gzip", bytes.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{GzipCodec{}, nil} {
+		store.Codec = codec
+		for _, id := range []string{"plain", "gzip"} {
+			if !bytes.Equal(readBlob(t, store, id), text) {
+				t.Errorf("%s not equal with codec %v", id, codec)
+			}
+			if n, err := store.Size(context.Background(), id); err != nil || n != int64(len(text)) {
+				t.Errorf("%s: wrong size %d %v", id, n, err)
+			}
+		}
+	}
+}
+
+func TestWithCodec(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	if err := store.Write(ctx, "gzip", bytes.NewReader(text), WithCodec(GzipCodec{})); err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = GzipCodec{}
+	if err := store.Write(ctx, "plain", bytes.NewReader(text), WithCodec(nil)); err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = nil
+	for id, codec := range map[string]string{"gzip": "gzip", "plain": ""} {
+		var segment blobSegment
+		if err := store.Collection.FindOne(ctx, bson.M{"blobId": id, "seq": 0}).Decode(&segment); err != nil {
+			t.Fatal(err)
+		}
+		if segment.Codec != codec {
+			t.Errorf("%s: wrong codec %q", id, segment.Codec)
+		}
+		if !bytes.Equal(readBlob(t, store, id), text) {
+			t.Errorf("%s: wrong data", id)
+		}
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	gz, err := GzipCodec{}.Compress(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(gz)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), gz) {
+		t.Errorf("Compressed data is not returned as is")
+	}
+	store.DetectCompression = true
+	if !bytes.Equal(readBlob(t, store, "1"), text) {
+		t.Errorf("Compressed data is not decompressed")
+	}
+	rd, err := store.ReadRaw(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	raw, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, gz) {
+		t.Errorf("ReadRaw returned different data")
+	}
+}
+
+func TestCompressedRange(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.Codec = GzipCodec{}
+
+	data := bytes.Repeat([]byte("compressible data "), 500)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offsets are uncompressed
+	if segments[1].Start != 1024 || segments[1].N != 1024 || segments[1].DataLen >= 1024 {
+		t.Errorf("Wrong segment: %+v", segments[1])
+	}
+	rd, err := store.ReadFromOffset(context.Background(), "1", 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	read, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data[5000:]) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestCompressedRangeSegments(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	zstdCodec, err := NewZstdCodec(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := 0
+	store.OnBytes = func(op string, n int) {
+		if op == "read" {
+			segments++
+		}
+	}
+
+	data := bytes.Repeat([]byte("compressible data "), 500)
+	for _, codec := range []Codec{GzipCodec{}, zstdCodec} {
+		store.Codec = codec
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		// Ranges within a segment, and spanning two and three segments
+		for _, r := range [][2]int64{{10, 100}, {1000, 100}, {1500, 2000}, {8000, 5000}} {
+			segments = 0
+			rd, err := store.ReadRange(context.Background(), "1", r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := io.ReadAll(rd)
+			rd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := r[0] + r[1]
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			if !bytes.Equal(read, data[r[0]:end]) {
+				t.Errorf("%s %v: wrong data", codec.Name(), r)
+			}
+			// Only the segments overlapping the range are decompressed
+			if expected := int((end-1)/1024 - r[0]/1024 + 1); segments != expected {
+				t.Errorf("%s %v: read %d segments, expected %d", codec.Name(), r, segments, expected)
+			}
+		}
+	}
+}
+
+func TestNopEncode(t *testing.T) {
+	data := randomData(100)
+	for _, store := range []*Store{{}, {Codec: NopCodec{}, Encrypter: NopEncrypter{}}} {
+		w := store.newWriter(context.Background(), "1", 1024)
+		w.enc = encrypterOrNop(store.Encrypter)
+		// The nop codec and encrypter store plain segments, like a
+		// store without a codec and encrypter
+		segment, err := w.encode(0, 0, data, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segment.Codec != "" || segment.Nonce != nil || segment.Final != nil || !bytes.Equal(segment.Data, data) {
+			t.Errorf("Wrong segment: %+v", segment)
+		}
+		if !w.codecChecked || w.encrypts() {
+			t.Errorf("Wrong writer state")
+		}
+	}
+}
+
+func benchmarkEncode(b *testing.B, codec Codec, enc Encrypter) {
+	store := &Store{}
+	w := store.newWriter(context.Background(), "1", 256*1024)
+	w.codec = codec
+	w.codecChecked = true
+	w.enc = enc
+	data := randomData(256 * 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.encode(0, 0, data, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeDirect hashes the data as encode does, without the
+// codec and encrypter calls. BenchmarkEncodeNop encodes with the nop
+// implementations used by default, so the difference is the overhead
+// of the pipeline.
+func BenchmarkEncodeDirect(b *testing.B) {
+	data := randomData(256 * 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sha256.Sum256(data)
+	}
+}
+
+func BenchmarkEncodeNop(b *testing.B) { benchmarkEncode(b, NopCodec{}, NopEncrypter{}) }
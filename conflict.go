@@ -0,0 +1,124 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ConflictPolicy selects how Write handles a conflict with a
+// concurrent writer detected by DetectConflicts
+type ConflictPolicy int
+
+const (
+	// ConflictFail fails the write with ErrConflict. The first writer
+	// of a blob wins, and the blob is not changed by the others.
+	ConflictFail ConflictPolicy = iota
+	// ConflictRetry waits until the conflicting write finishes, and
+	// writes the data again as a staged upload, which replaces the blob
+	// atomically. The last writer to commit wins, and the blob never
+	// contains a mix of the writes. An existing blob is replaced without
+	// waiting. The data must be an io.Seeker so it can be read again,
+	// otherwise the write fails with ErrConflict.
+	ConflictRetry
+)
+
+// DefaultConflictWait is the default maximum time a write waits for a
+// conflicting write to finish
+var DefaultConflictWait = time.Minute
+
+// conflictRetryInterval is the interval at which a write polls the
+// blob while waiting for a conflicting write to finish
+const conflictRetryInterval = 50 * time.Millisecond
+
+// conflictRetry is the state needed to retry a conflicting write
+type conflictRetry struct {
+	data    io.ReadSeeker
+	offset  int64
+	version string
+}
+
+// beginConflictRetry records the position of data and the version of
+// the blob before the write. Returns nil if data cannot be read again.
+func (store *Store) beginConflictRetry(ctx context.Context, blobID string, data io.Reader) (*conflictRetry, error) {
+	seeker, ok := data.(io.ReadSeeker)
+	if !ok {
+		return nil, nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	retry := &conflictRetry{data: seeker, offset: offset}
+	if hdr != nil {
+		retry.version = hdr.Version
+	}
+	return retry, nil
+}
+
+// retryConflict waits until the write that conflicted with the write
+// of blobID is finished, and writes the data again as a staged upload
+func (store *Store) retryConflict(ctx context.Context, blobID string, retry *conflictRetry, opts ...WriteOption) (*Writer, error) {
+	if retry.version == "" {
+		if err := store.waitConflict(ctx, blobID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := retry.data.Seek(retry.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	u, err := store.BeginUpload(ctx, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := u.w.ReadFrom(retry.data); err != nil {
+		u.Abort()
+		return nil, err
+	}
+	if err := u.Commit(); err != nil {
+		return nil, err
+	}
+	return u.w, nil
+}
+
+// waitConflict waits until a new blob written by another writer is
+// closed, or removed
+func (store *Store) waitConflict(ctx context.Context, blobID string) error {
+	wait := store.ConflictWait
+	if wait <= 0 {
+		wait = DefaultConflictWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	ticker := time.NewTicker(conflictRetryInterval)
+	defer ticker.Stop()
+	for {
+		hdr, err := store.getHeader(ctx, blobID)
+		if err != nil {
+			return err
+		}
+		if hdr != nil && hdr.Version != "" {
+			return nil
+		}
+		exists, err := store.exists(ctx, blobID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrConflict
+			}
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// copyBatchBytes is the approximate number of bytes inserted in one
+// batch when copying a blob
+const copyBatchBytes = 16 * 1024 * 1024
+
+// Snapshot creates a copy of a blob under snapshotID, replacing any
+// existing blob with that ID. If the deployment supports transactions,
+// the snapshot is created in a transaction, so readers never see a
+// partial snapshot. Later changes to the blob do not affect the
+// snapshot. The snapshot gets a new version, and is not a pending
+// reservation.
+func (store *Store) Snapshot(ctx context.Context, blobID, snapshotID string) error {
+	return store.inTransaction(ctx, func(ctx context.Context) error {
+		return store.copyBlob(ctx, blobID, snapshotID)
+	})
+}
+
+// Copy replaces dstID with a copy of srcID, including its header and
+// user metadata. The copy gets a new version. The segments are copied
+// by the server with an aggregation, so the data does not pass through
+// the client. This needs the unique index created by EnsureIndex and
+// MongoDB 4.4 or later. The destination is removed before it is
+// copied, so readers may briefly see it missing; use Snapshot to
+// replace it atomically.
+// Encrypted blobs, blobs of a store with a ChunkCollection, and copies
+// made in a transaction started by WithTransaction are copied as by
+// Snapshot instead. Returns ErrNotFound if srcID does not exist.
+func (store *Store) Copy(ctx context.Context, srcID, dstID string) error {
+	if srcID == dstID {
+		return nil
+	}
+	enc, err := store.blobEncrypter(ctx, srcID)
+	if err != nil {
+		return err
+	}
+	if enc != nil || store.ChunkCollection != nil || ctx.Value(txKey{}) != nil {
+		return store.Snapshot(ctx, srcID, dstID)
+	}
+	exists, err := store.exists(ctx, srcID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound(srcID)
+	}
+	if err := store.checkWritable(ctx, dstID); err != nil {
+		return err
+	}
+	version, err := newVersion()
+	if err != nil {
+		return err
+	}
+	if err := store.remove(ctx, dstID); err != nil {
+		return err
+	}
+	// The copy is a new write of dstID, so its header gets a new
+	// version, and a pending reservation becomes an empty blob
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"blobId": srcID, "seq": bson.M{"$gte": headerSeq}}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "pending": 0}}},
+		{{Key: "$set", Value: bson.M{
+			"blobId":  dstID,
+			"version": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$seq", headerSeq}}, version, "$$REMOVE"}},
+		}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           store.Collection.Name(),
+			"on":             bson.A{"blobId", "seq"},
+			"whenMatched":    "replace",
+			"whenNotMatched": "insert",
+		}}},
+	}, store.scanAggregate())
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+// copyBlob replaces dstID with a copy of srcID. The data passes
+// through the client, so encrypted segments are re-encrypted for
+// dstID.
+func (store *Store) copyBlob(ctx context.Context, srcID, dstID string) error {
+	enc, err := store.blobEncrypter(ctx, srcID)
+	if err != nil {
+		return err
+	}
+	cursor, err := store.Collection.Find(ctx, bson.M{"blobId": srcID, "seq": bson.M{"$gte": headerSeq}}, store.findSorted(1))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		return notFound(srcID)
+	}
+	if err := store.checkWritable(ctx, dstID); err != nil {
+		return err
+	}
+	version, err := newVersion()
+	if err != nil {
+		return err
+	}
+	if err := store.remove(ctx, dstID); err != nil {
+		return err
+	}
+	var batch []interface{}
+	batchBytes := 0
+	refs := map[string]int64{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// Add the references to shared chunks before the segments
+		// referring to them are inserted
+		if err := store.retainChunks(ctx, refs); err != nil {
+			return err
+		}
+		_, err := store.Collection.InsertMany(ctx, batch)
+		batch = batch[:0]
+		batchBytes = 0
+		refs = map[string]int64{}
+		return err
+	}
+	for {
+		doc, err := store.copyDocument(ctx, enc, cursor.Current, srcID, dstID, version)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, doc)
+		if ref, ok := cursor.Current.Lookup("ref").StringValueOK(); ok {
+			refs[ref]++
+		}
+		batchBytes += len(cursor.Current)
+		if batchBytes >= copyBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if !cursor.Next(ctx) {
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// copyDocument returns a copy of a raw blob document for dstID,
+// without the document ID. Encrypted segments are re-encrypted with
+// enc. A header gets the given version, and is no longer pending.
+func (store *Store) copyDocument(ctx context.Context, enc Encrypter, raw bson.Raw, srcID, dstID, version string) (bson.D, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var ciphertext, nonce []byte
+	if _, err := raw.LookupErr("nonce"); err == nil {
+		data, err := segmentData(ctx, enc, srcID, raw)
+		if err != nil {
+			return nil, err
+		}
+		seq := raw.Lookup("seq").AsInt64()
+		if nonce, ciphertext, err = encrypt(ctx, enc, data, rawSegmentAAD(dstID, uint64(seq), raw)); err != nil {
+			return nil, err
+		}
+	}
+	isHeader := raw.Lookup("seq").AsInt64() == headerSeq
+	out := make(bson.D, 0, len(doc)+1)
+	for _, e := range doc {
+		switch e.Key {
+		case "_id", "pending", "version":
+			continue
+		case "blobId":
+			e.Value = dstID
+		case "data":
+			if ciphertext != nil {
+				e.Value = ciphertext
+			}
+		case "nonce":
+			e.Value = nonce
+		}
+		out = append(out, e)
+	}
+	if isHeader {
+		out = append(out, bson.E{Key: "version", Value: version})
+	}
+	return out, nil
+}
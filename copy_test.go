@@ -0,0 +1,159 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSnapshot(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.Encrypter, _ = NewAESGCM(make([]byte, 16))
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Snapshot(context.Background(), "1", "1@v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1@v1"), data) {
+		t.Errorf("Snapshot changed")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	data := randomData(5005)
+	if err := store.WriteWithMeta(ctx, "staging/1", bytes.NewReader(data), bson.M{"owner": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// The copy replaces a longer blob
+	if err := store.Write(ctx, "final/1", bytes.NewReader(randomData(9000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Copy(ctx, "staging/1", "final/1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"staging/1", "final/1"} {
+		if !bytes.Equal(readBlob(t, store, id), data) {
+			t.Errorf("%s: wrong data", id)
+		}
+		if meta, err := store.Metadata(ctx, id); err != nil || meta["owner"] != "a" {
+			t.Errorf("%s: wrong metadata %v %v", id, meta, err)
+		}
+	}
+	if err := store.Verify(ctx, "final/1"); err != nil {
+		t.Error(err)
+	}
+	if err := store.Copy(ctx, "missing", "final/1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	// Copies are new writes of the destination: they get a new
+	// version, and a reservation is not copied as pending
+	if _, err := store.Collection.UpdateOne(ctx, headerFilter("staging/1"), bson.M{"$set": bson.M{"pending": true}}); err != nil {
+		t.Fatal(err)
+	}
+	src, err := store.getHeader(ctx, "staging/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, copyBlob := range []func(string, string) error{
+		func(src, dst string) error { return store.Copy(ctx, src, dst) },
+		func(src, dst string) error { return store.Snapshot(ctx, src, dst) },
+	} {
+		if err := copyBlob("staging/1", "final/2"); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := store.getHeader(ctx, "final/2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Version == "" || hdr.Version == src.Version || hdr.Pending {
+			t.Errorf("Wrong header: %+v", hdr)
+		}
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Snapshot(context.Background(), "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := store.Checksum(context.Background(), "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha256.Sum256(data)
+	if !bytes.Equal(sum, expected[:]) {
+		t.Errorf("Wrong checksum")
+	}
+	if err := store.DeepVerify(context.Background(), "2"); err != nil {
+		t.Error(err)
+	}
+	// A truncated blob has the checksum of no data
+	if err := store.Write(context.Background(), "3", nil); err != nil {
+		t.Fatal(err)
+	}
+	sum, err = store.Checksum(context.Background(), "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty := sha256.Sum256(nil); !bytes.Equal(sum, empty[:]) {
+		t.Errorf("Wrong checksum of truncated blob")
+	}
+	// A blob without a recorded checksum
+	if _, err := store.Collection.UpdateOne(context.Background(), headerFilter("1"), bson.M{"$set": bson.M{"sha256": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Checksum(context.Background(), "1"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("Expected ErrNoChecksum, got %v", err)
+	}
+	if _, err := store.Checksum(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	src := setupTestStore(t)
+	defer cleanupBlobs(src)
+	dst := &Store{Collection: src.Collection.Database().Collection("blob2")}
+	defer cleanupBlobs(dst)
+	if err := dst.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(5005)
+	if err := src.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(context.Background(), dst, src, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, dst, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	if exists, err := src.Exists(context.Background(), "1"); err != nil || exists {
+		t.Errorf("Source not removed: %v %v", exists, err)
+	}
+	if err := Move(context.Background(), dst, src, "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
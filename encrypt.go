@@ -0,0 +1,385 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrNoEncrypter is returned when reading an encrypted segment from a
+// store without an Encrypter
+var ErrNoEncrypter = errors.New("No encrypter")
+
+// ErrAuthentication is returned when an encrypted segment fails
+// authentication. This happens if the segment was modified, or moved
+// to another blob or position.
+var ErrAuthentication = errors.New("Segment authentication failed")
+
+// Encrypter encrypts and decrypts segment data. Each segment is
+// encrypted independently with its own nonce. The additional
+// authenticated data binds the segment to its blob and seq, so a
+// segment cannot be moved without detection.
+type Encrypter interface {
+	// Encrypt encrypts plaintext, and returns the nonce and the
+	// ciphertext
+	Encrypt(plaintext, aad []byte) (nonce, ciphertext []byte, err error)
+	// Decrypt decrypts ciphertext. It returns an error if the
+	// ciphertext or the aad do not match.
+	Decrypt(nonce, ciphertext, aad []byte) ([]byte, error)
+}
+
+// ContextEncrypter is an Encrypter that uses the context of the
+// operation, for instance to honor cancellation in a key management
+// service. If an encrypter implements ContextEncrypter, its context
+// methods are called instead of Encrypt and Decrypt.
+type ContextEncrypter interface {
+	Encrypter
+	EncryptContext(ctx context.Context, plaintext, aad []byte) (nonce, ciphertext []byte, err error)
+	DecryptContext(ctx context.Context, nonce, ciphertext, aad []byte) ([]byte, error)
+}
+
+// encrypt encrypts plaintext using enc
+func encrypt(ctx context.Context, enc Encrypter, plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
+	if ce, ok := enc.(ContextEncrypter); ok {
+		return ce.EncryptContext(ctx, plaintext, aad)
+	}
+	return enc.Encrypt(plaintext, aad)
+}
+
+// decrypt decrypts ciphertext using enc
+func decrypt(ctx context.Context, enc Encrypter, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if ce, ok := enc.(ContextEncrypter); ok {
+		return ce.DecryptContext(ctx, nonce, ciphertext, aad)
+	}
+	return enc.Decrypt(nonce, ciphertext, aad)
+}
+
+// KeyProvider supplies the keys used to encrypt blobs, for instance
+// from a key management system. Blobs are encrypted with AES-GCM using
+// the provided keys. The key ID of a blob is stored in its header, and
+// is used to fetch the key when the blob is read.
+type KeyProvider interface {
+	// DataKey returns the key to encrypt the blob with, and its ID
+	DataKey(ctx context.Context, blobID string) (keyID string, key []byte, err error)
+	// Key returns the key with the given ID for the blob
+	Key(ctx context.Context, blobID, keyID string) ([]byte, error)
+}
+
+// writeEncrypter returns the encrypter and the key ID to write the
+// blob with
+func (store *Store) writeEncrypter(ctx context.Context, blobID string) (Encrypter, string, error) {
+	if store.KeyProvider == nil {
+		return store.Encrypter, "", nil
+	}
+	keyID, key, err := store.KeyProvider.DataKey(ctx, blobID)
+	if err != nil {
+		return nil, "", err
+	}
+	enc, err := NewAESGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return enc, keyID, nil
+}
+
+// readEncrypter returns the encrypter to read the blob with. hdr is
+// the header of the blob, which can be nil.
+func (store *Store) readEncrypter(ctx context.Context, blobID string, hdr *blobHeader) (Encrypter, error) {
+	if store.KeyProvider == nil || hdr == nil || hdr.KeyID == "" {
+		return store.Encrypter, nil
+	}
+	key, err := store.KeyProvider.Key(ctx, blobID, hdr.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return NewAESGCM(key)
+}
+
+// blobEncrypter returns the encrypter to read the blob with. The
+// header of the blob is only loaded if there is a KeyProvider.
+func (store *Store) blobEncrypter(ctx context.Context, blobID string) (Encrypter, error) {
+	if store.KeyProvider == nil {
+		return store.Encrypter, nil
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	return store.readEncrypter(ctx, blobID, hdr)
+}
+
+// AESGCM is an Encrypter using AES in Galois/Counter mode with random
+// nonces
+type AESGCM struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCM returns an AES-GCM encrypter. The key must be 16, 24, or
+// 32 bytes long, selecting AES-128, AES-192, or AES-256.
+func NewAESGCM(key []byte) (*AESGCM, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCM{aead: aead}, nil
+}
+
+// Encrypt encrypts plaintext with a random nonce
+func (a *AESGCM) Encrypt(plaintext, aad []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, a.aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// Decrypt decrypts and authenticates ciphertext
+func (a *AESGCM) Decrypt(nonce, ciphertext, aad []byte) ([]byte, error) {
+	if len(nonce) != a.aead.NonceSize() {
+		return nil, ErrAuthentication
+	}
+	plaintext, err := a.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plaintext, nil
+}
+
+// segmentAAD returns the additional authenticated data for a segment
+func segmentAAD(blobID string, seq uint64) []byte {
+	aad := make([]byte, 0, len(blobID)+8)
+	aad = append(aad, blobID...)
+	return binary.BigEndian.AppendUint64(aad, seq)
+}
+
+// finalAAD returns the additional authenticated data for a segment
+// with a final marker. final is set for the last segment of the blob.
+func finalAAD(blobID string, seq uint64, final bool) []byte {
+	aad := segmentAAD(blobID, seq)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// rawSegmentAAD returns the additional authenticated data for a raw
+// segment. Segments written before final markers were introduced do
+// not have the final field.
+func rawSegmentAAD(blobID string, seq uint64, raw bson.Raw) []byte {
+	if final, ok := raw.Lookup("final").BooleanOK(); ok {
+		return finalAAD(blobID, seq, final)
+	}
+	return segmentAAD(blobID, seq)
+}
+
+// segmentData returns the data of a raw segment document, decrypting
+// it with enc if necessary. Unencrypted data is not copied out of raw.
+func segmentData(ctx context.Context, enc Encrypter, blobID string, raw bson.Raw) ([]byte, error) {
+	val, err := raw.LookupErr("data")
+	if err != nil {
+		return nil, err
+	}
+	_, data, ok := val.BinaryOK()
+	if !ok {
+		return nil, fmt.Errorf("Invalid segment data type: %s", val.Type)
+	}
+	nonceVal, err := raw.LookupErr("nonce")
+	if err != nil {
+		// Not encrypted
+		return data, nil
+	}
+	_, nonce, ok := nonceVal.BinaryOK()
+	if !ok {
+		return nil, fmt.Errorf("Invalid segment nonce type: %s", nonceVal.Type)
+	}
+	if _, nop := enc.(NopEncrypter); enc == nil || nop {
+		return nil, ErrNoEncrypter
+	}
+	seq, ok := raw.Lookup("seq").AsInt64OK()
+	if !ok {
+		return nil, fmt.Errorf("Invalid segment seq")
+	}
+	plaintext, err := decrypt(ctx, enc, nonce, data, rawSegmentAAD(blobID, uint64(seq), raw))
+	if err != nil {
+		return nil, fmt.Errorf("Segment %d: %w", seq, err)
+	}
+	return plaintext, nil
+}
+
+// ErrNoKeyProvider is returned by Rekey if the store has no
+// KeyProvider
+var ErrNoKeyProvider = errors.New("No key provider")
+
+// ErrKeyProvider is returned by RekeyEncrypter if the store has a
+// KeyProvider
+var ErrKeyProvider = errors.New("Store has a key provider")
+
+// Rekey re-encrypts the segments of a blob with the key keyID of the
+// KeyProvider, and records keyID in the header of the blob, so the
+// blob is read with that key. If keyID is empty, a new data key is
+// requested with DataKey. Segments are decrypted with the current
+// encrypter of the blob. Unencrypted segments are encrypted. The
+// logical content of the blob does not change, and other blobs are not
+// affected. The final markers of encrypted segments are kept. Segments
+// that were not encrypted do not get final markers, so truncation of
+// such a blob is not detected. Returns ErrNoKeyProvider if the store
+// has no KeyProvider; use RekeyEncrypter for stores that only have an
+// Encrypter.
+//
+// Rekey is interruptible: the target key is recorded in the header
+// before the segments are updated one by one, and segments that are
+// already encrypted with it are skipped, so an interrupted Rekey is
+// resumed by calling it again, with the same key even if keyID is
+// empty. The blob cannot be read while rekeying is in progress.
+func (store *Store) Rekey(ctx context.Context, blobID, keyID string) error {
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	if store.ChunkCollection != nil {
+		return ErrDedupEncrypted
+	}
+	if store.KeyProvider == nil {
+		return ErrNoKeyProvider
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	oldEnc, err := store.readEncrypter(ctx, blobID, hdr)
+	if err != nil {
+		return err
+	}
+	if keyID == "" && hdr != nil {
+		keyID = hdr.RekeyID
+	}
+	var newKey []byte
+	if keyID == "" {
+		keyID, newKey, err = store.KeyProvider.DataKey(ctx, blobID)
+	} else {
+		newKey, err = store.KeyProvider.Key(ctx, blobID, keyID)
+	}
+	if err != nil {
+		return err
+	}
+	newEnc, err := NewAESGCM(newKey)
+	if err != nil {
+		return err
+	}
+	cursor, err := store.openSegments(ctx, segmentFilter(blobID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound(blobID)
+	}
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	fields := bson.M{"rekeyId": keyID}
+	if hdr == nil {
+		// The key ID is recorded in the header, so create one for a
+		// blob written by an older version of this package
+		size, err := store.blobEnd(ctx, blobID)
+		if err != nil {
+			return err
+		}
+		fields["size"] = size
+		fields["storedSize"] = int64(-1)
+	}
+	if err := store.setHeader(ctx, blobID, fields); err != nil {
+		return err
+	}
+	if err := store.rekeySegments(ctx, blobID, cursor, oldEnc, newEnc); err != nil {
+		return err
+	}
+	_, err = store.Collection.UpdateOne(ctx, headerFilter(blobID), bson.M{
+		"$set":   bson.M{"keyId": keyID},
+		"$unset": bson.M{"rekeyId": ""},
+	})
+	return err
+}
+
+// RekeyEncrypter re-encrypts the segments of a blob with newEnc, for
+// stores that encrypt with an Encrypter and have no KeyProvider. The
+// segments are decrypted with the Encrypter of the store, and the key
+// is not recorded, so the Encrypter of the store must be replaced with
+// newEnc once all blobs are rekeyed; until then, rekeyed blobs cannot
+// be read through the store. As in Rekey, unencrypted segments are
+// encrypted, the final markers are kept, and an interrupted
+// RekeyEncrypter is resumed by calling it again with the same
+// encrypter. Returns ErrKeyProvider if the store has a KeyProvider.
+func (store *Store) RekeyEncrypter(ctx context.Context, blobID string, newEnc Encrypter) error {
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	if store.ChunkCollection != nil {
+		return ErrDedupEncrypted
+	}
+	if store.KeyProvider != nil {
+		return ErrKeyProvider
+	}
+	cursor, err := store.openSegments(ctx, segmentFilter(blobID))
+	if errors.Is(err, ErrNotFound) {
+		return notFound(blobID)
+	}
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return store.rekeySegments(ctx, blobID, cursor, store.Encrypter, newEnc)
+}
+
+// rekeySegments re-encrypts the segments of an open cursor with newEnc,
+// starting with the current one
+func (store *Store) rekeySegments(ctx context.Context, blobID string, cursor *mongo.Cursor, oldEnc, newEnc Encrypter) error {
+	for {
+		if err := store.rekeySegment(ctx, blobID, cursor.Current, oldEnc, newEnc); err != nil {
+			return err
+		}
+		if !cursor.Next(ctx) {
+			break
+		}
+	}
+	return cursor.Err()
+}
+
+// rekeySegment re-encrypts a raw segment with newEnc
+func (store *Store) rekeySegment(ctx context.Context, blobID string, raw bson.Raw, oldEnc, newEnc Encrypter) error {
+	store.countSegment(raw)
+	var segment segmentPos
+	if err := bson.Unmarshal(raw, &segment); err != nil {
+		return err
+	}
+	data, err := segmentData(ctx, oldEnc, blobID, raw)
+	if errors.Is(err, ErrAuthentication) || errors.Is(err, ErrNoEncrypter) {
+		// The segment may already be encrypted with the new key
+		if _, err := segmentData(ctx, newEnc, blobID, raw); err == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	nonce, ciphertext, err := encrypt(ctx, newEnc, data, rawSegmentAAD(blobID, segment.Seq, raw))
+	if err != nil {
+		return err
+	}
+	_, err = store.Collection.UpdateOne(ctx, bson.M{"blobId": blobID, "seq": segment.Seq}, bson.M{"$set": bson.M{
+		"data":  ciphertext,
+		"nonce": nonce,
+	}})
+	if err != nil {
+		return err
+	}
+	store.countBytes("write", len(ciphertext))
+	return nil
+}
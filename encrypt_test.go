@@ -0,0 +1,373 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestAESGCM(t *testing.T) {
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(100)
+	nonce, ciphertext, err := enc.Encrypt(data, segmentAAD("1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := enc.Decrypt(nonce, ciphertext, segmentAAD("1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, data) {
+		t.Errorf("Not equal")
+	}
+	if _, err := enc.Decrypt(nonce, ciphertext, segmentAAD("1", 1)); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Moved segment decrypted: %v", err)
+	}
+	if _, err := enc.Decrypt(nonce, ciphertext, segmentAAD("2", 0)); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Segment of another blob decrypted: %v", err)
+	}
+	ciphertext[0]++
+	if _, err := enc.Decrypt(nonce, ciphertext, segmentAAD("1", 0)); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Modified segment decrypted: %v", err)
+	}
+}
+
+func TestEncryptedBlob(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Encrypter = enc
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+
+	// Swap the first two segments
+	var s0, s1 blobSegment
+	if err := store.Collection.FindOne(context.Background(), bson.M{"blobId": "1", "seq": 0}).Decode(&s0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Collection.FindOne(context.Background(), bson.M{"blobId": "1", "seq": 1}).Decode(&s1); err != nil {
+		t.Fatal(err)
+	}
+	s0.Seq, s1.Seq = 1, 0
+	if _, err := store.Collection.ReplaceOne(context.Background(), bson.M{"blobId": "1", "seq": 0}, s1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.ReplaceOne(context.Background(), bson.M{"blobId": "1", "seq": 1}, s0); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if _, err := io.ReadAll(rd); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+}
+
+func TestFinalMarker(t *testing.T) {
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Store{Encrypter: enc}
+	w := store.newWriter(context.Background(), "1", 1024)
+	w.enc = enc
+	data := randomData(100)
+	for _, final := range []bool{false, true} {
+		segment, err := w.encode(0, 0, data, final)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := bson.Marshal(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.decodeSegment(context.Background(), enc, "1", raw); err != nil {
+			t.Errorf("Final %v: %v", final, err)
+		}
+		// Changing or removing the marker fails authentication
+		flipped := !final
+		segment.Final = &flipped
+		if raw, err = bson.Marshal(segment); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.decodeSegment(context.Background(), enc, "1", raw); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Final %v: changed marker accepted: %v", final, err)
+		}
+		segment.Final = nil
+		if raw, err = bson.Marshal(segment); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.decodeSegment(context.Background(), enc, "1", raw); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Final %v: removed marker accepted: %v", final, err)
+		}
+	}
+
+	// Segments without a marker are authenticated without it
+	nonce, ciphertext, err := enc.Encrypt(data, segmentAAD("1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(blobSegment{ID: "1", Data: ciphertext, Nonce: nonce, N: uint64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := store.decodeSegment(context.Background(), enc, "1", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("Wrong data")
+	}
+}
+
+func TestEncryptedTruncation(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Encrypter = enc
+
+	// The second blob ends at a segment boundary
+	for _, size := range []int{5005, 4096} {
+		data := randomData(size)
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readBlob(t, store, "1"), data) {
+			t.Errorf("%d: Not equal", size)
+		}
+		if err := store.DeepVerify(context.Background(), "1"); err != nil {
+			t.Errorf("%d: DeepVerify: %v", size, err)
+		}
+
+		// Remove the last segment
+		var last blobSegment
+		if err := store.Collection.FindOne(context.Background(), bson.M{"blobId": "1", "seq": bson.M{"$gte": 0}},
+			options.FindOne().SetSort(bson.M{"seq": -1})).Decode(&last); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "1", "seq": last.Seq}); err != nil {
+			t.Fatal(err)
+		}
+		rd, err := store.Read(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(rd); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%d: Expected ErrCorrupted, got %v", size, err)
+		}
+		rd.Close()
+		if err := store.DeepVerify(context.Background(), "1"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%d: DeepVerify: expected ErrCorrupted, got %v", size, err)
+		}
+	}
+}
+
+type testKeyProvider map[string][]byte
+
+func (p testKeyProvider) DataKey(ctx context.Context, blobID string) (string, []byte, error) {
+	return "k1", p["k1"], nil
+}
+
+func (p testKeyProvider) Key(ctx context.Context, blobID, keyID string) ([]byte, error) {
+	key, ok := p[keyID]
+	if !ok {
+		return nil, errors.New("Unknown key")
+	}
+	return key, nil
+}
+
+func TestKeyProvider(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.KeyProvider = testKeyProvider{"k1": make([]byte, 16)}
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Not equal")
+	}
+	store.KeyProvider = nil
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if _, err := io.ReadAll(rd); !errors.Is(err, ErrNoEncrypter) {
+		t.Errorf("Expected ErrNoEncrypter, got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	oldKey := make([]byte, 32)
+	store.Encrypter, _ = NewAESGCM(oldKey)
+
+	ctx := context.Background()
+	data := randomData(5005)
+	other := randomData(3000)
+	// Blobs written with the store encrypter and with a provided key
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Rekey(ctx, "1", "k2"); !errors.Is(err, ErrNoKeyProvider) {
+		t.Errorf("Expected ErrNoKeyProvider, got %v", err)
+	}
+	store.KeyProvider = testKeyProvider{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 32)}
+	if err := store.Write(ctx, "2", bytes.NewReader(other)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Rekey(ctx, "1", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	// Rekeying again is a no-op
+	if err := store.Rekey(ctx, "1", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := store.getHeader(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.KeyID != "k2" || hdr.RekeyID != "" {
+		t.Errorf("Wrong key: %+v", hdr)
+	}
+	// The rekeyed and the untouched blob are read through the same store
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Rekeyed blob not equal")
+	}
+	if !bytes.Equal(readBlob(t, store, "2"), other) {
+		t.Errorf("Untouched blob not equal")
+	}
+	// An empty key ID rotates to a new data key
+	if err := store.Rekey(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Rotated blob not equal")
+	}
+}
+
+func TestRekeyEncrypter(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	oldEnc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnc, err := NewAESGCM(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Encrypter = oldEnc
+
+	ctx := context.Background()
+	data := randomData(5005)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RekeyEncrypter(ctx, "1", newEnc); err != nil {
+		t.Fatal(err)
+	}
+	// Rekeying again is a no-op
+	if err := store.RekeyEncrypter(ctx, "1", newEnc); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RekeyEncrypter(ctx, "2", newEnc); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	// The blob is read with the new encrypter once the store uses it
+	rd, err := store.Read(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rd); err == nil {
+		t.Errorf("Rekeyed blob read with the old encrypter")
+	}
+	rd.Close()
+	store.Encrypter = newEnc
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Rekeyed blob not equal")
+	}
+	if err := store.DeepVerify(ctx, "1"); err != nil {
+		t.Error(err)
+	}
+
+	store.KeyProvider = testKeyProvider{"k1": bytes.Repeat([]byte{1}, 32)}
+	if err := store.RekeyEncrypter(ctx, "1", oldEnc); !errors.Is(err, ErrKeyProvider) {
+		t.Errorf("Expected ErrKeyProvider, got %v", err)
+	}
+}
+
+type ctxKey struct{}
+
+// ctxEncrypter checks that it is called with the context of the
+// operation
+type ctxEncrypter struct {
+	Encrypter
+	t *testing.T
+}
+
+func (e ctxEncrypter) EncryptContext(ctx context.Context, plaintext, aad []byte) ([]byte, []byte, error) {
+	if ctx.Value(ctxKey{}) == nil {
+		e.t.Errorf("Encrypt called without the operation context")
+	}
+	return e.Encrypt(plaintext, aad)
+}
+
+func (e ctxEncrypter) DecryptContext(ctx context.Context, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if ctx.Value(ctxKey{}) == nil {
+		e.t.Errorf("Decrypt called without the operation context")
+	}
+	return e.Decrypt(nonce, ciphertext, aad)
+}
+
+func TestContextEncrypter(t *testing.T) {
+	aes, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	store := &Store{Encrypter: ctxEncrypter{Encrypter: aes, t: t}}
+	w := store.newWriter(ctx, "1", 1024)
+	w.enc = store.Encrypter
+	data := randomData(100)
+	segment, err := w.encode(0, 0, data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := store.decodeSegment(ctx, store.Encrypter, "1", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("Wrong data")
+	}
+}
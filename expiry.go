@@ -0,0 +1,113 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WriteWithExpiry writes the blob, which expires at t. See WithExpiry.
+func (store *Store) WriteWithExpiry(ctx context.Context, blobID string, data io.Reader, t time.Time) error {
+	return store.Write(ctx, blobID, data, WithExpiry(t))
+}
+
+// SetExpiry makes an existing blob expire at t. All segments and the
+// header of the blob are stamped with t. If t is zero, the blob no
+// longer expires. Returns ErrNotFound if the blob does not exist.
+func (store *Store) SetExpiry(ctx context.Context, blobID string, t time.Time) error {
+	update := bson.M{"$unset": bson.M{"expireAt": ""}}
+	if !t.IsZero() {
+		update = bson.M{"$set": bson.M{"expireAt": t}}
+	}
+	result, err := store.Collection.UpdateMany(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": headerSeq}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return notFound(blobID)
+	}
+	return nil
+}
+
+// GC removes the blobs that have expired, and returns the number of
+// blobs removed. The TTL index removes expired documents one by one,
+// so GC also removes blobs that are partially removed by it, as the
+// remaining documents of such blobs have expired as well. Abandoned
+// uploads and reservations are removed too. GC also removes the
+// orphaned segments of blobs whose removal was interrupted, such as by
+// a failed Remove or DeleteMany: segments of a blob without a first
+// segment are orphans, since writers write the first segment of a blob
+// before the others. A blob that lost segments after its first one
+// cannot be told apart from a truncated blob, so it is left to
+// CheckIntegrity and Repair. A blob written again after it is selected
+// is kept. If the store is in DryRun mode, the blobs are counted, but
+// not removed. GC requires the indexes created by EnsureIndex.
+func (store *Store) GC(ctx context.Context) (int64, error) {
+	now := store.now()
+	expired := bson.M{"expireAt": bson.M{"$lt": now}, "seq": bson.M{"$gte": headerSeq}}
+	removed, err := store.collect(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: expired}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId"}}},
+	}, func(ctx context.Context, blobID string) (bool, error) {
+		// Check that the blob was not written since it was selected
+		n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": blobID, "expireAt": bson.M{"$lt": now}, "seq": bson.M{"$gte": headerSeq}})
+		return n > 0, err
+	})
+	if err != nil {
+		return removed, err
+	}
+	// Expired orphans are removed above
+	orphans, err := store.collect(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"seq": bson.M{"$gte": 0}, "blobId": notInternal(), "expireAt": bson.M{"$not": bson.M{"$lt": now}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId", "first": bson.M{"$min": "$seq"}}}},
+		{{Key: "$match", Value: bson.M{"first": bson.M{"$gt": 0}}}},
+	}, func(ctx context.Context, blobID string) (bool, error) {
+		// Check that the first segment was not written since the blob
+		// was selected
+		n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": blobID, "seq": 0})
+		return n == 0, err
+	})
+	return removed + orphans, err
+}
+
+// collect removes the blobs whose IDs are returned as _id by pipeline,
+// if selected still returns true for them in the transaction removing
+// them. Returns the number of blobs removed.
+func (store *Store) collect(ctx context.Context, pipeline mongo.Pipeline, selected func(ctx context.Context, blobID string) (bool, error)) (int64, error) {
+	cursor, err := store.Collection.Aggregate(ctx, pipeline, store.scanAggregate())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var removed int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return removed, err
+		}
+		if store.DryRun {
+			removed++
+			continue
+		}
+		deleted := false
+		err := store.inTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			if deleted, err = selected(ctx, doc.ID); err != nil || !deleted {
+				return err
+			}
+			return store.remove(ctx, doc.ID)
+		})
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+	return removed, cursor.Err()
+}
@@ -0,0 +1,79 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGC(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for _, id := range []string{"expired", "partial", "kept"} {
+		if err := store.WriteWithExpiry(ctx, id, bytes.NewReader(randomData(3000)), expireAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.AtomicWrites = true
+	if err := store.WriteWithExpiry(ctx, "staged", bytes.NewReader(randomData(3000)), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	store.AtomicWrites = false
+	for _, id := range []string{"plain", "orphan", "headerless"} {
+		if err := store.Write(ctx, id, bytes.NewReader(randomData(3000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr, err := store.getHeader(ctx, "staged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr == nil || !hdr.ExpireAt.Equal(expireAt) {
+		t.Errorf("Wrong expiration of a staged write: %v", hdr)
+	}
+	if err := store.SetExpiry(ctx, "kept", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetExpiry(ctx, "missing", expireAt); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	// Simulate the TTL monitor removing some documents of a blob
+	if _, err := store.Collection.DeleteMany(ctx, bson.M{"blobId": "partial", "seq": bson.M{"$lt": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an interrupted Remove, and a blob written by an older
+	// version of this package, which is not an orphan
+	if _, err := store.Collection.DeleteMany(ctx, bson.M{"blobId": "orphan", "seq": bson.M{"$lt": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.DeleteOne(ctx, headerFilter("headerless")); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Now = func() time.Time { return expireAt.Add(time.Minute) }
+	store.DryRun = true
+	if n, err := store.GC(ctx); err != nil || n != 4 {
+		t.Errorf("Wrong dry run count: %d %v", n, err)
+	}
+	store.DryRun = false
+	if n, err := store.GC(ctx); err != nil || n != 4 {
+		t.Errorf("Wrong count: %d %v", n, err)
+	}
+	for _, id := range []string{"expired", "partial", "staged", "orphan"} {
+		if n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": id}); err != nil || n != 0 {
+			t.Errorf("%s not removed: %d %v", id, n, err)
+		}
+	}
+	for _, id := range []string{"kept", "plain", "headerless"} {
+		if n, err := store.Size(ctx, id); err != nil || n != 3000 {
+			t.Errorf("%s: wrong size %d %v", id, n, err)
+		}
+	}
+}
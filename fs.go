@@ -0,0 +1,233 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FS returns the blobs of the store as a read-only file system. Blob
+// IDs are paths, so the blob "a/b/c" is the file c in the directory
+// a/b. Directories are not stored; a directory exists if there are
+// blobs under it. A blob whose ID is also the prefix of other blobs
+// hides the directory of the same name. Blob IDs that are not valid
+// paths, such as IDs with a leading slash, are not accessible. The
+// returned file system can be served with http.FileServer using
+// http.FS. All operations use ctx.
+func (store *Store) FS(ctx context.Context) fs.FS {
+	return &blobFS{ctx: ctx, store: store}
+}
+
+type blobFS struct {
+	ctx   context.Context
+	store *Store
+}
+
+// Open opens the blob or the directory name
+func (f *blobFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		info, err := f.stat(name)
+		if err == nil {
+			return &blobFile{blobSeeker: blobSeeker{ctx: f.ctx, store: f.store, blobID: name, size: info.size}, info: info}, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	entries, err := f.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &blobDir{info: blobInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+}
+
+// ReadDir returns the entries of the directory name, sorted by name
+func (f *blobFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir, ok := file.(*blobDir)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("Not a directory")}
+	}
+	return dir.ReadDir(-1)
+}
+
+// stat returns the file info of the blob name
+func (f *blobFS) stat(name string) (blobInfo, error) {
+	size, err := f.store.Size(f.ctx, name)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	modTime, err := f.store.ModTime(f.ctx, name)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	return blobInfo{name: path.Base(name), size: size, modTime: modTime}, nil
+}
+
+// readDir returns the immediate children of the directory name. The
+// children are grouped by the database: each blob under the directory
+// contributes the first component of its ID after the directory,
+// which is a directory if more components follow.
+func (f *blobFS) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+	rest := bson.M{"$substrBytes": bson.A{"$blobId", len(prefix), -1}}
+	slash := bson.M{"$indexOfBytes": bson.A{rest, "/"}}
+	cursor, err := f.store.Collection.Aggregate(f.ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$and": bson.A{
+				bson.M{"blobId": prefixFilter(prefix)},
+				bson.M{"blobId": notInternal()},
+			},
+			"seq": bson.M{"$in": bson.A{headerSeq, 0}},
+		}}},
+		{{Key: "$project", Value: bson.M{"slash": slash, "rest": rest}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"$cond": bson.A{
+				bson.M{"$lt": bson.A{"$slash", 0}},
+				"$rest",
+				bson.M{"$substrBytes": bson.A{"$rest", 0, "$slash"}},
+			}},
+			"file": bson.M{"$max": bson.M{"$lt": bson.A{"$slash", 0}}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}, f.store.scanAggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(f.ctx)
+	var entries []fs.DirEntry
+	for cursor.Next(f.ctx) {
+		var doc struct {
+			Name string `bson:"_id"`
+			File bool   `bson:"file"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if !fs.ValidPath(doc.Name) || doc.Name == "." {
+			continue
+		}
+		entries = append(entries, &blobDirEntry{fs: f, path: prefix + doc.Name, name: doc.Name, dir: !doc.File})
+	}
+	return entries, cursor.Err()
+}
+
+// blobInfo is the fs.FileInfo of a blob or a directory
+type blobInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i blobInfo) Name() string       { return i.name }
+func (i blobInfo) Size() int64        { return i.size }
+func (i blobInfo) ModTime() time.Time { return i.modTime }
+func (i blobInfo) IsDir() bool        { return i.dir }
+func (i blobInfo) Sys() interface{}   { return nil }
+
+func (i blobInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// blobDirEntry is a directory entry. The file info of a blob is read
+// when Info is called.
+type blobDirEntry struct {
+	fs   *blobFS
+	path string
+	name string
+	dir  bool
+}
+
+func (e *blobDirEntry) Name() string { return e.name }
+func (e *blobDirEntry) IsDir() bool  { return e.dir }
+
+func (e *blobDirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *blobDirEntry) Info() (fs.FileInfo, error) {
+	if e.dir {
+		return blobInfo{name: e.name, dir: true}, nil
+	}
+	info, err := e.fs.stat(e.path)
+	if errors.Is(err, ErrNotFound) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.path, Err: err}
+	}
+	return info, nil
+}
+
+// blobFile is an open blob
+type blobFile struct {
+	blobSeeker
+	info blobInfo
+}
+
+func (f *blobFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// blobDir is an open directory
+type blobDir struct {
+	info    blobInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *blobDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *blobDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("Is a directory")}
+}
+
+func (d *blobDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, or all
+// remaining entries if n is not positive
+func (d *blobDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	left := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return left, nil
+	}
+	if len(left) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(left) {
+		n = len(left)
+	}
+	d.offset += n
+	return left[:n], nil
+}
@@ -0,0 +1,78 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestFS(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(3000)
+	for _, id := range []string{"a/b/c", "a/b/d", "a/e", "f", "/invalid"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := store.FS(context.Background())
+	names := func(dir string) []string {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+	for dir, expected := range map[string][]string{
+		".":   {"a/", "f"},
+		"a":   {"b/", "e"},
+		"a/b": {"c", "d"},
+	} {
+		if got := names(dir); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", dir, expected, got)
+		}
+	}
+
+	read, err := fs.ReadFile(fsys, "a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Wrong data")
+	}
+	info, err := fs.Stat(fsys, "a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "c" || info.Size() != 3000 || info.IsDir() {
+		t.Errorf("Wrong info: %s %d %v", info.Name(), info.Size(), info.IsDir())
+	}
+	file, err := fsys.Open("a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.(io.Seeker).Seek(1000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	read, _ = io.ReadAll(file)
+	file.Close()
+	if !bytes.Equal(read, data[1000:]) {
+		t.Errorf("Wrong data after seek")
+	}
+	if _, err := fsys.Open("a/x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
@@ -2,11 +2,13 @@ module github.com/bserdar/blobstore
 
 go 1.19
 
-require go.mongodb.org/mongo-driver v1.11.3
+require (
+	github.com/klauspost/compress v1.17.0
+	go.mongodb.org/mongo-driver v1.11.3
+)
 
 require (
 	github.com/golang/snappy v0.0.1 // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
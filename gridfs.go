@@ -0,0 +1,201 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BlobStore is the common interface of Store, BucketStore and
+// GridFSStore, so an application can switch between them, for
+// instance while migrating from GridFS. Readers returned by Open must
+// be closed.
+type BlobStore interface {
+	Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error
+	Open(ctx context.Context, blobID string) (io.ReadCloser, error)
+	Size(ctx context.Context, blobID string) (int64, error)
+	Exists(ctx context.Context, blobID string) (bool, error)
+	Remove(ctx context.Context, blobIDs ...string) error
+}
+
+var (
+	_ BlobStore = (*Store)(nil)
+	_ BlobStore = (*BucketStore)(nil)
+	_ BlobStore = (*GridFSStore)(nil)
+)
+
+// Open returns a reader for the blob. It is Read returning an
+// io.ReadCloser.
+func (store *Store) Open(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Open returns a reader for the blob. It is Read returning an
+// io.ReadCloser.
+func (store *BucketStore) Open(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// GridFSStore is a BlobStore keeping blobs in a GridFS bucket. The ID
+// of a blob is the file name, and the latest revision of a file is the
+// blob. Writing a blob uploads a new revision, and removes the older
+// ones once it is complete. GridFS streams use deadlines instead of
+// contexts, so only the deadline of ctx applies to reading and writing
+// the data. Write options are ignored.
+type GridFSStore struct {
+	Bucket *gridfs.Bucket
+}
+
+// Write uploads data as the new revision of the file blobID
+func (g *GridFSStore) Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	us, err := g.Bucket.OpenUploadStream(blobID)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		us.SetWriteDeadline(deadline)
+	}
+	if data != nil {
+		if _, err := io.Copy(us, data); err != nil {
+			us.Abort()
+			return err
+		}
+	}
+	if err := us.Close(); err != nil {
+		return err
+	}
+	return g.removeRevisions(ctx, bson.M{"filename": blobID, "_id": bson.M{"$ne": us.FileID}})
+}
+
+// Open returns a reader for the latest revision of the file blobID.
+// Returns ErrNotFound if the file does not exist.
+func (g *GridFSStore) Open(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	ds, err := g.Bucket.OpenDownloadStreamByName(blobID)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, notFound(blobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ds.SetReadDeadline(deadline)
+	}
+	return ds, nil
+}
+
+// Size returns the length of the latest revision of the file blobID.
+// Returns ErrNotFound if the file does not exist.
+func (g *GridFSStore) Size(ctx context.Context, blobID string) (int64, error) {
+	cursor, err := g.Bucket.FindContext(ctx, bson.M{"filename": blobID},
+		options.GridFSFind().SetSort(bson.M{"uploadDate": -1}).SetLimit(1))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return 0, err
+		}
+		return 0, notFound(blobID)
+	}
+	var file gridfs.File
+	if err := cursor.Decode(&file); err != nil {
+		return 0, err
+	}
+	return file.Length, nil
+}
+
+// Exists returns if the file blobID exists
+func (g *GridFSStore) Exists(ctx context.Context, blobID string) (bool, error) {
+	_, err := g.Size(ctx, blobID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove removes all revisions of the files. Removing a file that
+// does not exist is not an error.
+func (g *GridFSStore) Remove(ctx context.Context, blobIDs ...string) error {
+	for _, blobID := range blobIDs {
+		if err := g.removeRevisions(ctx, bson.M{"filename": blobID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRevisions removes the files matching filter
+func (g *GridFSStore) removeRevisions(ctx context.Context, filter bson.M) error {
+	cursor, err := g.Bucket.GetFilesCollection().Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := g.Bucket.DeleteContext(ctx, file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportFromGridFS writes the latest revision of the GridFS file with
+// the given name as the blob of the same ID. The data is streamed, so
+// the file is not buffered in memory. Returns ErrNotFound if the file
+// does not exist.
+func (store *Store) ImportFromGridFS(ctx context.Context, bucket *gridfs.Bucket, filename string, opts ...WriteOption) error {
+	rd, err := (&GridFSStore{Bucket: bucket}).Open(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return store.Write(ctx, filename, rd, opts...)
+}
+
+// ImportFromGridFSByID writes the GridFS file with the given ID as the
+// blob blobID. Returns ErrNotFound if the file does not exist.
+func (store *Store) ImportFromGridFSByID(ctx context.Context, bucket *gridfs.Bucket, fileID interface{}, blobID string, opts ...WriteOption) error {
+	ds, err := bucket.OpenDownloadStream(fileID)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return notFound(blobID)
+	}
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		ds.SetReadDeadline(deadline)
+	}
+	return store.Write(ctx, blobID, ds, opts...)
+}
+
+// ExportToGridFS writes the blob as a new revision of the GridFS file
+// with the same name, removing the older revisions. The data is
+// streamed, so the blob is not buffered in memory. Returns ErrNotFound
+// if the blob does not exist.
+func (store *Store) ExportToGridFS(ctx context.Context, bucket *gridfs.Bucket, blobID string) error {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return (&GridFSStore{Bucket: bucket}).Write(ctx, blobID, rd)
+}
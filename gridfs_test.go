@@ -0,0 +1,86 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestGridFS(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	bucket, err := gridfs.NewBucket(store.Collection.Database(), options.GridFSBucket().SetName("testfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Drop()
+
+	ctx := context.Background()
+	var fs BlobStore = &GridFSStore{Bucket: bucket}
+	read := func(bs BlobStore, id string) []byte {
+		rd, err := bs.Open(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rd.Close()
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// A new revision replaces the file
+	if err := fs.Write(ctx, "a", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(300000)
+	if err := fs.Write(ctx, "a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bucket.GetFilesCollection().CountDocuments(ctx, bson.M{"filename": "a"}); err != nil || n != 1 {
+		t.Errorf("Wrong number of revisions: %d %v", n, err)
+	}
+	if n, err := fs.Size(ctx, "a"); err != nil || n != int64(len(data)) {
+		t.Errorf("Wrong size: %d %v", n, err)
+	}
+	if !bytes.Equal(read(fs, "a"), data) {
+		t.Errorf("Wrong GridFS data")
+	}
+
+	if err := store.ImportFromGridFS(ctx, bucket, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(store, "a"), data) {
+		t.Errorf("Wrong imported data")
+	}
+	other := randomData(5000)
+	if err := store.Write(ctx, "b", bytes.NewReader(other)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ExportToGridFS(ctx, bucket, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(fs, "b"), other) {
+		t.Errorf("Wrong exported data")
+	}
+
+	if err := fs.Remove(ctx, "a", "b", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := fs.Exists(ctx, "a"); err != nil || exists {
+		t.Errorf("File not removed: %v %v", exists, err)
+	}
+	if _, err := fs.Open(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.ImportFromGridFS(ctx, bucket, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
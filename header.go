@@ -0,0 +1,167 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// headerSeq is the seq value of the header document of a blob. The
+// header lives in the same collection as the segments, so it is
+// covered by the (blobId, seq) index, and it sorts before all data
+// segments.
+const headerSeq = -1
+
+// blobHeader keeps per-blob information that is not repeated on every
+// segment. Blobs written by older versions of this package do not have
+// a header.
+type blobHeader struct {
+	ID        string `bson:"blobId"`
+	Seq       int64  `bson:"seq"`
+	ChunkSize int    `bson:"chunkSize,omitempty"`
+	// Size is the logical size of the blob, and StoredSize is the
+	// number of data bytes stored after compression and encryption.
+	// StoredSize is -1 if it is not known.
+	Size       int64  `bson:"size"`
+	StoredSize int64  `bson:"storedSize"`
+	KeyID      string `bson:"keyId,omitempty"`
+	// RekeyID is the key a blob is being re-encrypted with by Rekey
+	RekeyID string `bson:"rekeyId,omitempty"`
+	// Codec is the name of the codec the blob is compressed with,
+	// empty if the blob is stored uncompressed
+	Codec    string    `bson:"codec,omitempty"`
+	ExpireAt time.Time `bson:"expireAt,omitempty"`
+	// Version changes every time the blob is written
+	Version string `bson:"version,omitempty"`
+	// SHA256 is the hex encoded SHA-256 hash of the blob contents,
+	// empty if it is not known
+	SHA256 string `bson:"sha256,omitempty"`
+	// SegmentsHash is the hex encoded SHA-256 hash of the
+	// concatenated segment hashes, empty if it is not known
+	SegmentsHash string `bson:"segmentsHash,omitempty"`
+	// UpdatedAt is the time the blob was last written. Blobs written
+	// by older versions of this package do not have it.
+	UpdatedAt time.Time `bson:"updatedAt,omitempty"`
+	// ContentType is the media type of the blob, if recorded
+	ContentType string `bson:"contentType,omitempty"`
+	// Pending is set for a blob reserved with Reserve that is not
+	// written yet
+	Pending bool `bson:"pending,omitempty"`
+	// CreatedAt is the time the blob was first written. Blobs written
+	// by older versions of this package do not have it.
+	CreatedAt time.Time `bson:"createdAt,omitempty"`
+	// Meta is the user metadata of the blob
+	Meta bson.M `bson:"meta,omitempty"`
+}
+
+// segmentFilter returns a filter matching the data segments of a blob,
+// excluding the header
+func segmentFilter(blobID string) bson.M {
+	return bson.M{"blobId": blobID, "seq": bson.M{"$gte": 0}}
+}
+
+// headerFilter returns a filter matching the header document of a blob
+func headerFilter(blobID string) bson.M {
+	return bson.M{"blobId": blobID, "seq": headerSeq}
+}
+
+// setHeader updates the given header fields of a blob, creating the
+// header if necessary
+func (store *Store) setHeader(ctx context.Context, blobID string, fields bson.M) error {
+	_, err := store.Collection.UpdateOne(ctx, headerFilter(blobID), bson.M{"$set": fields}, options.Update().SetUpsert(true))
+	return err
+}
+
+// getHeader returns the header of a blob. Returns nil if the blob
+// does not have a header.
+func (store *Store) getHeader(ctx context.Context, blobID string) (*blobHeader, error) {
+	var hdr blobHeader
+	err := store.Collection.FindOne(ctx, headerFilter(blobID)).Decode(&hdr)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hdr, nil
+}
+
+// isEmpty returns if the blob has a header recording it as empty. A
+// reserved blob is not empty, it does not exist.
+func (store *Store) isEmpty(ctx context.Context, blobID string) (bool, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return false, err
+	}
+	return hdr != nil && hdr.Size == 0 && !hdr.Pending, nil
+}
+
+// recordedSize returns the size recorded in a raw header document.
+// Returns false if the header has no size, or if it is a reservation
+// that is not written yet.
+func recordedSize(raw bson.Raw) (int64, bool) {
+	if pending, _ := raw.Lookup("pending").BooleanOK(); pending {
+		return 0, false
+	}
+	return raw.Lookup("size").AsInt64OK()
+}
+
+// openEmpty returns an empty reader if the blob is empty, and
+// ErrNotFound otherwise
+func (store *Store) openEmpty(ctx context.Context, blobID string) (*Reader, error) {
+	empty, err := store.isEmpty(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, notFound(blobID)
+	}
+	return &Reader{ctx: ctx, store: store, blobID: blobID, err: io.EOF}, nil
+}
+
+// blobEnd returns the size of the blob, computed from its last
+// segment. An empty blob has size 0. Returns ErrNotFound if the blob
+// does not exist.
+func (store *Store) blobEnd(ctx context.Context, blobID string) (int64, error) {
+	last, err := store.lastSegment(ctx, segmentFilter(blobID))
+	if errors.Is(err, ErrNotFound) {
+		if empty, herr := store.isEmpty(ctx, blobID); herr != nil || empty {
+			return 0, herr
+		}
+		return 0, notFound(blobID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(last.Start + last.N), nil
+}
+
+// ChunkSizeOf returns the chunk size a blob was written with. It is
+// read from the header of the blob if recorded, otherwise the size of
+// the first segment is returned. For a blob without a header that has
+// a single segment, this is the size of the blob, which may be smaller
+// than the chunk size it was written with.
+func (store *Store) ChunkSizeOf(ctx context.Context, blobID string) (int, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	if hdr != nil && hdr.ChunkSize > 0 {
+		return hdr.ChunkSize, nil
+	}
+	var first segmentPos
+	err = store.Collection.FindOne(ctx, bson.M{"blobId": blobID, "seq": 0}, options.FindOne().
+		SetProjection(bson.M{"seq": 1, "s": 1, "n": 1})).Decode(&first)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, notFound(blobID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(first.N), nil
+}
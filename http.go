@@ -0,0 +1,255 @@
+package blobstore
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeBlob serves the blob as the response to r. Range requests are
+// supported, including requests for multiple ranges, which are
+// answered with a multipart/byteranges body. Each range is read
+// starting from the segment containing it. Responds with 404 if the
+// blob does not exist. If CompressResponses is set, and the client
+// accepts gzip, responses to requests for the whole blob are gzip
+// encoded. Range requests are always served uncompressed. The
+// Content-Type is the content type recorded for the blob, or detected
+// from its data.
+func (store *Store) ServeBlob(w http.ResponseWriter, r *http.Request, blobID string) {
+	ctx := r.Context()
+	size, err := store.Size(ctx, blobID)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hdr != nil && hdr.ContentType != "" {
+		w.Header().Set("Content-Type", hdr.ContentType)
+	}
+	if store.CompressResponses && r.Method == http.MethodGet && r.Header.Get("Range") == "" && acceptsGzip(r) {
+		if err := store.serveGzip(w, r, blobID, hdr); err != nil && store.OnServeError != nil {
+			store.OnServeError(blobID, err)
+		}
+		return
+	}
+	content := &blobSeeker{ctx: ctx, store: store, blobID: blobID, size: size}
+	defer content.Close()
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// serveGzip serves the blob with gzip content encoding. A blob stored
+// with the gzip codec is sent as stored, otherwise the data is
+// compressed while it is sent. hdr is the header of the blob, which
+// can be nil. If the content type is not recorded, it is detected from
+// the data, as by http.ServeContent. Returns the error that stopped
+// the response after it started.
+func (store *Store) serveGzip(w http.ResponseWriter, r *http.Request, blobID string, hdr *blobHeader) error {
+	ctx := r.Context()
+	if w.Header().Get("Content-Type") == "" {
+		contentType, err := store.sniffContentType(ctx, blobID)
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return nil
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	passThrough := hdr != nil && hdr.Codec == GzipCodec{}.Name()
+	var rd *Reader
+	var err error
+	if passThrough {
+		rd, err = store.ReadRaw(ctx, blobID)
+	} else {
+		rd, err = store.Read(ctx, blobID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	defer rd.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if passThrough {
+		_, err := rd.WriteTo(w)
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := rd.WriteTo(gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// sniffContentType detects the content type of the blob from the
+// start of its data
+func (store *Store) sniffContentType(ctx context.Context, blobID string) (string, error) {
+	rd, err := store.ReadRange(ctx, blobID, 0, 512)
+	if err != nil {
+		return "", err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(data), nil
+}
+
+// acceptsGzip returns if the client accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(params[2:], 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// ServeStream writes the blob to w, flushing the response after each
+// segment if w is an http.Flusher, so the client receives data as it
+// is read from the database. Content-Length is set if the size of the
+// blob is known. Returns the number of bytes written. If the blob does
+// not exist, ErrNotFound is returned and nothing is written to w.
+func (store *Store) ServeStream(ctx context.Context, blobID string, w http.ResponseWriter) (int64, error) {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	if size := rd.Size(); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		return rd.WriteTo(flushWriter{w: w, flusher: flusher})
+	}
+	return rd.WriteTo(w)
+}
+
+// flushWriter flushes after every write
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
+
+// ErrTooLarge is returned by WriteHTTPBody if the request body exceeds
+// the size limit
+var ErrTooLarge = errors.New("Too large")
+
+// WriteHTTPBody writes the body of r as the blob, and returns the size
+// of the blob. If the body is longer than maxBytes, the segments
+// written so far are removed, and an error wrapping ErrTooLarge is
+// returned. With AtomicWrites, only the staged data is removed, and the
+// blob is not changed. The body is not closed.
+func (store *Store) WriteHTTPBody(ctx context.Context, blobID string, r *http.Request, maxBytes int64) (int64, error) {
+	w, err := store.write(ctx, blobID, http.MaxBytesReader(nil, r.Body, maxBytes))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		// A staged write is discarded by write, the segments of a
+		// direct write replaced the blob
+		if !store.AtomicWrites {
+			if rerr := store.remove(ctx, blobID); rerr != nil {
+				return 0, rerr
+			}
+		}
+		return 0, fmt.Errorf("%w: %s: body is larger than %d bytes", ErrTooLarge, blobID, maxBytes)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(w.start), nil
+}
+
+// Handler returns an HTTP handler serving blobs using ServeBlob. The
+// blob ID of a request is returned by blobID.
+func (store *Store) Handler(blobID func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.ServeBlob(w, r, blobID(r))
+	})
+}
+
+// blobSeeker is an io.ReadSeeker for a blob of known size. A reader is
+// opened at the current offset when data is read after a seek.
+type blobSeeker struct {
+	ctx    context.Context
+	store  *Store
+	blobID string
+	size   int64
+	offset int64
+	rd     *Reader
+}
+
+func (s *blobSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.rd == nil {
+		rd, err := s.store.ReadFromOffset(s.ctx, s.blobID, s.offset)
+		if err != nil {
+			return 0, err
+		}
+		s.rd = rd
+	}
+	n, err := s.rd.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *blobSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, ErrInvalidRange
+	}
+	if offset != s.offset {
+		s.Close()
+		s.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current reader
+func (s *blobSeeker) Close() error {
+	if s.rd == nil {
+		return nil
+	}
+	err := s.rd.Close()
+	s.rd = nil
+	return err
+}
@@ -0,0 +1,197 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestServeBlob(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(store.Handler(func(r *http.Request) string { return r.URL.Path[1:] }))
+	defer srv.Close()
+
+	get := func(path, rng string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/missing", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+
+	resp = get("/1", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("Wrong full response: %d", resp.StatusCode)
+	}
+
+	resp = get("/1", "bytes=1000-2099")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[1000:2100]) {
+		t.Errorf("Wrong single range response: %d", resp.StatusCode)
+	}
+
+	resp = get("/1", "bytes=10-19,3000-4099")
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || err != nil {
+		t.Fatalf("Wrong multi range response: %d %v", resp.StatusCode, err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, expected := range [][]byte{data[10:20], data[3000:4100]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, _ := io.ReadAll(part)
+		if !bytes.Equal(read, expected) {
+			t.Errorf("Wrong part %s", part.Header.Get("Content-Range"))
+		}
+	}
+}
+
+func TestServeBlobGzip(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.CompressResponses = true
+
+	data := bytes.Repeat([]byte("compressible data "), 500)
+	if err := store.Write(context.Background(), "plain", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = GzipCodec{}
+	if err := store.Write(context.Background(), "gzip", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"plain", "gzip"} {
+		req := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		store.ServeBlob(rec, req, id)
+		if rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s: not gzip encoded", id)
+		}
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("%s: wrong data", id)
+		}
+		// The content type is detected from the data, not the
+		// encoded body
+		if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s: wrong content type %s", id, ct)
+		}
+	}
+	// A recorded content type is used
+	if err := store.setHeader(context.Background(), "gzip", bson.M{"contentType": "application/json"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, encoding := range []string{"gzip", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/gzip", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		store.ServeBlob(rec, req, "gzip")
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: wrong content type %s", encoding, ct)
+		}
+	}
+	// Ranges are not compressed
+	req := httptest.NewRequest(http.MethodGet, "/plain", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-9")
+	rec := httptest.NewRecorder()
+	store.ServeBlob(rec, req, "plain")
+	if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), data[:10]) {
+		t.Errorf("Wrong range response")
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	n, err := store.ServeStream(context.Background(), "1", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5000 || rec.Header().Get("Content-Length") != "5000" || !rec.Flushed {
+		t.Errorf("Wrong response: %d %s %v", n, rec.Header().Get("Content-Length"), rec.Flushed)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("Wrong data")
+	}
+	if _, err := store.ServeStream(context.Background(), "missing", httptest.NewRecorder()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWriteHTTPBody(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5000)
+	req := httptest.NewRequest(http.MethodPut, "/1", bytes.NewReader(data))
+	n, err := store.WriteHTTPBody(context.Background(), "1", req, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5000 || !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong blob: %d", n)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/2", bytes.NewReader(data))
+	if _, err := store.WriteHTTPBody(context.Background(), "2", req, 4999); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if exists, err := store.Exists(context.Background(), "2"); err != nil || exists {
+		t.Errorf("Partial blob not removed: %v %v", exists, err)
+	}
+
+	// A staged write that is too large leaves the blob intact
+	store.AtomicWrites = true
+	req = httptest.NewRequest(http.MethodPut, "/1", bytes.NewReader(randomData(6000)))
+	if _, err := store.WriteHTTPBody(context.Background(), "1", req, 5000); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Blob changed by a failed staged write")
+	}
+}
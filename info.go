@@ -0,0 +1,119 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	ID string
+	// Size is the logical size of the blob
+	Size int64
+	// Chunks is the number of segments of the blob
+	Chunks int64
+	// ChunkSize is the size of the segments of the blob
+	ChunkSize int
+	// StoredSize is the number of data bytes stored, after compression
+	// and encryption. It is -1 if it is not known.
+	StoredSize int64
+	// SHA256 is the hex encoded SHA-256 hash of the blob contents,
+	// empty if it is not known
+	SHA256 string
+	// Version changes every time the blob is written
+	Version string
+	// ContentType is the media type of the blob, empty if it is not
+	// known
+	ContentType string
+	// ModTime is the time the blob was written
+	ModTime time.Time
+	// CreateTime is the time the blob was first written, zero if it is
+	// not known. It is only set by Stat.
+	CreateTime time.Time
+	// Meta is the user metadata of the blob. It is only set by Stat.
+	Meta bson.M
+}
+
+// ETag returns a strong HTTP entity tag for the blob. It is derived
+// from the content hash if known, otherwise from the version.
+func (info BlobInfo) ETag() string {
+	if info.SHA256 != "" {
+		return `"` + info.SHA256 + `"`
+	}
+	return `"` + info.Version + `"`
+}
+
+// Stat returns the information of a stored blob with its user
+// metadata. The size and the number of segments are read from the
+// last segment, the other fields from the header. Blobs written by
+// older versions of this package have no header, so only their size
+// and number of segments are returned. Returns ErrNotFound if the blob
+// does not exist.
+func (store *Store) Stat(ctx context.Context, blobID string) (BlobInfo, error) {
+	info := BlobInfo{ID: blobID, StoredSize: -1, Meta: bson.M{}}
+	last, err := store.lastSegment(ctx, segmentFilter(blobID))
+	switch {
+	case err == nil:
+		info.Size = int64(last.Start + last.N)
+		info.Chunks = int64(last.Seq) + 1
+	case !errors.Is(err, ErrNotFound):
+		return BlobInfo{}, err
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if hdr == nil || hdr.Pending {
+		if info.Chunks == 0 {
+			return BlobInfo{}, notFound(blobID)
+		}
+		return info, nil
+	}
+	info.ChunkSize = hdr.ChunkSize
+	info.StoredSize = hdr.StoredSize
+	info.SHA256 = hdr.SHA256
+	info.Version = hdr.Version
+	info.ContentType = hdr.ContentType
+	info.ModTime = hdr.UpdatedAt
+	info.CreateTime = hdr.CreatedAt
+	if hdr.Meta != nil {
+		info.Meta = hdr.Meta
+	}
+	return info, nil
+}
+
+// WriteReader writes the blob from r as Write does, and returns the
+// information of the stored blob
+func (store *Store) WriteReader(ctx context.Context, blobID string, r io.Reader, opts ...WriteOption) (BlobInfo, error) {
+	w, err := store.write(ctx, blobID, r, opts...)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return w.info(), nil
+}
+
+// info returns the information of the blob written by a closed writer
+func (w *Writer) info() BlobInfo {
+	info := BlobInfo{
+		ID:          w.blobID,
+		Size:        int64(w.start),
+		Chunks:      int64(w.seq),
+		ChunkSize:   w.chunkSize,
+		StoredSize:  w.stored,
+		Version:     w.version,
+		ContentType: w.contentType,
+		ModTime:     w.modTime,
+	}
+	if w.storedUnknown {
+		info.StoredSize = -1
+	}
+	if w.hash != nil {
+		info.SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+	}
+	return info
+}
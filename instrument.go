@@ -0,0 +1,212 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// InstrumentedStore is a store that records the latency of the
+// operations it wraps, so latency percentiles can be observed without
+// wrapping every call site. The latency of Read is the time to open
+// the blob and fetch its first segment, not the time to read the whole
+// blob. Methods of Store that are not wrapped are not recorded. An
+// InstrumentedStore must not be copied after first use.
+type InstrumentedStore struct {
+	*Store
+
+	// OnLatency, if set, is called with the latency of every wrapped
+	// operation. op is the name of the method.
+	OnLatency func(op string, d time.Duration, err error)
+
+	mu         sync.Mutex
+	histograms map[string]*latencyHistogram
+}
+
+// LatencyStats are the latency statistics of an operation. The
+// percentiles are accurate to within 12.5%.
+type LatencyStats struct {
+	Count int64
+	Mean  time.Duration
+	Max   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// Latency returns the latency statistics of op, which is the name of a
+// wrapped method, such as "Read" or "Write"
+func (store *InstrumentedStore) Latency(op string) LatencyStats {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	h := store.histograms[op]
+	if h == nil {
+		return LatencyStats{}
+	}
+	return h.stats()
+}
+
+// ResetLatency discards the recorded latencies
+func (store *InstrumentedStore) ResetLatency() {
+	store.mu.Lock()
+	store.histograms = nil
+	store.mu.Unlock()
+}
+
+// record records the latency of an operation started at start
+func (store *InstrumentedStore) record(op string, start time.Time, err error) {
+	d := time.Since(start)
+	store.mu.Lock()
+	if store.histograms == nil {
+		store.histograms = map[string]*latencyHistogram{}
+	}
+	h := store.histograms[op]
+	if h == nil {
+		h = &latencyHistogram{}
+		store.histograms[op] = h
+	}
+	h.add(d)
+	store.mu.Unlock()
+	if store.OnLatency != nil {
+		store.OnLatency(op, d, err)
+	}
+}
+
+// Write writes the blob and records the latency
+func (store *InstrumentedStore) Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	start := time.Now()
+	err := store.Store.Write(ctx, blobID, data, opts...)
+	store.record("Write", start, err)
+	return err
+}
+
+// Append appends to the blob and records the latency
+func (store *InstrumentedStore) Append(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	start := time.Now()
+	err := store.Store.Append(ctx, blobID, data, opts...)
+	store.record("Append", start, err)
+	return err
+}
+
+// Read opens the blob and records the time to the first segment
+func (store *InstrumentedStore) Read(ctx context.Context, blobID string) (*Reader, error) {
+	start := time.Now()
+	rd, err := store.Store.Read(ctx, blobID)
+	store.record("Read", start, err)
+	return rd, err
+}
+
+// ReadRange opens a range of the blob and records the time to the
+// first segment
+func (store *InstrumentedStore) ReadRange(ctx context.Context, blobID string, offset, length int64) (*Reader, error) {
+	start := time.Now()
+	rd, err := store.Store.ReadRange(ctx, blobID, offset, length)
+	store.record("ReadRange", start, err)
+	return rd, err
+}
+
+// Size returns the size of the blob and records the latency
+func (store *InstrumentedStore) Size(ctx context.Context, blobID string) (int64, error) {
+	start := time.Now()
+	size, err := store.Store.Size(ctx, blobID)
+	store.record("Size", start, err)
+	return size, err
+}
+
+// Remove removes the blobs and records the latency
+func (store *InstrumentedStore) Remove(ctx context.Context, blobIDs ...string) error {
+	start := time.Now()
+	err := store.Store.Remove(ctx, blobIDs...)
+	store.record("Remove", start, err)
+	return err
+}
+
+// RemoveStrict removes the blob and records the latency
+func (store *InstrumentedStore) RemoveStrict(ctx context.Context, blobID string) error {
+	start := time.Now()
+	err := store.Store.RemoveStrict(ctx, blobID)
+	store.record("RemoveStrict", start, err)
+	return err
+}
+
+// latencySubBuckets is the number of buckets per power of two of a
+// latency histogram
+const latencySubBuckets = 8
+
+// latencyHistogram counts latencies in microsecond buckets. Latencies
+// below latencySubBuckets microseconds have a bucket each, and each
+// power of two above is split into latencySubBuckets buckets.
+type latencyHistogram struct {
+	buckets [64 * latencySubBuckets]int64
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+// latencyBucket returns the bucket of d
+func latencyBucket(d time.Duration) int {
+	us := uint64(d / time.Microsecond)
+	if us < latencySubBuckets {
+		return int(us)
+	}
+	exp := bits.Len64(us) - 4
+	return exp*latencySubBuckets + int(us>>exp)
+}
+
+// latencyBucketMax returns the largest latency in bucket b
+func latencyBucketMax(b int) time.Duration {
+	if b < latencySubBuckets {
+		return time.Duration(b+1)*time.Microsecond - 1
+	}
+	exp := b/latencySubBuckets - 1
+	m := uint64(b%latencySubBuckets + latencySubBuckets)
+	return time.Duration((m+1)<<exp)*time.Microsecond - 1
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.buckets[latencyBucket(d)]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// percentile returns the latency below which the fraction q of the
+// latencies are
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	rank := int64(q * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+	var n int64
+	for b, c := range h.buckets {
+		n += c
+		if n > rank {
+			if d := latencyBucketMax(b); d < h.max {
+				return d
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	if h.count == 0 {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Count: h.count,
+		Mean:  h.sum / time.Duration(h.count),
+		Max:   h.max,
+		P50:   h.percentile(0.5),
+		P90:   h.percentile(0.9),
+		P99:   h.percentile(0.99),
+	}
+}
@@ -0,0 +1,70 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	for _, d := range []time.Duration{0, time.Microsecond, 7 * time.Microsecond, 8 * time.Microsecond, 100 * time.Microsecond, time.Millisecond, time.Second, time.Hour} {
+		b := latencyBucket(d)
+		if max := latencyBucketMax(b); max < d || float64(max) > 1.125*float64(d)+float64(time.Microsecond) {
+			t.Errorf("%v: bucket %d max %v", d, b, max)
+		}
+		if b > 0 && latencyBucketMax(b-1) >= d {
+			t.Errorf("%v: in bucket %d, previous bucket max %v", d, b, latencyBucketMax(b-1))
+		}
+	}
+	var h latencyHistogram
+	for i := 1; i <= 100; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	stats := h.stats()
+	if stats.Count != 100 || stats.Max != 100*time.Millisecond {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+	check := func(name string, got, want time.Duration) {
+		if got < want || float64(got) > 1.125*float64(want) {
+			t.Errorf("%s: got %v, expected about %v", name, got, want)
+		}
+	}
+	check("P50", stats.P50, 51*time.Millisecond)
+	check("P90", stats.P90, 91*time.Millisecond)
+	check("P99", stats.P99, 100*time.Millisecond)
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	store := &InstrumentedStore{Store: setupTestStore(t)}
+	defer cleanupBlobs(store.Store)
+	var ops []string
+	store.OnLatency = func(op string, d time.Duration, err error) {
+		ops = append(ops, op)
+	}
+
+	data := randomData(3000)
+	for i := 0; i < 10; i++ {
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if stats := store.Latency("Write"); stats.Count != 10 || stats.P50 <= 0 || stats.P99 < stats.P50 || stats.Max < stats.P99 {
+		t.Errorf("Wrong Write stats: %+v", stats)
+	}
+	if stats := store.Latency("Read"); stats.Count != 1 {
+		t.Errorf("Wrong Read stats: %+v", stats)
+	}
+	if len(ops) != 11 {
+		t.Errorf("Wrong number of latency callbacks: %d", len(ops))
+	}
+	store.ResetLatency()
+	if stats := store.Latency("Write"); stats.Count != 0 {
+		t.Errorf("Not reset: %+v", stats)
+	}
+}
@@ -0,0 +1,257 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrCorrupted is returned when the stored data of a blob is not
+// consistent
+var ErrCorrupted = errors.New("Corrupted")
+
+// SegmentMeta describes a stored segment of a blob
+type SegmentMeta struct {
+	Seq   uint64 `bson:"seq"`
+	Start uint64 `bson:"s"`
+	N     uint64 `bson:"n"`
+	// DataLen is the number of bytes stored for the segment, after
+	// compression and encryption
+	DataLen int64 `bson:"dataLen"`
+}
+
+// DumpSegments returns the segment map of a blob, sorted by seq. The
+// segment data is not fetched. Returns ErrNotFound if the blob has no
+// segments.
+func (store *Store) DumpSegments(ctx context.Context, blobID string) ([]SegmentMeta, error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: segmentFilter(blobID)}},
+		{{Key: "$sort", Value: bson.M{"seq": 1}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":     0,
+			"seq":     1,
+			"s":       1,
+			"n":       1,
+			"dataLen": bson.M{"$binarySize": "$data"},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var segments []SegmentMeta
+	if err := cursor.All(ctx, &segments); err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, notFound(blobID)
+	}
+	return segments, nil
+}
+
+// SegmentSizes returns the number of data bytes of each segment of a
+// blob in seq order. The segment data is not fetched. An empty blob
+// has no segments. Returns ErrNotFound if the blob does not exist.
+func (store *Store) SegmentSizes(ctx context.Context, blobID string) ([]uint64, error) {
+	cursor, err := store.Collection.Find(ctx, segmentFilter(blobID), store.findSorted(1).
+		SetProjection(bson.M{"seq": 1, "s": 1, "n": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	sizes := []uint64{}
+	for cursor.Next(ctx) {
+		var segment segmentPos
+		if err := cursor.Decode(&segment); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, segment.N)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(sizes) == 0 {
+		if empty, err := store.isEmpty(ctx, blobID); err != nil || !empty {
+			if err == nil {
+				err = notFound(blobID)
+			}
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// CheckIntegrity checks that the segments of a blob are contiguous:
+// the seq values start from 0 without gaps, and each segment starts
+// where the previous one ends. The segment data is not fetched. Returns
+// an error wrapping ErrCorrupted if the blob is inconsistent.
+func (store *Store) CheckIntegrity(ctx context.Context, blobID string) error {
+	_, _, problem, err := store.contiguousPrefix(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	return problem
+}
+
+// contiguousPrefix returns the number of segments and the size of the
+// longest contiguous run of segments starting at seq 0. If there are
+// other segments after the run, problem describes the first
+// inconsistency.
+func (store *Store) contiguousPrefix(ctx context.Context, blobID string) (count, size uint64, problem, err error) {
+	opts := store.findSorted(1).SetProjection(bson.M{"seq": 1, "s": 1, "n": 1})
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	cursor, err := store.Collection.Find(ctx, segmentFilter(blobID), opts)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var segment segmentPos
+		if err := cursor.Decode(&segment); err != nil {
+			return 0, 0, nil, err
+		}
+		if segment.Seq != count {
+			return count, size, fmt.Errorf("%w: %s: expected segment %d, found %d", ErrCorrupted, blobID, count, segment.Seq), nil
+		}
+		if segment.Start != size {
+			return count, size, fmt.Errorf("%w: %s: segment %d starts at %d, expected %d", ErrCorrupted, blobID, count, segment.Start, size), nil
+		}
+		count++
+		size += segment.N
+	}
+	return count, size, nil, cursor.Err()
+}
+
+// Repair truncates a blob to the longest contiguous run of segments
+// starting at seq 0, removing all segments after the first gap or
+// inconsistency. Returns the size of the repaired blob. Use
+// CheckIntegrity to find out if a blob needs repair. If the store is in
+// DryRun mode, the blob is not changed.
+func (store *Store) Repair(ctx context.Context, blobID string) (truncatedTo int64, err error) {
+	count, size, problem, err := store.contiguousPrefix(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	if problem == nil {
+		if count == 0 {
+			hdr, err := store.getHeader(ctx, blobID)
+			if err != nil {
+				return 0, err
+			}
+			if hdr == nil {
+				return 0, notFound(blobID)
+			}
+		}
+		return int64(size), nil
+	}
+	if store.WriteOnce {
+		return 0, ErrImmutable
+	}
+	if store.AppendOnly {
+		return 0, ErrAppendOnly
+	}
+	if store.DryRun {
+		return int64(size), nil
+	}
+	_, err = store.deleteSegments(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": int64(count)}})
+	if err != nil {
+		return 0, err
+	}
+	if err := store.sealTruncated(ctx, blobID, count); err != nil {
+		return 0, err
+	}
+	if err := store.setHeader(ctx, blobID, bson.M{"size": int64(size), "storedSize": int64(-1), "sha256": "", "segmentsHash": "", "updatedAt": store.now()}); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// sealTruncated marks the last segment of an encrypted blob truncated
+// to count segments as final, so the blob can be read to the end
+func (store *Store) sealTruncated(ctx context.Context, blobID string, count uint64) error {
+	if count == 0 {
+		return nil
+	}
+	w, _, err := store.continueWriter(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if !w.encrypts() {
+		return nil
+	}
+	w.seq = count
+	return w.seal()
+}
+
+// ScanIntegrity runs CheckIntegrity on all blobs of the store using
+// concurrency goroutines, and calls report for every blob that fails.
+// report is not called concurrently. Blob IDs are streamed, so the
+// store can be arbitrarily large. ScanIntegrity stops when ctx is
+// canceled.
+func (store *Store) ScanIntegrity(ctx context.Context, concurrency int, report func(blobID string, err error)) error {
+	var mu sync.Mutex
+	return store.forEachBlob(ctx, concurrency, func(ctx context.Context, blobID string) {
+		if err := store.CheckIntegrity(ctx, blobID); err != nil {
+			mu.Lock()
+			report(blobID, err)
+			mu.Unlock()
+		}
+	})
+}
+
+// RepairAll runs Repair on all blobs of the store failing
+// CheckIntegrity, using concurrency goroutines. Healthy blobs are only
+// checked, their segment data is not fetched. report is called for
+// every blob repaired with the size it was truncated to, and for every
+// blob that could not be checked or repaired with the error. report is
+// not called concurrently. RepairAll stops when ctx is canceled.
+func (store *Store) RepairAll(ctx context.Context, concurrency int, report func(blobID string, truncatedTo int64, err error)) error {
+	var mu sync.Mutex
+	return store.forEachBlob(ctx, concurrency, func(ctx context.Context, blobID string) {
+		err := store.CheckIntegrity(ctx, blobID)
+		if err == nil {
+			return
+		}
+		var size int64
+		if errors.Is(err, ErrCorrupted) {
+			size, err = store.Repair(ctx, blobID)
+		}
+		mu.Lock()
+		report(blobID, size, err)
+		mu.Unlock()
+	})
+}
+
+// forEachBlob calls fn for all blobs using concurrency goroutines
+func (store *Store) forEachBlob(ctx context.Context, concurrency int, fn func(ctx context.Context, blobID string)) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	ids := make(chan string, store.Scan.Prefetch)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				fn(ctx, id)
+			}
+		}()
+	}
+	err := store.eachBlobID(ctx, func(blobID string) error {
+		select {
+		case ids <- blobID:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(ids)
+	wg.Wait()
+	return err
+}
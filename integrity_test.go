@@ -0,0 +1,404 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestScanIntegrity(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for _, id := range []string{"good", "bad"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(5005))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "bad", "seq": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CheckIntegrity(context.Background(), "good"); err != nil {
+		t.Error(err)
+	}
+	reported := map[string]error{}
+	err := store.ScanIntegrity(context.Background(), 2, func(blobID string, err error) {
+		reported[blobID] = err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || !errors.Is(reported["bad"], ErrCorrupted) {
+		t.Errorf("Wrong report: %v", reported)
+	}
+}
+
+func TestRepairAll(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for _, id := range []string{"good", "bad"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(5005))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "bad", "seq": 2}); err != nil {
+		t.Fatal(err)
+	}
+	reported := map[string]int64{}
+	err := store.RepairAll(context.Background(), 2, func(blobID string, truncatedTo int64, err error) {
+		if err != nil {
+			t.Errorf("%s: %v", blobID, err)
+		}
+		reported[blobID] = truncatedTo
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported["bad"] != 2048 {
+		t.Errorf("Wrong report: %v", reported)
+	}
+	if err := store.CheckIntegrity(context.Background(), "bad"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "1", "seq": 2}); err != nil {
+		t.Fatal(err)
+	}
+	size, err := store.Repair(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2048 {
+		t.Errorf("Wrong repaired size: %d", size)
+	}
+	if err := store.CheckIntegrity(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data[:2048]) {
+		t.Errorf("Not equal")
+	}
+}
+
+func TestRepairEncrypted(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	enc, err := NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Encrypter = enc
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "1", "seq": 2}); err != nil {
+		t.Fatal(err)
+	}
+	size, err := store.Repair(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2048 {
+		t.Errorf("Wrong repaired size: %d", size)
+	}
+	// The new last segment is final, so the blob reads to the end
+	if !bytes.Equal(readBlob(t, store, "1"), data[:2048]) {
+		t.Errorf("Not equal")
+	}
+	if err := store.DeepVerify(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDumpSegments(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(2500))); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SegmentMeta{{0, 0, 1024, 1024}, {1, 1024, 1024, 1024}, {2, 2048, 452, 452}}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Wrong segments: %v", segments)
+	}
+	if _, err := store.DumpSegments(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.VerifyOnRead = true
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	// Replace the data of a segment keeping its length
+	if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": "1", "seq": 1},
+		bson.M{"$set": bson.M{"data": randomData(1024)}}); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rd); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestVerifyOnReadSegment(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.VerifyOnRead = true
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": "1", "seq": 1},
+		bson.M{"$set": bson.M{"data": randomData(1024)}}); err != nil {
+		t.Fatal(err)
+	}
+	// A range read does not reach the content hash check, so the
+	// corrupted segment is detected by its own checksum
+	rd, err := store.ReadRange(context.Background(), "1", 1100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rd); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	// The segments before it are still readable
+	rd, err = store.ReadRange(context.Background(), "1", 0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	buf.Reset()
+	if _, err := buf.ReadFrom(rd); err != nil || !bytes.Equal(buf.Bytes(), data[:1024]) {
+		t.Errorf("Wrong data: %v", err)
+	}
+}
+
+func TestReaderSum(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(3000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(context.Background(), "empty", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := rd.Sum(); sum != nil {
+		t.Errorf("Sum without VerifyOnRead: %x", sum)
+	}
+	rd.Close()
+
+	store.VerifyOnRead = true
+	for id, content := range map[string][]byte{"1": data, "empty": nil} {
+		rd, err := store.Read(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256(content)
+		if !bytes.Equal(rd.Sum(), want[:]) {
+			t.Errorf("%s: wrong sum %x", id, rd.Sum())
+		}
+		rd.Close()
+	}
+}
+
+func TestSegmentSizes(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(2500))); err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := store.SegmentSizes(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []uint64{1024, 1024, 452}) {
+		t.Errorf("Wrong sizes: %v", sizes)
+	}
+	if _, err := store.SegmentSizes(context.Background(), "2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.DeleteOne(context.Background(), bson.M{"blobId": "1", "seq": 1}); err != nil {
+		t.Fatal(err)
+	}
+	store.DryRun = true
+	size, err := store.Repair(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1024 {
+		t.Errorf("Wrong repair size: %d", size)
+	}
+	if err := store.Remove(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveStrict(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveStrict(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	segments, err := store.DumpSegments(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Errorf("Dry run changed the blob: %v", segments)
+	}
+}
+
+func TestScanOptions(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.Scan = ScanOptions{BatchSize: 1, Prefetch: 4}
+
+	for i := 0; i < 10; i++ {
+		if err := store.Write(context.Background(), fmt.Sprint(i), bytes.NewReader(randomData(3000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.forEachBlob(context.Background(), 2, func(ctx context.Context, blobID string) {
+		if err := store.CheckIntegrity(ctx, blobID); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.Query(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 10 {
+		t.Errorf("Expected 10 blobs, got %d", len(ids))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	if err := store.DeepVerify(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	// Corrupting the data keeps the checksums, so only DeepVerify
+	// detects it
+	if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": "1", "seq": 1},
+		bson.M{"$set": bson.M{"data": randomData(1024)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	if err := store.DeepVerify(context.Background(), "1"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	// Replacing a checksum is detected by Verify
+	if _, err := store.Collection.UpdateOne(context.Background(), bson.M{"blobId": "1", "seq": 1},
+		bson.M{"$set": bson.M{"h": randomData(32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(context.Background(), "1"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+
+	// A blob written before checksums were recorded
+	if err := store.Write(context.Background(), "2", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection.UpdateMany(context.Background(), bson.M{"blobId": "2"},
+		bson.M{"$unset": bson.M{"h": "", "sha256": "", "segmentsHash": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(context.Background(), "2"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("Verify: expected ErrNoChecksum, got %v", err)
+	}
+	if err := store.DeepVerify(context.Background(), "2"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("DeepVerify: expected ErrNoChecksum, got %v", err)
+	}
+}
+
+func TestPutSegment(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	a, b := randomData(100), randomData(50)
+	if err := store.PutSegment(context.Background(), "1", 0, 0, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutSegment(context.Background(), "1", 1, 100, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), append(a, b...)) {
+		t.Errorf("Wrong data")
+	}
+	start, data, err := store.GetSegment(context.Background(), "1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 100 || !bytes.Equal(data, b) {
+		t.Errorf("Wrong segment: %d", start)
+	}
+	if _, _, err := store.GetSegment(context.Background(), "1", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+)
+
+// LineIterator iterates over the lines of a blob
+type LineIterator interface {
+	// Next advances to the next line. It returns false at the end of
+	// the blob, or if there is an error.
+	Next() bool
+	// Line returns the current line without the line ending. It is
+	// only valid until the next call to Next.
+	Line() []byte
+	// Err returns the error that stopped the iteration, or nil at the
+	// end of the blob
+	Err() error
+	// Close stops the iteration and closes the underlying reader
+	Close() error
+}
+
+// Lines returns an iterator over the lines of the blob. Lines are
+// separated by "\n", and a trailing "\r" is removed, as with
+// bufio.ScanLines. Lines spanning segments are reassembled, and there
+// is no limit on the length of a line. The last line does not need a
+// line ending. The iterator stops with the error of the context if it
+// is canceled. The underlying reader is closed when the iteration ends,
+// or when the iterator is closed.
+func (store *Store) Lines(ctx context.Context, blobID string) (LineIterator, error) {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	return &lineIterator{ctx: ctx, rd: rd, br: bufio.NewReader(rd)}, nil
+}
+
+type lineIterator struct {
+	ctx  context.Context
+	rd   *Reader
+	br   *bufio.Reader
+	line []byte
+	err  error
+	done bool
+}
+
+func (it *lineIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.stop(err)
+		return false
+	}
+	it.line = it.line[:0]
+	for {
+		part, err := it.br.ReadSlice('\n')
+		it.line = append(it.line, part...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(it.line) > 0 {
+			// Last line without a line ending
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			it.stop(err)
+			return false
+		}
+		break
+	}
+	it.line = bytes.TrimSuffix(bytes.TrimSuffix(it.line, []byte("\n")), []byte("\r"))
+	return true
+}
+
+func (it *lineIterator) Line() []byte {
+	return it.line
+}
+
+func (it *lineIterator) Err() error {
+	return it.err
+}
+
+func (it *lineIterator) Close() error {
+	if it.done {
+		return nil
+	}
+	it.done = true
+	it.line = nil
+	return it.rd.Close()
+}
+
+// stop ends the iteration with err
+func (it *lineIterator) stop(err error) {
+	it.err = err
+	it.Close()
+}
@@ -0,0 +1,71 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// Lines span segments of 1024 bytes, and one is longer than the
+	// buffer of the iterator
+	lines := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("a"), 1500), []byte("crlf"), bytes.Repeat([]byte("b"), 10000), []byte("last")}
+	var data []byte
+	for i, line := range lines {
+		data = append(data, line...)
+		switch {
+		case i == 3:
+			data = append(data, "\r\n"...)
+		case i < len(lines)-1:
+			data = append(data, '\n')
+		}
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	it, err := store.Lines(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		if n >= len(lines) {
+			t.Fatalf("Too many lines")
+		}
+		if !bytes.Equal(it.Line(), lines[n]) {
+			t.Errorf("Line %d: got %d bytes, expected %d", n, len(it.Line()), len(lines[n]))
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(lines) {
+		t.Errorf("Got %d lines, expected %d", n, len(lines))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err = store.Lines(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	cancel()
+	if it.Next() {
+		t.Errorf("Next after cancel")
+	}
+	if !errors.Is(it.Err(), context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", it.Err())
+	}
+	if _, err := store.Lines(context.Background(), "2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// eachBlobID calls fn with the ID of every blob in the store, until fn
+// returns an error. IDs are streamed from the database as fn is called.
+// Uncommitted uploads are skipped.
+func (store *Store) eachBlobID(ctx context.Context, fn func(blobID string) error) error {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"seq": bson.M{"$gte": headerSeq}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId"}}},
+	}, store.scanAggregate())
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if isInternal(doc.ID) {
+			continue
+		}
+		if err := fn(doc.ID); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// scanAggregate returns the options of an aggregation scanning the
+// store
+func (store *Store) scanAggregate() *options.AggregateOptions {
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	return opts
+}
+
+// DefaultListLimit is the number of blob IDs returned by ListPage if
+// no limit is given
+var DefaultListLimit = 100
+
+// ListPage returns up to limit blob IDs in ascending order, starting
+// after the given ID. If after is empty, listing starts from the
+// beginning. next is the token to pass as after to get the next page.
+// It is empty if there are no more blobs. If limit is not positive,
+// DefaultListLimit is used.
+//
+// ListPage is the ID-only listing. It is not named List because List
+// iterates over blob information selected by ListOptions. Unlike List,
+// ListPage also returns reserved blobs that are not written yet.
+func (store *Store) ListPage(ctx context.Context, after string, limit int) (ids []string, next string, err error) {
+	return store.listIDs(ctx, "", after, limit)
+}
+
+// listIDs returns up to limit IDs of the blobs starting with prefix,
+// in ascending order, starting after the given ID
+func (store *Store) listIDs(ctx context.Context, prefix, after string, limit int) (ids []string, next string, err error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	// Every blob has a header or a first segment, so it is enough to
+	// look at those. Each blob contributes at most two documents.
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$and": bson.A{
+				bson.M{"blobId": bson.M{"$gt": after}},
+				bson.M{"blobId": prefixFilter(prefix)},
+				bson.M{"blobId": notInternal()},
+			},
+			"seq": bson.M{"$in": bson.A{headerSeq, 0}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "blobId", Value: 1}, {Key: "seq", Value: 1}}}},
+		{{Key: "$limit", Value: 2 * limit}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, doc.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(ids) == limit {
+		next = ids[len(ids)-1]
+	}
+	return ids, next, nil
+}
+
+// ListOptions selects the blobs returned by List
+type ListOptions struct {
+	// Prefix, if set, lists only the blobs whose ID starts with it
+	Prefix string
+	// After is the token of a previous listing. Listing continues
+	// after the blob the token was returned for.
+	After string
+	// Limit, if positive, is the maximum number of blobs returned
+	Limit int
+	// PageSize is the number of blobs read by one query. If it is not
+	// positive, DefaultListLimit is used.
+	PageSize int
+}
+
+// BlobIterator iterates over the blobs selected by List, in ascending
+// order of ID. Call Next to move to the next blob, and Info to get it.
+// Blobs are read a page at a time, so no cursor is held between pages.
+type BlobIterator struct {
+	ctx   context.Context
+	store *Store
+	opts  ListOptions
+	// page is the current page, and pos the index of the current blob
+	page  []BlobInfo
+	pos   int
+	after string
+	// done is set when there are no more pages
+	done  bool
+	count int
+	// last is the ID of the last blob returned
+	last string
+	err  error
+}
+
+// List returns an iterator over the blobs of the store with their size,
+// number of segments, and the fields recorded in their header. Meta and
+// CreateTime are not set; use Stat for them. Uncommitted uploads and
+// reserved blobs that are not written yet are skipped.
+func (store *Store) List(ctx context.Context, opts ListOptions) *BlobIterator {
+	return &BlobIterator{ctx: ctx, store: store, opts: opts, after: opts.After, pos: -1}
+}
+
+// Next moves to the next blob. Returns false if there are no more
+// blobs, or if there is an error.
+func (it *BlobIterator) Next() bool {
+	if it.err != nil || (it.opts.Limit > 0 && it.count >= it.opts.Limit) {
+		return false
+	}
+	it.pos++
+	for it.pos >= len(it.page) {
+		if it.done {
+			return false
+		}
+		if it.err = it.nextPage(); it.err != nil {
+			return false
+		}
+	}
+	it.count++
+	it.last = it.page[it.pos].ID
+	return true
+}
+
+// nextPage reads the next page of blobs
+func (it *BlobIterator) nextPage() error {
+	ids, next, err := it.store.listIDs(it.ctx, it.opts.Prefix, it.after, it.opts.PageSize)
+	if err != nil {
+		return err
+	}
+	it.after = next
+	it.done = next == ""
+	it.page, err = it.store.blobInfos(it.ctx, ids)
+	it.pos = 0
+	return err
+}
+
+// Info returns the current blob
+func (it *BlobIterator) Info() BlobInfo {
+	if it.pos < 0 || it.pos >= len(it.page) {
+		return BlobInfo{}
+	}
+	return it.page[it.pos]
+}
+
+// Token returns the token to pass as ListOptions.After to continue
+// listing after the last blob returned by Next
+func (it *BlobIterator) Token() string {
+	return it.last
+}
+
+// Err returns the error that stopped Next
+func (it *BlobIterator) Err() error {
+	return it.err
+}
+
+// blobInfos returns the information of the given blobs in the same
+// order, grouping their segments in the database. Reserved blobs are
+// skipped.
+func (store *Store) blobInfos(ctx context.Context, ids []string) ([]BlobInfo, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	isSegment := bson.M{"$gte": bson.A{"$seq", 0}}
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"blobId": bson.M{"$in": ids}, "seq": bson.M{"$gte": headerSeq}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$blobId",
+			"size":        bson.M{"$max": bson.M{"$cond": bson.A{isSegment, bson.M{"$add": bson.A{"$s", "$n"}}, nil}}},
+			"chunks":      bson.M{"$sum": bson.M{"$cond": bson.A{isSegment, 1, 0}}},
+			"chunkSize":   bson.M{"$max": "$chunkSize"},
+			"storedSize":  bson.M{"$max": "$storedSize"},
+			"sha256":      bson.M{"$max": "$sha256"},
+			"version":     bson.M{"$max": "$version"},
+			"contentType": bson.M{"$max": "$contentType"},
+			"updatedAt":   bson.M{"$max": "$updatedAt"},
+			"pending":     bson.M{"$max": "$pending"},
+		}}},
+	}, store.scanAggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	found := make(map[string]BlobInfo, len(ids))
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID          string    `bson:"_id"`
+			Size        int64     `bson:"size"`
+			Chunks      int64     `bson:"chunks"`
+			ChunkSize   int       `bson:"chunkSize"`
+			StoredSize  *int64    `bson:"storedSize"`
+			SHA256      string    `bson:"sha256"`
+			Version     string    `bson:"version"`
+			ContentType string    `bson:"contentType"`
+			UpdatedAt   time.Time `bson:"updatedAt"`
+			Pending     bool      `bson:"pending"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if doc.Pending && doc.Chunks == 0 {
+			continue
+		}
+		info := BlobInfo{
+			ID:          doc.ID,
+			Size:        doc.Size,
+			Chunks:      doc.Chunks,
+			ChunkSize:   doc.ChunkSize,
+			StoredSize:  -1,
+			SHA256:      doc.SHA256,
+			Version:     doc.Version,
+			ContentType: doc.ContentType,
+			ModTime:     doc.UpdatedAt,
+		}
+		if doc.StoredSize != nil {
+			info.StoredSize = *doc.StoredSize
+		}
+		found[doc.ID] = info
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	infos := make([]BlobInfo, 0, len(found))
+	for _, id := range ids {
+		if info, ok := found[id]; ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// Stream returns a channel that receives the IDs of all blobs as they
+// are read from the database. The channel is closed when all IDs are
+// sent, or when ctx is canceled. If listing fails, the error is sent to
+// the error channel. The error channel is closed after the ID channel.
+func (store *Store) Stream(ctx context.Context) (<-chan string, <-chan error) {
+	ids := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(ids)
+		err := store.eachBlobID(ctx, func(blobID string) error {
+			select {
+			case ids <- blobID:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return ids, errs
+}
+
+// ModifiedSince returns the IDs of the blobs last written after t, in
+// the order they were written. Blobs without a modification time,
+// written by older versions of this package, are not returned. Use
+// EachModifiedSince for large result sets.
+func (store *Store) ModifiedSince(ctx context.Context, t time.Time) ([]string, error) {
+	var ids []string
+	err := store.EachModifiedSince(ctx, t, func(blobID string, _ time.Time) error {
+		ids = append(ids, blobID)
+		return nil
+	})
+	return ids, err
+}
+
+// EachModifiedSince calls fn with the ID and modification time of every
+// blob last written after t, in the order they were written, until fn
+// returns an error. IDs are streamed from the database as fn is
+// called. An incremental sync can record the last modification time
+// passed to fn, and continue from it on the next run. This uses the
+// updatedAt index created by EnsureIndex.
+func (store *Store) EachModifiedSince(ctx context.Context, t time.Time, fn func(blobID string, modTime time.Time) error) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "blobId", Value: 1}}).
+		SetProjection(bson.M{"blobId": 1, "updatedAt": 1})
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	cursor, err := store.Collection.Find(ctx, bson.M{
+		"seq":       headerSeq,
+		"updatedAt": bson.M{"$gt": t},
+		"blobId":    notInternal(),
+		"pending":   bson.M{"$ne": true},
+	}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var hdr blobHeader
+		if err := cursor.Decode(&hdr); err != nil {
+			return err
+		}
+		if err := fn(hdr.ID, hdr.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,262 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestListPage(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	var expected []string
+	for i := 0; i < 7; i++ {
+		id := fmt.Sprintf("blob%d", i)
+		expected = append(expected, id)
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(3000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var listed []string
+	after := ""
+	for {
+		ids, next, err := store.ListPage(context.Background(), after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, ids...)
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("Wrong list: %v", listed)
+	}
+}
+
+func TestList(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	var expected []string
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("a/%d", i)
+		expected = append(expected, id)
+		if err := store.Write(ctx, id, bytes.NewReader(randomData(1000+i*500))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Write(ctx, "b/0", bytes.NewReader(randomData(10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reserve(ctx, "a/reserved"); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	it := store.List(ctx, ListOptions{Prefix: "a/", PageSize: 2})
+	for it.Next() {
+		info := it.Info()
+		listed = append(listed, info.ID)
+		size := int64(1000 + (len(listed)-1)*500)
+		if info.Size != size || info.Chunks != (size+1023)/1024 || info.SHA256 == "" || info.ModTime.IsZero() {
+			t.Errorf("Wrong info: %+v", info)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("Wrong list: %v", listed)
+	}
+	// Continue from a token with a limit
+	it = store.List(ctx, ListOptions{Prefix: "a/", Limit: 2})
+	for it.Next() {
+	}
+	if it.Token() != "a/1" {
+		t.Errorf("Wrong token: %s", it.Token())
+	}
+	listed = nil
+	it = store.List(ctx, ListOptions{Prefix: "a/", After: "a/1"})
+	for it.Next() {
+		listed = append(listed, it.Info().ID)
+	}
+	if !reflect.DeepEqual(listed, expected[2:]) {
+		t.Errorf("Wrong list: %v", listed)
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+
+	for _, id := range []string{"c", "a", "b"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(100))); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+	if err := store.Reserve(context.Background(), "reserved"); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.ModifiedSince(context.Background(), time.Date(2020, 1, 2, 3, 4, 30, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("Wrong IDs: %v", ids)
+	}
+}
+
+func TestEachModifiedSince(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+
+	start := now
+	for _, id := range []string{"c", "a", "b"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(100))); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+	var ids []string
+	var times []time.Time
+	err := store.EachModifiedSince(context.Background(), start.Add(-time.Second), func(blobID string, modTime time.Time) error {
+		ids = append(ids, blobID)
+		times = append(times, modTime)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"c", "a", "b"}) {
+		t.Errorf("Wrong IDs: %v", ids)
+	}
+	for i, modTime := range times {
+		if !modTime.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Errorf("%s: wrong modification time %v", ids[i], modTime)
+		}
+	}
+	// Continuing from the last time seen returns nothing new
+	err = store.EachModifiedSince(context.Background(), times[len(times)-1], func(blobID string, _ time.Time) error {
+		t.Errorf("Unexpected blob %s", blobID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The error of fn stops the iteration
+	stop := errors.New("stop")
+	n := 0
+	err = store.EachModifiedSince(context.Background(), time.Time{}, func(string, time.Time) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Expected stop after 1 blob, got %v after %d", err, n)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for id, size := range map[string]int{"a": 100, "b": 2000, "c": 5000} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(randomData(size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := store.Query(context.Background(), bson.M{"seq": headerSeq, "size": bson.M{"$gt": 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"b", "c"}) {
+		t.Errorf("Wrong ids: %v", ids)
+	}
+	ids, err = store.Query(context.Background(), bson.M{"$expr": bson.M{"$gt": bson.A{bson.M{"$add": bson.A{"$s", "$n"}}, 3000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"c"}) {
+		t.Errorf("Wrong ids: %v", ids)
+	}
+}
+
+func TestRemoveWhere(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	for i, size := range []int{100, 5000, 3000} {
+		if err := store.Write(context.Background(), fmt.Sprint(i), bytes.NewReader(randomData(size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetMetadata(context.Background(), "0", bson.M{"tag": "temp"}); err != nil {
+		t.Fatal(err)
+	}
+	// A segment filter removes whole blobs
+	n, err := store.RemoveWhere(context.Background(), bson.M{"s": bson.M{"$gte": 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Removed %d blobs", n)
+	}
+	n, err = store.RemoveWhere(context.Background(), bson.M{"seq": -1, "meta.tag": "temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Removed %d blobs", n)
+	}
+	ids, _, err := store.ListPage(context.Background(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"2"}) {
+		t.Errorf("Wrong blobs left: %v", ids)
+	}
+	n, err = store.Collection.CountDocuments(context.Background(), bson.M{"blobId": "1"})
+	if err != nil || n != 0 {
+		t.Errorf("Documents of removed blob left: %d %v", n, err)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(2000)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Write(context.Background(), id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Write(context.Background(), "d", bytes.NewReader(randomData(2000))); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := store.FindDuplicates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group, got %v", groups)
+	}
+	for _, ids := range groups {
+		if !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+			t.Errorf("Wrong group: %v", ids)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrLocked is returned when a blob is locked by someone else
+var ErrLocked = errors.New("Locked")
+
+// lockSeq is the seq value of the lock document of a blob
+const lockSeq = -2
+
+// Lock acquires an exclusive lock on a blob for ttl. The lock is a
+// document in the blob collection, so it works across processes. If
+// the blob is already locked, returns ErrLocked. The returned unlock
+// function releases the lock. It only releases the lock if it is still
+// held by this caller, and calling it more than once has no effect.
+// If the lock is not released, it expires after ttl.
+//
+// Lock relies on the unique index created by EnsureIndex.
+func (store *Store) Lock(ctx context.Context, blobID string, ttl time.Duration) (unlock func() error, err error) {
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	owner := hex.EncodeToString(rnd[:])
+	now := store.now()
+	// Take over the lock if it expired, otherwise insert a new lock.
+	// If the lock is held, the insert fails on the unique index.
+	_, err = store.Collection.UpdateOne(ctx, bson.M{
+		"blobId":   blobID,
+		"seq":      lockSeq,
+		"expireAt": bson.M{"$lt": now},
+	}, bson.M{"$set": bson.M{
+		"owner":    owner,
+		"expireAt": now.Add(ttl),
+	}}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			_, err = store.Collection.DeleteOne(context.Background(), bson.M{
+				"blobId": blobID,
+				"seq":    lockSeq,
+				"owner":  owner,
+			})
+		})
+		return err
+	}, nil
+}
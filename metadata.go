@@ -0,0 +1,106 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// metaField is the field of the blob header containing user metadata
+const metaField = "meta"
+
+// EnsureMetadataIndex creates an index for each of the given user
+// metadata fields of blob headers, so queries on metadata do not scan
+// the collection. The indexes are partial indexes covering only the
+// header documents.
+func (store *Store) EnsureMetadataIndex(ctx context.Context, fields ...string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	models := make([]mongo.IndexModel, 0, len(fields))
+	for _, field := range fields {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: metaField + "." + field, Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"seq": headerSeq}),
+		})
+	}
+	_, err := store.Collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// SetMetadata sets user metadata fields of a blob, such as tags. The
+// fields are merged with the existing metadata, and they are kept when
+// the blob is written again. Returns ErrNotFound if the blob does not
+// exist.
+func (store *Store) SetMetadata(ctx context.Context, blobID string, meta bson.M) error {
+	if len(meta) == 0 {
+		return nil
+	}
+	exists, err := store.exists(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound(blobID)
+	}
+	fields := bson.M{}
+	for k, v := range meta {
+		fields[metaField+"."+k] = v
+	}
+	return store.setHeader(ctx, blobID, fields)
+}
+
+// WriteWithMeta writes the blob with the user metadata meta. The
+// metadata is recorded in the header with the size of the blob, so it
+// becomes visible together with the data.
+func (store *Store) WriteWithMeta(ctx context.Context, blobID string, data io.Reader, meta bson.M) error {
+	return store.Write(ctx, blobID, data, WithMeta(meta))
+}
+
+// SetMeta replaces the user metadata of a blob with meta. Unlike
+// SetMetadata, fields not in meta are removed. The segments of the
+// blob are not modified. Returns ErrNotFound if the blob does not
+// exist.
+func (store *Store) SetMeta(ctx context.Context, blobID string, meta bson.M) error {
+	exists, err := store.exists(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound(blobID)
+	}
+	if meta == nil {
+		meta = bson.M{}
+	}
+	return store.setHeader(ctx, blobID, bson.M{metaField: meta})
+}
+
+// Metadata returns the user metadata of a blob. Returns ErrNotFound if
+// the blob does not exist.
+func (store *Store) Metadata(ctx context.Context, blobID string) (bson.M, error) {
+	var hdr struct {
+		Meta bson.M `bson:"meta"`
+	}
+	err := store.Collection.FindOne(ctx, headerFilter(blobID), options.FindOne().SetProjection(bson.M{metaField: 1})).Decode(&hdr)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		exists, err := store.exists(ctx, blobID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, notFound(blobID)
+		}
+		return bson.M{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Meta == nil {
+		hdr.Meta = bson.M{}
+	}
+	return hdr.Meta, nil
+}
@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Move transfers a blob from src to dst, which can be in different
+// databases or clusters, replacing any existing blob with the same ID
+// in dst. The blob is staged in dst, and committed only after the
+// number of bytes copied matches the size of the source blob, and the
+// hash of the copied data matches the content hash of the source blob
+// if it is known. The blob is removed from src after it is committed
+// to dst and its size in dst is verified. If any step fails, the
+// source blob is left intact.
+func Move(ctx context.Context, dst, src *Store, blobID string) error {
+	hdr, err := src.getHeader(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	var opts []WriteOption
+	if hdr != nil && hdr.ChunkSize > 0 {
+		opts = append(opts, WithChunkSize(hdr.ChunkSize))
+	}
+	// Read the stored data, so blobs are copied as is even if src
+	// detects compression
+	rd, err := src.read(ctx, blobID, false)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	u, err := dst.BeginUpload(ctx, blobID, opts...)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(u, io.TeeReader(rd, hash))
+	if err == nil {
+		err = verifyMove(blobID, hdr, rd.Size(), n, hex.EncodeToString(hash.Sum(nil)))
+	}
+	if err != nil {
+		u.Abort()
+		return err
+	}
+	if err := u.Commit(); err != nil {
+		return err
+	}
+	size, err := dst.Size(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if size != n {
+		return fmt.Errorf("%w: %s: moved %d bytes, stored %d", ErrCorrupted, blobID, n, size)
+	}
+	return src.Remove(ctx, blobID)
+}
+
+// verifyMove checks the data copied from a blob with the given header
+// and size
+func verifyMove(blobID string, hdr *blobHeader, size, copied int64, sum string) error {
+	if size >= 0 && copied != size {
+		return fmt.Errorf("%w: %s: copied %d bytes, expected %d", ErrCorrupted, blobID, copied, size)
+	}
+	if hdr != nil && hdr.SHA256 != "" && hdr.SHA256 != sum {
+		return fmt.Errorf("%w: %s: content hash mismatch", ErrCorrupted, blobID)
+	}
+	return nil
+}
+
+// Rename changes the ID of a blob to newID, replacing any existing
+// blob with that ID. The header, with the metadata of the blob, and
+// the saved versions of the blob are renamed with its segments, and
+// locks are left in place. If the deployment supports transactions,
+// this is done atomically. Encrypted segments are authenticated with
+// the blob ID, so an encrypted blob is copied and re-encrypted
+// instead. Saved versions of a replaced blob are kept, and are listed
+// with the versions of the renamed blob. Returns ErrNotFound if the
+// blob does not exist.
+func (store *Store) Rename(ctx context.Context, blobID, newID string) error {
+	if blobID == newID {
+		return nil
+	}
+	if store.WriteOnce {
+		if err := store.checkWritable(ctx, blobID); err != nil {
+			return err
+		}
+	}
+	enc, err := store.blobEncrypter(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	versions, err := store.versionIDs(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	return store.inTransaction(ctx, func(ctx context.Context) error {
+		if err := store.renameBlob(ctx, enc, blobID, newID); err != nil {
+			return err
+		}
+		for _, id := range versions {
+			renamed := versionPrefix + newID + strings.TrimPrefix(id, versionPrefix+blobID)
+			if err := store.renameBlob(ctx, enc, id, renamed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renameBlob replaces dstID with the documents of srcID. If enc is
+// set, the blob is copied and re-encrypted.
+func (store *Store) renameBlob(ctx context.Context, enc Encrypter, srcID, dstID string) error {
+	if enc != nil {
+		if err := store.copyBlob(ctx, srcID, dstID); err != nil {
+			return err
+		}
+		return store.remove(ctx, srcID)
+	}
+	exists, err := store.exists(ctx, srcID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound(srcID)
+	}
+	if err := store.checkWritable(ctx, dstID); err != nil {
+		return err
+	}
+	if err := store.remove(ctx, dstID); err != nil {
+		return err
+	}
+	_, err = store.Collection.UpdateMany(ctx, bson.M{"blobId": srcID, "seq": bson.M{"$ne": lockSeq}}, bson.M{"$set": bson.M{"blobId": dstID}})
+	return err
+}
@@ -0,0 +1,49 @@
+package blobstore
+
+// NopCodec is a codec that does not compress. It is the codec of
+// writers of a store without a Codec. Its name is empty, so segments
+// written with it are stored uncompressed, as segments written before
+// it existed.
+type NopCodec struct{}
+
+// Name returns the empty name of uncompressed segments
+func (NopCodec) Name() string { return "" }
+
+// Compress returns data
+func (NopCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+
+// Decompress returns data
+func (NopCodec) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+// NopEncrypter is an encrypter that does not encrypt. It is the
+// encrypter of writers of a store without an Encrypter. It returns an
+// empty nonce, so segments written with it are stored as unencrypted
+// segments, without a final marker, and can be read without an
+// encrypter.
+type NopEncrypter struct{}
+
+// Encrypt returns plaintext with an empty nonce
+func (NopEncrypter) Encrypt(plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
+	return nil, plaintext, nil
+}
+
+// Decrypt returns ciphertext
+func (NopEncrypter) Decrypt(nonce, ciphertext, aad []byte) ([]byte, error) {
+	return ciphertext, nil
+}
+
+// codecOrNop returns codec, or NopCodec if it is nil
+func codecOrNop(codec Codec) Codec {
+	if codec == nil {
+		return NopCodec{}
+	}
+	return codec
+}
+
+// encrypterOrNop returns enc, or NopEncrypter if it is nil
+func encrypterOrNop(enc Encrypter) Encrypter {
+	if enc == nil {
+		return NopEncrypter{}
+	}
+	return enc
+}
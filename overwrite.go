@@ -0,0 +1,111 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// WriteAt overwrites the bytes of the blob at offset with data. The
+// range must lie within the blob, otherwise ErrInvalidRange is
+// returned. Only the segments containing the range are rewritten, the
+// other segments are not modified. The content hash of the blob is
+// cleared, since it is no longer known. WriteAt is not atomic: a
+// concurrent reader may see some of the segments changed, and
+// concurrent writes to the same segments are not detected.
+func (store *Store) WriteAt(ctx context.Context, blobID string, offset int64, data []byte) error {
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	if store.AppendOnly {
+		return ErrAppendOnly
+	}
+	if offset < 0 {
+		return ErrInvalidRange
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	size, err := store.blobEnd(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	end := offset + int64(len(data))
+	if end > size {
+		return ErrInvalidRange
+	}
+	w, enc, err := store.continueWriter(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	cursor, err := store.Collection.Find(ctx, bson.M{
+		"blobId": blobID,
+		"seq":    bson.M{"$gte": 0},
+		"s":      bson.M{"$lt": end},
+		"$expr":  bson.M{"$gt": bson.A{bson.M{"$add": bson.A{"$s", "$n"}}, offset}},
+	}, store.findSorted(1))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var stored int64
+	for cursor.Next(ctx) {
+		var old blobSegment
+		if err := cursor.Decode(&old); err != nil {
+			return err
+		}
+		raw, err := store.resolveSegment(ctx, cursor.Current)
+		if err != nil {
+			return err
+		}
+		store.countSegment(raw)
+		plain, err := store.decodeSegment(ctx, enc, blobID, raw)
+		if err != nil {
+			return err
+		}
+		if uint64(len(plain)) != old.N {
+			return ErrCorrupted
+		}
+		// Copy the part of data within the segment
+		from := offset - int64(old.Start)
+		src := data
+		if from < 0 {
+			src = data[-from:]
+			from = 0
+		}
+		copy(plain[from:], src)
+		segment, err := w.encode(old.Seq, old.Start, plain, old.Start+old.N == uint64(size))
+		if err != nil {
+			return err
+		}
+		segment.ExpireAt = old.ExpireAt
+		if err := w.put(ctx, segment, plain, true); err != nil {
+			return err
+		}
+		if val, err := raw.LookupErr("data"); err == nil {
+			_, oldData := val.Binary()
+			stored += int64(len(segment.Data) - len(oldData))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	version, err := newVersion()
+	if err != nil {
+		return err
+	}
+	// Blobs without a header are left without one
+	if _, err := store.Collection.UpdateOne(ctx, headerFilter(blobID), bson.M{"$set": bson.M{
+		"sha256":       "",
+		"segmentsHash": "",
+		"version":      version,
+		"updatedAt":    store.now(),
+	}}); err != nil {
+		return err
+	}
+	if stored != 0 {
+		_, err = store.Collection.UpdateOne(ctx, bson.M{"blobId": blobID, "seq": headerSeq, "storedSize": bson.M{"$gte": 0}},
+			bson.M{"$inc": bson.M{"storedSize": stored}})
+	}
+	return err
+}
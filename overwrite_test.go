@@ -0,0 +1,58 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func segmentDocs(t *testing.T, store *Store, blobID string) map[int64]bson.Raw {
+	cursor, err := store.Collection.Find(context.Background(), segmentFilter(blobID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close(context.Background())
+	docs := map[int64]bson.Raw{}
+	for cursor.Next(context.Background()) {
+		docs[cursor.Current.Lookup("seq").AsInt64()] = append(bson.Raw(nil), cursor.Current...)
+	}
+	return docs
+}
+
+func TestWriteAt(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(10 * 1024)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data), WithChunkSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+	before := segmentDocs(t, store, "1")
+	// Patch within segment 3, and across segments 4 to 6
+	patches := map[int64][]byte{3500: randomData(100), 5000: randomData(1200)}
+	for offset, patch := range patches {
+		if err := store.WriteAt(context.Background(), "1", offset, patch); err != nil {
+			t.Fatal(err)
+		}
+		copy(data[offset:], patch)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	after := segmentDocs(t, store, "1")
+	for seq, doc := range before {
+		changed := seq >= 3 && seq <= 6
+		if same := bytes.Equal(doc, after[seq]); same == changed {
+			t.Errorf("Segment %d: expected changed %v", seq, changed)
+		}
+	}
+	if err := store.DeepVerify(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	if err := store.WriteAt(context.Background(), "1", 10*1024-10, randomData(11)); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// WriteParallel writes the blob from r, which has the given size.
+// Segments are read from r and written using concurrency goroutines.
+// The first segment is written before the others, so the compression
+// decision is made once for the blob. The Codec and the Encrypter of
+// the store must be safe for concurrent use. Segments of a previous,
+// larger version of the blob are removed.
+func (store *Store) WriteParallel(ctx context.Context, blobID string, r io.ReaderAt, size int64, concurrency int, opts ...WriteOption) error {
+	if size < 0 {
+		return ErrInvalidRange
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	w, err := store.NewWriter(ctx, blobID, opts...)
+	if err != nil {
+		return err
+	}
+	chunkSize := int64(w.chunkSize)
+	if size == 0 {
+		return w.Close()
+	}
+	// Check the segment limit before writing anything
+	if err := w.checkChunks(uint64((size+chunkSize-1)/chunkSize) - 1); err != nil {
+		return err
+	}
+	// Segments are written out of order, so the hash of the blob is
+	// not computed
+	w.hash = nil
+	w.segmentsHash = nil
+	count := uint64((size + chunkSize - 1) / chunkSize)
+	// Write the first segment to check the codec
+	w.final = count == 1
+	w.buf = w.buf[:min64(chunkSize, size)]
+	if err := readFullAt(r, w.buf, 0); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stored int64
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	seqs := make(chan uint64)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunkSize)
+			for seq := range seqs {
+				start := int64(seq) * chunkSize
+				data := buf[:min64(chunkSize, size-start)]
+				if err := readFullAt(r, data, start); err != nil {
+					fail(err)
+					continue
+				}
+				segment, err := w.encode(seq, uint64(start), data, seq == count-1)
+				if err == nil {
+					err = w.put(ctx, segment, data, false)
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+				atomic.AddInt64(&stored, int64(len(segment.Data)))
+			}
+		}()
+	}
+	for seq := uint64(1); seq < count && ctx.Err() == nil; seq++ {
+		select {
+		case seqs <- seq:
+		case <-ctx.Done():
+		}
+	}
+	close(seqs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.seq = count
+	w.start = uint64(size)
+	w.stored += stored
+	w.sealed = true
+	return w.Close()
+}
+
+// readFullAt reads len(p) bytes from r at off
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWriteParallel(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// A larger previous version is truncated
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(20000))); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 100, 1024, 10000} {
+		data := randomData(size)
+		if err := store.WriteParallel(context.Background(), "1", bytes.NewReader(data), int64(size), 4); err != nil {
+			t.Fatal(err)
+		}
+		if size == 0 {
+			continue
+		}
+		if err := store.CheckIntegrity(context.Background(), "1"); err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(readBlob(t, store, "1"), data) {
+			t.Errorf("Wrong data for size %d", size)
+		}
+	}
+}
+
+func TestWriteConcurrency(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.WriteConcurrency = 4
+
+	ctx := context.Background()
+	if err := store.Write(ctx, "1", bytes.NewReader(randomData(30000))); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{nil, GzipCodec{}} {
+		store.Codec = codec
+		for _, size := range []int{0, 100, 1024, 10000, 20480} {
+			data := randomData(size)
+			info, err := store.WriteReader(ctx, "1", bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(size) || info.SHA256 == "" || info.StoredSize < 0 {
+				t.Errorf("Wrong info for size %d: %+v", size, info)
+			}
+			if err := store.Verify(ctx, "1"); err != nil {
+				t.Errorf("Size %d: %v", size, err)
+			}
+			if !bytes.Equal(readBlob(t, store, "1"), data) {
+				t.Errorf("Wrong data for size %d", size)
+			}
+		}
+	}
+	// A failed segment fails the write
+	store.MaxChunks = 5
+	if err := store.Write(ctx, "1", bytes.NewReader(randomData(10000))); !errors.Is(err, ErrTooManyChunks) {
+		t.Errorf("Expected ErrTooManyChunks, got %v", err)
+	}
+}
+
+func BenchmarkWriteConcurrency(b *testing.B) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+		ChunkSize:  255 * 1024,
+	}
+	defer cleanupBlobs(store)
+
+	data := randomData(16 * 1024 * 1024)
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprint(concurrency), func(b *testing.B) {
+			store.WriteConcurrency = concurrency
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
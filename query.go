@@ -0,0 +1,116 @@
+package blobstore
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Query returns the IDs of the blobs with a header or segment
+// document matching match, in ascending order. The filter is matched
+// against the header (seq -1) and segment (seq >= 0) documents of the
+// blobs, so it can select blobs by header fields, such as
+// {"seq": -1, "size": {"$gt": 1000}}, or by segment fields, such as
+// {"$expr": {"$gt": [{"$add": ["$s", "$n"]}, 1000]}}. Uncommitted
+// uploads are not included.
+func (store *Store) Query(ctx context.Context, match bson.M) ([]string, error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$and": bson.A{
+				bson.M{"seq": bson.M{"$gte": headerSeq}},
+				bson.M{"blobId": notInternal()},
+				match,
+			},
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "blobId": 1}}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}, store.scanAggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var ids []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+// RemoveWhere removes the blobs with a header or segment document
+// matching match, and returns the number of blobs removed. The filter
+// selects blobs as in Query, and whole blobs are removed: a filter
+// matching a single segment of a blob removes all of its documents,
+// not only the matching segment. Restrict the filter to headers with
+// {"seq": -1} to select blobs by header fields, such as size,
+// updatedAt or user metadata. Locks and uncommitted uploads are not
+// removed. If the store is in DryRun mode, the blobs are counted, but
+// not removed.
+func (store *Store) RemoveWhere(ctx context.Context, match bson.M) (int64, error) {
+	if store.WriteOnce {
+		return 0, ErrImmutable
+	}
+	ids, err := store.Query(ctx, match)
+	if err != nil || store.DryRun {
+		return int64(len(ids)), err
+	}
+	var removed int64
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > removeWhereBatch {
+			n = removeWhereBatch
+		}
+		if err := store.remove(ctx, ids[:n]...); err != nil {
+			return removed, err
+		}
+		removed += int64(n)
+		ids = ids[n:]
+	}
+	return removed, nil
+}
+
+// removeWhereBatch is the number of blobs RemoveWhere removes with one
+// query
+const removeWhereBatch = 1000
+
+// FindDuplicates returns the IDs of blobs with identical contents,
+// grouped by the hex encoded SHA-256 hash of the contents. Only groups
+// with more than one blob are returned. Blobs whose hash is not known,
+// such as blobs written by WriteParallel or appended to, are not
+// included. Uncommitted uploads are not included.
+func (store *Store) FindDuplicates(ctx context.Context) (map[string][]string, error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"seq":    headerSeq,
+			"sha256": bson.M{"$exists": true, "$ne": ""},
+			"blobId": notInternal(),
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$sha256", "ids": bson.M{"$push": "$blobId"}}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	}, store.scanAggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	groups := map[string][]string{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			Hash string   `bson:"_id"`
+			IDs  []string `bson:"ids"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		sort.Strings(doc.IDs)
+		groups[doc.Hash] = doc.IDs
+	}
+	return groups, cursor.Err()
+}
@@ -0,0 +1,231 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+)
+
+// ByteRange is a range of bytes of a blob
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// RangeReader reads several ranges of a blob in order. Call Next to
+// move to the next range, and read the data of the range from the
+// RangeReader until io.EOF. Close the RangeReader to release the
+// underlying cursor.
+type RangeReader struct {
+	ctx    context.Context
+	store  *Store
+	blobID string
+	size   int64
+	ranges []ByteRange
+	gap    int64
+	// The index of the current range, and the index after the last
+	// range read by rd
+	current  int
+	groupEnd int
+	// rd reads the current group of ranges, and pos is its offset
+	rd  *Reader
+	pos int64
+	// The number of bytes of the current range not yet read
+	left int64
+	err  error
+}
+
+// ReadRanges returns a reader for the given ranges of a blob. Ranges
+// must be sorted by offset and must not overlap. Ranges separated by
+// at most gap bytes are read using a single query, and the data
+// between them is discarded, so clustered ranges take one round-trip.
+// A range extending beyond the end of the blob is cut at the end.
+// Returns ErrInvalidRange if the ranges are not sorted, overlap, or
+// start beyond the end of the blob.
+func (store *Store) ReadRanges(ctx context.Context, blobID string, ranges []ByteRange, gap int64) (*RangeReader, error) {
+	end := int64(0)
+	for _, r := range ranges {
+		if r.Offset < end || r.Length < 0 {
+			return nil, ErrInvalidRange
+		}
+		end = r.Offset + r.Length
+	}
+	size, err := store.blobEnd(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	clamped := make([]ByteRange, len(ranges))
+	for i, r := range ranges {
+		if r.Offset > size {
+			return nil, ErrInvalidRange
+		}
+		if r.Length > size-r.Offset {
+			r.Length = size - r.Offset
+		}
+		clamped[i] = r
+	}
+	return &RangeReader{ctx: ctx, store: store, blobID: blobID, size: size, ranges: clamped, gap: gap, current: -1}, nil
+}
+
+// Next moves to the next range. Returns false if there are no more
+// ranges, or if there is an error. The unread data of the previous
+// range is discarded.
+func (rr *RangeReader) Next() bool {
+	if rr.err != nil || rr.current >= len(rr.ranges) {
+		return false
+	}
+	rr.current++
+	rr.left = 0
+	if rr.current >= len(rr.ranges) {
+		rr.closeGroup()
+		return false
+	}
+	r := rr.ranges[rr.current]
+	if rr.current >= rr.groupEnd {
+		if rr.err = rr.openGroup(); rr.err != nil {
+			return false
+		}
+	}
+	if r.Length > 0 {
+		if _, err := io.CopyN(io.Discard, rr.rd, r.Offset-rr.pos); err != nil {
+			rr.err = err
+			return false
+		}
+		rr.pos = r.Offset
+	}
+	rr.left = r.Length
+	return true
+}
+
+// openGroup opens a reader for the current range and the ranges
+// following it within the gap
+func (rr *RangeReader) openGroup() error {
+	rr.closeGroup()
+	start := rr.ranges[rr.current].Offset
+	end := start + rr.ranges[rr.current].Length
+	rr.groupEnd = rr.current + 1
+	for rr.groupEnd < len(rr.ranges) && rr.ranges[rr.groupEnd].Offset <= end+rr.gap {
+		if e := rr.ranges[rr.groupEnd].Offset + rr.ranges[rr.groupEnd].Length; e > end {
+			end = e
+		}
+		rr.groupEnd++
+	}
+	if end <= start {
+		// Only empty ranges
+		return nil
+	}
+	rd, err := rr.store.limitRead(rr.ctx, func() (*Reader, error) {
+		return rr.store.openRange(rr.ctx, rr.blobID, start, end, rr.size)
+	})
+	if err != nil {
+		return err
+	}
+	rr.rd = rd
+	rr.pos = start
+	return nil
+}
+
+// closeGroup closes the reader of the current group
+func (rr *RangeReader) closeGroup() {
+	if rr.rd != nil {
+		rr.rd.Close()
+		rr.rd = nil
+	}
+}
+
+// Range returns the current range. The length is cut at the end of
+// the blob.
+func (rr *RangeReader) Range() ByteRange {
+	if rr.current < 0 || rr.current >= len(rr.ranges) {
+		return ByteRange{}
+	}
+	return rr.ranges[rr.current]
+}
+
+// Read reads the data of the current range. Returns io.EOF at the end
+// of the range.
+func (rr *RangeReader) Read(p []byte) (int, error) {
+	if rr.err != nil {
+		return 0, rr.err
+	}
+	if rr.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > rr.left {
+		p = p[:rr.left]
+	}
+	n, err := rr.rd.Read(p)
+	rr.pos += int64(n)
+	rr.left -= int64(n)
+	if err == io.EOF && rr.left > 0 {
+		// The blob was truncated since it was opened
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Err returns the error that stopped Next
+func (rr *RangeReader) Err() error {
+	return rr.err
+}
+
+// Close releases the underlying cursor
+func (rr *RangeReader) Close() error {
+	rr.closeGroup()
+	rr.current = len(rr.ranges)
+	return nil
+}
+
+// BlobReaderAt is an io.ReaderAt for a blob. Each ReadAt fetches only
+// the segments overlapping the range read, so it can be used for
+// random access to large blobs, for instance with io.NewSectionReader.
+// ReadAt can be called concurrently.
+type BlobReaderAt struct {
+	ctx    context.Context
+	store  *Store
+	blobID string
+	size   int64
+}
+
+// NewReaderAt returns an io.ReaderAt for the blob. The size of the
+// blob is read when the reader is created. Returns ErrNotFound if the
+// blob does not exist.
+func (store *Store) NewReaderAt(ctx context.Context, blobID string) (*BlobReaderAt, error) {
+	size, err := store.blobEnd(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobReaderAt{ctx: ctx, store: store, blobID: blobID, size: size}, nil
+}
+
+// Size returns the size of the blob when the reader was created
+func (r *BlobReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the blob starting at off. If fewer bytes
+// are read, the error explains why, and it is io.EOF at the end of the
+// blob.
+func (r *BlobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidRange
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	rd, err := r.store.ReadRange(r.ctx, r.blobID, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	n, err := io.ReadFull(rd, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
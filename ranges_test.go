@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadRanges(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(10000)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	ranges := []ByteRange{{10, 20}, {40, 0}, {100, 1000}, {5000, 10}, {9990, 100}}
+	rr, err := store.ReadRanges(context.Background(), "1", ranges, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+	i := 0
+	for rr.Next() {
+		r := ranges[i]
+		if r.Offset+r.Length > int64(len(data)) {
+			r.Length = int64(len(data)) - r.Offset
+		}
+		if rr.Range() != r {
+			t.Errorf("%d: wrong range %v", i, rr.Range())
+		}
+		// Read only part of one of the ranges
+		if i == 2 {
+			buf := make([]byte, 10)
+			if _, err := io.ReadFull(rr, buf); err != nil || !bytes.Equal(buf, data[100:110]) {
+				t.Errorf("%d: wrong partial data: %v", i, err)
+			}
+			i++
+			continue
+		}
+		read, err := io.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data[r.Offset:r.Offset+r.Length]) {
+			t.Errorf("%d: wrong data", i)
+		}
+		i++
+	}
+	if err := rr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(ranges) {
+		t.Errorf("Expected %d ranges, got %d", len(ranges), i)
+	}
+
+	for _, ranges := range [][]ByteRange{{{100, 10}, {50, 10}}, {{0, 100}, {50, 10}}, {{20000, 1}}} {
+		if _, err := store.ReadRanges(context.Background(), "1", ranges, 0); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("%v: expected ErrInvalidRange, got %v", ranges, err)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	data := randomData(5005)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.NewReaderAt(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 5005 {
+		t.Errorf("Wrong size: %d", r.Size())
+	}
+	for _, c := range []struct{ off, n int }{{0, 10}, {1000, 100}, {1020, 2000}, {4000, 1005}} {
+		p := make([]byte, c.n)
+		if n, err := r.ReadAt(p, int64(c.off)); err != nil || n != c.n {
+			t.Fatalf("ReadAt %d %d: %d %v", c.off, c.n, n, err)
+		}
+		if !bytes.Equal(p, data[c.off:c.off+c.n]) {
+			t.Errorf("ReadAt %d %d: wrong data", c.off, c.n)
+		}
+	}
+	p := make([]byte, 100)
+	if n, err := r.ReadAt(p, 4950); err != io.EOF || n != 55 || !bytes.Equal(p[:n], data[4950:]) {
+		t.Errorf("Expected 55 bytes and io.EOF, got %d %v", n, err)
+	}
+	if _, err := r.ReadAt(p, 5005); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if _, err := store.NewReaderAt(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,1017 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reader streams the data of a blob. Segments are fetched from the
+// database as the data is read, so an abandoned reader does not hold
+// on to any goroutines, unless the store has ReadPrefetch set. Close
+// releases the underlying cursor. Segments are read in seq order, and
+// reading fails with an error wrapping ErrCorrupted if a segment does
+// not start where the previous one ended, or if the trailing segments
+// of an encrypted blob are missing.
+type Reader struct {
+	// Number of bytes returned, updated atomically. This is the first
+	// field for 64-bit alignment.
+	read   int64
+	ctx    context.Context
+	store  *Store
+	blobID string
+	enc    Encrypter
+	cursor *mongo.Cursor
+	size   int64
+	buf    []byte
+	err    error
+	// If set, segments are not decompressed
+	raw bool
+	// If set, the segment data is a compressed stream, and the blob
+	// is read from stream
+	stream      io.Reader
+	closeStream func()
+	// If set, called when the reader is done
+	release func()
+	// The expected start of the next segment. Segments must follow
+	// each other without gaps or overlaps.
+	nextStart uint64
+	started   bool
+	// The segment being decoded
+	current bson.Raw
+	// If set, segments are fetched ahead by a goroutine, and received
+	// from prefetch. prefetchErr is set before prefetch is closed.
+	prefetch     chan bson.Raw
+	prefetchErr  error
+	stopPrefetch chan struct{}
+	prefetchDone chan struct{}
+	// If set, the decoded segments are hashed, and the hash is
+	// compared to sum at the end of the blob
+	verify hash.Hash
+	sum    string
+	// If lazy is set, the cursor is opened by the first read
+	lazy bool
+	// If checkFinal is set, the reader reads to the end of the blob,
+	// and fails if the last encrypted segment read is not marked as
+	// the final segment. unfinished is set if a segment marked as not
+	// final was read.
+	checkFinal bool
+	unfinished bool
+	// If limited is set, the reader returns at most left more bytes
+	limited bool
+	left    int64
+	// filter matches the segments of the reader. If set, the cursor
+	// can be reopened after the segment lastSeq when it fails with a
+	// transient error. retries is the number of times it was reopened.
+	filter  bson.M
+	lastSeq int64
+	retries int
+	// closeOnce guards Close, and closeErr is the result of the first
+	// Close
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// DefaultReadBackoff waits 100ms before the first retry of a read,
+// doubling the wait for every further attempt up to 5s
+func DefaultReadBackoff(attempt int) time.Duration {
+	d := 100 * time.Millisecond
+	for i := 1; i < attempt && d < 5*time.Second; i++ {
+		d *= 2
+	}
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
+
+// retryableReadCodes are the server error codes after which a read
+// can be retried, as defined by the retryable reads specification,
+// and CursorNotFound
+var retryableReadCodes = []int{6, 7, 43, 89, 91, 134, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
+// isTransient returns if a read failed with err can be retried
+func isTransient(err error) bool {
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableReadError") {
+		return true
+	}
+	for _, code := range retryableReadCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// reopen replaces the cursor of the reader after it failed with err,
+// if err is transient and the reader has retries left. The new cursor
+// starts after the last segment read. Returns false if the cursor
+// cannot be reopened.
+func (rd *Reader) reopen(err error) bool {
+	for rd.filter != nil && rd.retries < rd.store.ReadRetries && isTransient(err) {
+		rd.retries++
+		backoff := rd.store.ReadBackoff
+		if backoff == nil {
+			backoff = DefaultReadBackoff
+		}
+		timer := time.NewTimer(backoff(rd.retries))
+		select {
+		case <-timer.C:
+		case <-rd.ctx.Done():
+			timer.Stop()
+			return false
+		}
+		filter := bson.M{}
+		for k, v := range rd.filter {
+			filter[k] = v
+		}
+		if rd.started {
+			filter["seq"] = bson.M{"$gt": rd.lastSeq}
+		}
+		var cursor *mongo.Cursor
+		cursor, err = rd.store.Collection.Find(rd.ctx, filter, rd.store.findSorted(1))
+		if err == nil {
+			rd.cursor.Close(context.Background())
+			rd.cursor = cursor
+			return true
+		}
+	}
+	return false
+}
+
+// newReader returns a reader for the segments of the cursor. The
+// cursor must be positioned on the first segment. If raw is set,
+// segments are not decompressed.
+func (store *Store) newReader(ctx context.Context, blobID string, cursor *mongo.Cursor, size int64, raw bool) (*Reader, error) {
+	enc, err := store.blobEncrypter(ctx, blobID)
+	if err != nil {
+		cursor.Close(ctx)
+		return nil, err
+	}
+	rd := &Reader{ctx: ctx, store: store, blobID: blobID, enc: enc, size: size, raw: raw}
+	rd.start(cursor)
+	return rd, nil
+}
+
+// start positions the reader on the first segment of cursor
+func (rd *Reader) start(cursor *mongo.Cursor) {
+	rd.cursor = cursor
+	rd.current = cursor.Current
+	if rd.store.ReadPrefetch > 0 {
+		rd.current = append(bson.Raw(nil), cursor.Current...)
+	}
+	rd.decode()
+	if rd.store.ReadPrefetch > 0 && rd.err == nil {
+		rd.startPrefetch(rd.store.ReadPrefetch)
+	}
+}
+
+// open opens the cursor of a lazy reader over the segments matching
+// its filter. If there are none, the reader fails with ErrNotFound,
+// unless its size is 0.
+func (rd *Reader) open() {
+	rd.lazy = false
+	cursor, err := rd.store.openSegments(rd.ctx, rd.filter)
+	if errors.Is(err, ErrNotFound) {
+		err = notFound(rd.blobID)
+		if rd.size == 0 {
+			err = io.EOF
+		}
+	}
+	if err != nil {
+		rd.fail(err)
+		return
+	}
+	rd.start(cursor)
+}
+
+// startPrefetch starts a goroutine fetching up to depth segments
+// ahead of the reader
+func (rd *Reader) startPrefetch(depth int) {
+	rd.prefetch = make(chan bson.Raw, depth)
+	rd.stopPrefetch = make(chan struct{})
+	rd.prefetchDone = make(chan struct{})
+	go func() {
+		defer close(rd.prefetchDone)
+		defer close(rd.prefetch)
+		for rd.cursor.Next(rd.ctx) {
+			select {
+			case rd.prefetch <- append(bson.Raw(nil), rd.cursor.Current...):
+			case <-rd.stopPrefetch:
+				return
+			}
+		}
+		rd.prefetchErr = rd.cursor.Err()
+	}()
+}
+
+// Size returns the total number of bytes the reader returns, not the
+// number of unread bytes. For a reader returned by Read, this is the
+// size of the blob. Size returns -1 if the size is not known.
+func (rd *Reader) Size() int64 {
+	return rd.size
+}
+
+// ReadSegments returns the concatenated data of the segments of the
+// blob with seq in [fromSeq, toSeq). Returns ErrNotFound if there are
+// no segments in the range, and ErrInvalidRange without querying the
+// blob if fromSeq is not before toSeq.
+func (store *Store) ReadSegments(ctx context.Context, blobID string, fromSeq, toSeq uint64) (io.ReadCloser, error) {
+	if fromSeq >= toSeq {
+		return nil, ErrInvalidRange
+	}
+	filter := bson.M{"blobId": blobID, "seq": bson.M{"$gte": fromSeq, "$lt": toSeq}}
+	rd, err := store.limitRead(ctx, func() (*Reader, error) {
+		cursor, err := store.openSegments(ctx, filter)
+		if errors.Is(err, ErrNotFound) {
+			return nil, notFound(blobID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var first segmentPos
+		if err := cursor.Decode(&first); err != nil {
+			cursor.Close(ctx)
+			return nil, err
+		}
+		last, err := store.lastSegment(ctx, filter)
+		if err != nil {
+			cursor.Close(ctx)
+			return nil, err
+		}
+		return store.newReader(ctx, blobID, cursor, int64(last.Start+last.N-first.Start), false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Peek returns the first n bytes of the blob, or the whole blob if it
+// is shorter than n. Only the segments containing the first n bytes
+// are fetched.
+func (store *Store) Peek(ctx context.Context, blobID string, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrInvalidRange
+	}
+	end := n
+	if end == 0 {
+		// Fetch the first segment to check if the blob exists
+		end = 1
+	}
+	filter := bson.M{"blobId": blobID, "seq": bson.M{"$gte": 0}, "s": bson.M{"$lt": end}}
+	rd, err := store.limitRead(ctx, func() (*Reader, error) {
+		cursor, err := store.openSegments(ctx, filter)
+		if errors.Is(err, ErrNotFound) {
+			return store.openEmpty(ctx, blobID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return store.newReader(ctx, blobID, cursor, -1, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	buf := make([]byte, n)
+	k, err := io.ReadFull(rd, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return buf[:k], nil
+}
+
+// ReadAllInto reads the whole blob into dst, and returns the number of
+// bytes read. Returns io.ErrShortBuffer if the blob does not fit into
+// dst. Use Size to allocate dst.
+func (store *Store) ReadAllInto(ctx context.Context, blobID string, dst []byte) (int, error) {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	if rd.Size() > int64(len(dst)) {
+		return 0, io.ErrShortBuffer
+	}
+	n, err := io.ReadFull(rd, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	if err != nil {
+		return n, err
+	}
+	// dst is full, check that there is no more data
+	var extra [1]byte
+	for {
+		k, err := rd.Read(extra[:])
+		if k > 0 {
+			return n, io.ErrShortBuffer
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// ReadBytes returns the whole blob. A blob stored in a single segment
+// is fetched with one query and returned without creating a Reader,
+// which saves the size query and most of the allocations of Read for
+// small blobs. Larger blobs are read using Read.
+func (store *Store) ReadBytes(ctx context.Context, blobID string) ([]byte, error) {
+	data, ok, err := store.readSingle(ctx, blobID)
+	if err != nil || ok {
+		return data, err
+	}
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	size := rd.Size()
+	if size < 0 {
+		size = 0
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := buf.ReadFrom(rd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadChunks calls fn with the data of each segment of the blob in
+// order, without copying it. The chunk is only valid during the call,
+// and fn must not modify it or keep a reference to it. If the stored
+// data is a compressed stream detected by DetectCompression, fn is
+// called with pieces of the decompressed data instead. ReadChunks
+// stops and returns the error if fn returns one.
+func (store *Store) ReadChunks(ctx context.Context, blobID string, fn func(chunk []byte) error) error {
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = rd.WriteTo(chunkWriter(fn))
+	return err
+}
+
+// chunkWriter passes written data to a ReadChunks callback
+type chunkWriter func(chunk []byte) error
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	if err := w(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readSingle returns the data of a blob stored in a single segment.
+// Returns false if the blob has more than one segment, or if its data
+// has to be detected as compressed.
+func (store *Store) readSingle(ctx context.Context, blobID string) ([]byte, bool, error) {
+	if err := store.autoIndex(ctx); err != nil {
+		return nil, false, err
+	}
+	release, err := store.acquireRead(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+	cursor, err := store.Collection.Find(ctx, segmentFilter(blobID), store.findSorted(1).SetLimit(2).SetBatchSize(2))
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return nil, false, err
+		}
+		empty, err := store.isEmpty(ctx, blobID)
+		if err != nil {
+			return nil, false, err
+		}
+		if !empty {
+			return nil, false, notFound(blobID)
+		}
+		return []byte{}, true, nil
+	}
+	// Next may reuse the buffer of Current
+	current := append(bson.Raw(nil), cursor.Current...)
+	if cursor.Next(ctx) {
+		return nil, false, nil
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, false, err
+	}
+	var pos segmentPos
+	if err := bson.Unmarshal(current, &pos); err != nil {
+		return nil, false, err
+	}
+	if pos.Start != 0 {
+		return nil, false, fmt.Errorf("%w: segment %d of %s starts at %d, expected 0", ErrCorrupted, pos.Seq, blobID, pos.Start)
+	}
+	enc, err := store.blobEncrypter(ctx, blobID)
+	if err != nil {
+		return nil, false, err
+	}
+	segment, err := store.resolveSegment(ctx, current)
+	if err != nil {
+		return nil, false, err
+	}
+	store.countSegment(segment)
+	data, err := store.decodeSegment(ctx, enc, blobID, segment)
+	if err != nil {
+		return nil, false, err
+	}
+	if uint64(len(data)) != pos.N {
+		return nil, false, fmt.Errorf("%w: segment %d of %s has %d bytes, expected %d", ErrCorrupted, pos.Seq, blobID, len(data), pos.N)
+	}
+	if final, ok := current.Lookup("final").BooleanOK(); ok && !final {
+		return nil, false, fmt.Errorf("%w: %s: final segment is missing", ErrCorrupted, blobID)
+	}
+	if store.DetectCompression {
+		if _, err := current.LookupErr("codec"); err != nil && (bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)) {
+			return nil, false, nil
+		}
+	}
+	if store.VerifyOnRead {
+		if err := checkSegmentHash(blobID, current, data); err != nil {
+			return nil, false, err
+		}
+		hdr, err := store.getHeader(ctx, blobID)
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr != nil && hdr.SHA256 != "" {
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) != hdr.SHA256 {
+				return nil, false, fmt.Errorf("%w: %s: content hash mismatch", ErrCorrupted, blobID)
+			}
+		}
+	}
+	return data, true, nil
+}
+
+// ReadConcat returns a reader for the concatenation of the given
+// blobs, in order. Each blob is opened when the reader reaches it, so
+// only one blob is read at a time. If a blob does not exist, the reader
+// returns an error wrapping ErrNotFound after the data of the blobs
+// before it.
+func (store *Store) ReadConcat(ctx context.Context, blobIDs []string) (io.ReadCloser, error) {
+	return &concatReader{ctx: ctx, store: store, blobIDs: blobIDs}, nil
+}
+
+// concatReader reads a sequence of blobs
+type concatReader struct {
+	ctx     context.Context
+	store   *Store
+	blobIDs []string
+	rd      *Reader
+	err     error
+}
+
+func (c *concatReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		if c.rd == nil {
+			if len(c.blobIDs) == 0 {
+				c.err = io.EOF
+				break
+			}
+			rd, err := c.store.Read(c.ctx, c.blobIDs[0])
+			if err != nil {
+				c.err = fmt.Errorf("%s: %w", c.blobIDs[0], err)
+				break
+			}
+			c.rd = rd
+			c.blobIDs = c.blobIDs[1:]
+		}
+		n, err := c.rd.Read(p)
+		if err == io.EOF {
+			c.rd.Close()
+			c.rd = nil
+			err = nil
+		}
+		if err != nil {
+			c.err = err
+		}
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		}
+	}
+	return 0, c.err
+}
+
+// Close closes the current blob reader
+func (c *concatReader) Close() error {
+	c.err = io.ErrClosedPipe
+	if c.rd == nil {
+		return nil
+	}
+	err := c.rd.Close()
+	c.rd = nil
+	return err
+}
+
+// ReadFromOffset returns a reader for the data of the blob starting at
+// offset. Returns ErrInvalidRange if offset is negative or beyond the
+// end of the blob. If offset is the size of the blob, the returned
+// reader is empty.
+func (store *Store) ReadFromOffset(ctx context.Context, blobID string, offset int64) (*Reader, error) {
+	if offset < 0 {
+		return nil, ErrInvalidRange
+	}
+	return store.limitRead(ctx, func() (*Reader, error) {
+		size, err := store.blobEnd(ctx, blobID)
+		if err != nil {
+			return nil, err
+		}
+		return store.openOffset(ctx, blobID, offset, size)
+	})
+}
+
+// ReadRange returns a reader for length bytes of the blob starting at
+// offset. If length is zero or negative, or the range extends beyond
+// the end of the blob, the reader returns the data up to the end. If
+// offset is at or beyond the end of the blob, the reader is empty.
+// Returns ErrInvalidRange if offset is negative.
+//
+// Only the segments overlapping the range are fetched. The segments at
+// the boundaries of the range are fetched whole and sliced by the
+// client: the server cannot return part of the binary data of a
+// segment, since $substrBytes and $slice operate on strings and
+// arrays, and segments may be compressed or encrypted anyway. Use a
+// smaller chunk size to reduce the overhead of small ranges.
+func (store *Store) ReadRange(ctx context.Context, blobID string, offset, length int64) (*Reader, error) {
+	if offset < 0 {
+		return nil, ErrInvalidRange
+	}
+	return store.limitRead(ctx, func() (*Reader, error) {
+		size, err := store.blobEnd(ctx, blobID)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= size {
+			return &Reader{ctx: ctx, store: store, blobID: blobID, err: io.EOF}, nil
+		}
+		end := size
+		if length > 0 && length < size-offset {
+			end = offset + length
+		}
+		return store.openRange(ctx, blobID, offset, end, size)
+	})
+}
+
+// ReadPlan returns the number of segments ReadRange would fetch for
+// the range, and the number of stored bytes of those segments, without
+// reading any data. The bytes include the parts of the boundary
+// segments outside the range. For segments stored in the chunk
+// collection, the uncompressed size is counted. Returns the same
+// errors as ReadRange.
+func (store *Store) ReadPlan(ctx context.Context, blobID string, offset, length int64) (segments int, bytes int64, err error) {
+	if offset < 0 {
+		return 0, 0, ErrInvalidRange
+	}
+	end := int64(math.MaxInt64)
+	if length > 0 && length < end-offset {
+		end = offset + length
+	}
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"blobId": blobID,
+			"seq":    bson.M{"$gte": 0},
+			"s":      bson.M{"$lt": end},
+			"$expr":  bson.M{"$gt": bson.A{bson.M{"$add": bson.A{"$s", "$n"}}, offset}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      nil,
+			"segments": bson.M{"$sum": 1},
+			"bytes":    bson.M{"$sum": bson.M{"$ifNull": bson.A{bson.M{"$binarySize": "$data"}, "$n"}}},
+		}}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+	if cursor.Next(ctx) {
+		var result struct {
+			Segments int   `bson:"segments"`
+			Bytes    int64 `bson:"bytes"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return 0, 0, err
+		}
+		return result.Segments, result.Bytes, nil
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, 0, err
+	}
+	// No segments overlap the range, check that the blob exists
+	if _, err := store.blobEnd(ctx, blobID); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, nil
+}
+
+// Tail returns a reader for the last n bytes of the blob. If the blob
+// is shorter than n, the reader returns the whole blob.
+func (store *Store) Tail(ctx context.Context, blobID string, n int64) (io.ReadCloser, error) {
+	if n < 0 {
+		return nil, ErrInvalidRange
+	}
+	rd, err := store.limitRead(ctx, func() (*Reader, error) {
+		size, err := store.blobEnd(ctx, blobID)
+		if err != nil {
+			return nil, err
+		}
+		offset := size - n
+		if offset < 0 {
+			offset = 0
+		}
+		return store.openOffset(ctx, blobID, offset, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// openOffset returns a reader for the data of a blob of the given size
+// starting at offset
+func (store *Store) openOffset(ctx context.Context, blobID string, offset, size int64) (*Reader, error) {
+	return store.openRange(ctx, blobID, offset, size, size)
+}
+
+// openRange returns a reader for the data of a blob of the given size
+// from offset to end. Only the segments before end are fetched.
+func (store *Store) openRange(ctx context.Context, blobID string, offset, end, size int64) (*Reader, error) {
+	if offset > size {
+		return nil, ErrInvalidRange
+	}
+	if offset == end {
+		return &Reader{ctx: ctx, store: store, blobID: blobID, err: io.EOF}, nil
+	}
+	// Find the segment containing offset
+	var first segmentPos
+	err := store.Collection.FindOne(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": 0}, "s": bson.M{"$lte": offset}}, options.FindOne().
+		SetSort(bson.M{"seq": -1}).
+		SetProjection(bson.M{"seq": 1, "s": 1, "n": 1})).Decode(&first)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, notFound(blobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"blobId": blobID, "seq": bson.M{"$gte": first.Seq}}
+	if end < size {
+		filter["s"] = bson.M{"$lt": end}
+	}
+	cursor, err := store.openSegments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := store.newReader(ctx, blobID, cursor, end-offset, false)
+	if err != nil {
+		return nil, err
+	}
+	rd.filter = filter
+	rd.skip(offset - int64(first.Start))
+	if end < size {
+		rd.limit(end - offset)
+	} else {
+		rd.checkFinal = true
+	}
+	return rd, nil
+}
+
+// skip discards the first n bytes of the current segment
+func (rd *Reader) skip(n int64) {
+	if rd.err != nil {
+		return
+	}
+	if n > int64(len(rd.buf)) {
+		rd.fail(ErrInvalidRange)
+		return
+	}
+	rd.buf = rd.buf[n:]
+}
+
+// limit makes the reader return at most n more bytes
+func (rd *Reader) limit(n int64) {
+	rd.limited = true
+	rd.left = n
+	rd.trim()
+}
+
+// trim cuts the current segment data to the limit of the reader
+func (rd *Reader) trim() {
+	if !rd.limited {
+		return
+	}
+	if int64(len(rd.buf)) > rd.left {
+		rd.buf = rd.buf[:rd.left]
+	}
+	rd.left -= int64(len(rd.buf))
+}
+
+// Progress returns the number of bytes read so far, and the total
+// number of bytes the reader returns, which is -1 if not known. It is
+// safe to call Progress while another goroutine reads.
+func (rd *Reader) Progress() (read, total int64) {
+	return atomic.LoadInt64(&rd.read), rd.size
+}
+
+// Read reads the next len(p) bytes of the blob. At the end of the
+// blob, Read returns 0, io.EOF. A reader of an empty blob is at the end
+// from the start. A read with an empty p returns 0, nil unless the
+// reader is at the end or failed.
+func (rd *Reader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if rd.stream != nil {
+		n, err = rd.stream.Read(p)
+	} else {
+		n, err = rd.readSegments(p)
+	}
+	atomic.AddInt64(&rd.read, int64(n))
+	return n, err
+}
+
+// segmentSource reads the segment data of a reader
+type segmentSource struct {
+	rd *Reader
+}
+
+func (s segmentSource) Read(p []byte) (int, error) {
+	return s.rd.readSegments(p)
+}
+
+// readSegments reads segment data
+func (rd *Reader) readSegments(p []byte) (int, error) {
+	for len(rd.buf) == 0 {
+		if rd.err != nil {
+			return 0, rd.err
+		}
+		rd.next()
+	}
+	n := copy(p, rd.buf)
+	rd.buf = rd.buf[n:]
+	return n, nil
+}
+
+// WriteTo writes the remaining data of the blob to w. Segments are
+// written directly to w, without an intermediate copy.
+func (rd *Reader) WriteTo(w io.Writer) (int64, error) {
+	if rd.stream != nil {
+		return io.Copy(w, struct{ io.Reader }{rd})
+	}
+	var total int64
+	for {
+		if len(rd.buf) > 0 {
+			n, err := w.Write(rd.buf)
+			total += int64(n)
+			atomic.AddInt64(&rd.read, int64(n))
+			rd.buf = rd.buf[n:]
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+		if rd.err == io.EOF {
+			return total, nil
+		}
+		if rd.err != nil {
+			return total, rd.err
+		}
+		rd.next()
+	}
+}
+
+// next moves the cursor to the next segment
+func (rd *Reader) next() {
+	if rd.lazy {
+		rd.open()
+		return
+	}
+	if rd.prefetch != nil {
+		raw, ok := <-rd.prefetch
+		if !ok {
+			err := rd.prefetchErr
+			if err == nil {
+				err = io.EOF
+			}
+			rd.fail(err)
+			return
+		}
+		rd.current = raw
+		rd.decode()
+		return
+	}
+	for !rd.cursor.Next(rd.ctx) {
+		err := rd.cursor.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		if err != io.EOF && rd.reopen(err) {
+			continue
+		}
+		rd.fail(err)
+		return
+	}
+	rd.current = rd.cursor.Current
+	rd.decode()
+}
+
+// decode loads the current segment. Unless the segment is encrypted or
+// compressed, the data is not copied out of the cursor's batch buffer,
+// so it is only valid until the cursor is advanced.
+func (rd *Reader) decode() {
+	if err := rd.checkOrder(); err != nil {
+		rd.fail(err)
+		return
+	}
+	segment, err := rd.store.resolveSegment(rd.ctx, rd.current)
+	if err != nil {
+		rd.fail(err)
+		return
+	}
+	rd.store.countSegment(segment)
+	var data []byte
+	if rd.raw {
+		data, err = segmentData(rd.ctx, rd.enc, rd.blobID, segment)
+	} else {
+		data, err = rd.store.decodeSegment(rd.ctx, rd.enc, rd.blobID, segment)
+	}
+	if err != nil {
+		rd.fail(err)
+		return
+	}
+	if final, ok := rd.current.Lookup("final").BooleanOK(); ok {
+		// The marker is authenticated by decrypting the segment
+		rd.unfinished = !final
+	}
+	if rd.store.VerifyOnRead && !rd.raw {
+		if err := checkSegmentHash(rd.blobID, rd.current, data); err != nil {
+			rd.fail(err)
+			return
+		}
+	}
+	if rd.verify != nil {
+		rd.verify.Write(data)
+	}
+	rd.buf = data
+	rd.trim()
+}
+
+// startVerify makes the reader verify the content hash of the blob,
+// if the hash is known. The reader must be positioned on the first
+// segment, or not opened yet.
+func (rd *Reader) startVerify() error {
+	hdr, err := rd.store.getHeader(rd.ctx, rd.blobID)
+	if err != nil || hdr == nil || hdr.SHA256 == "" {
+		return err
+	}
+	rd.sum = hdr.SHA256
+	if rd.err != nil {
+		return nil
+	}
+	rd.verify = sha256.New()
+	rd.verify.Write(rd.buf)
+	return nil
+}
+
+// Sum returns the SHA-256 hash of the blob contents recorded when the
+// blob was written, so the blob can be checked against an expected
+// digest before it is read. The hash is loaded from the header when
+// the blob is opened, so it is only available for readers returned by
+// Read of a store with VerifyOnRead set. Sum returns nil if the hash is
+// not available, or not known for the blob.
+func (rd *Reader) Sum() []byte {
+	if rd.sum == "" {
+		return nil
+	}
+	sum, err := hex.DecodeString(rd.sum)
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+// checkOrder checks that the current segment starts where the
+// previous one ended. Segments are sorted by seq, which is unique for
+// a blob if the (blobId, seq) index exists. This detects segments
+// returned out of order, or duplicate segments if the index is
+// missing.
+func (rd *Reader) checkOrder() error {
+	var pos segmentPos
+	if err := bson.Unmarshal(rd.current, &pos); err != nil {
+		return err
+	}
+	if rd.started && pos.Start != rd.nextStart {
+		return fmt.Errorf("%w: segment %d of %s starts at %d, expected %d", ErrCorrupted, pos.Seq, rd.blobID, pos.Start, rd.nextStart)
+	}
+	rd.started = true
+	rd.nextStart = pos.Start + pos.N
+	rd.lastSeq = int64(pos.Seq)
+	return nil
+}
+
+// fail stops the reader with err
+func (rd *Reader) fail(err error) {
+	if err == io.EOF && rd.checkFinal && rd.unfinished {
+		err = fmt.Errorf("%w: %s: final segment is missing", ErrCorrupted, rd.blobID)
+	}
+	if err == io.EOF && rd.verify != nil {
+		if hex.EncodeToString(rd.verify.Sum(nil)) != rd.sum {
+			err = fmt.Errorf("%w: %s: content hash mismatch", ErrCorrupted, rd.blobID)
+		}
+		rd.verify = nil
+	}
+	rd.err = err
+	if rd.release != nil {
+		rd.release()
+	}
+}
+
+// detectCompression checks if the blob is a gzip or zstd stream
+// stored without a codec, and if so, sets up the reader to
+// decompress it
+func (rd *Reader) detectCompression() error {
+	if rd.lazy {
+		rd.open()
+	}
+	if _, err := rd.current.LookupErr("codec"); err == nil || rd.err != nil {
+		return nil
+	}
+	switch {
+	case bytes.HasPrefix(rd.buf, gzipMagic):
+		gz, err := gzip.NewReader(segmentSource{rd})
+		if err != nil {
+			return err
+		}
+		rd.stream = gz
+		rd.closeStream = func() { gz.Close() }
+	case bytes.HasPrefix(rd.buf, zstdMagic):
+		dec, err := zstd.NewReader(segmentSource{rd})
+		if err != nil {
+			return err
+		}
+		rd.stream = dec
+		rd.closeStream = dec.Close
+	default:
+		return nil
+	}
+	rd.size = -1
+	return nil
+}
+
+// Close stops reading and closes the underlying cursor. Close can be
+// called more than once, also concurrently, and before reading. Calls
+// after the first return the result of the first.
+func (rd *Reader) Close() error {
+	rd.closeOnce.Do(func() {
+		rd.closeErr = rd.close()
+	})
+	return rd.closeErr
+}
+
+func (rd *Reader) close() error {
+	rd.buf = nil
+	rd.fail(io.ErrClosedPipe)
+	if rd.closeStream != nil {
+		rd.closeStream()
+	}
+	if rd.cursor == nil {
+		return nil
+	}
+	if rd.stopPrefetch != nil {
+		close(rd.stopPrefetch)
+		<-rd.prefetchDone
+	}
+	return rd.cursor.Close(context.Background())
+}
@@ -0,0 +1,63 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrAlreadyExists is returned by Reserve if the blob ID is taken
+var ErrAlreadyExists = errors.New("Already exists")
+
+// DefaultReserveTTL is the default time a reservation is kept until
+// the blob is written
+var DefaultReserveTTL = 24 * time.Hour
+
+// Reserve claims a blob ID by writing a pending header for it, so a
+// generated ID cannot be picked by two uploaders. Returns
+// ErrAlreadyExists if the blob or a reservation for it exists. A
+// reserved blob is not readable; reading or sizing it returns
+// ErrNotFound until it is written. Writing the blob completes the
+// reservation. Reservations not written within ReserveTTL are removed
+// by the TTL index created by EnsureIndex.
+func (store *Store) Reserve(ctx context.Context, blobID string) error {
+	exists, err := store.exists(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrAlreadyExists
+	}
+	ttl := store.ReserveTTL
+	if ttl <= 0 {
+		ttl = DefaultReserveTTL
+	}
+	now := store.now()
+	// Inserting a second header fails on the unique index
+	_, err = store.Collection.InsertOne(ctx, bson.M{
+		"blobId":     blobID,
+		"seq":        headerSeq,
+		"size":       int64(0),
+		"storedSize": int64(0),
+		"pending":    true,
+		"expireAt":   now.Add(ttl),
+		"updatedAt":  now,
+		"createdAt":  now,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// Reserved returns if the blob is reserved and not yet written
+func (store *Store) Reserved(ctx context.Context, blobID string) (bool, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return false, err
+	}
+	return hdr != nil && hdr.Pending, nil
+}
@@ -0,0 +1,47 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReserve(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	if err := store.Reserve(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reserve(ctx, "1"); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Expected ErrAlreadyExists, got %v", err)
+	}
+	if reserved, err := store.Reserved(ctx, "1"); err != nil || !reserved {
+		t.Errorf("Not reserved: %v %v", reserved, err)
+	}
+	if _, err := store.Size(ctx, "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	data := randomData(3000)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if reserved, err := store.Reserved(ctx, "1"); err != nil || reserved {
+		t.Errorf("Still reserved: %v %v", reserved, err)
+	}
+	hdr, err := store.getHeader(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.ExpireAt.IsZero() {
+		t.Errorf("Written blob expires at %v", hdr.ExpireAt)
+	}
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	if err := store.Reserve(ctx, "1"); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Expected ErrAlreadyExists, got %v", err)
+	}
+}
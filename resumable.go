@@ -0,0 +1,97 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidToken is returned by ReadResumable if the token is malformed
+var ErrInvalidToken = errors.New("Invalid token")
+
+// ErrChanged is returned by ReadResumable if the blob was written after
+// the token was issued
+var ErrChanged = errors.New("Blob changed")
+
+// ResumableReader reads a blob, keeping track of the position so the
+// read can be resumed later using Token
+type ResumableReader struct {
+	*Reader
+	offset  int64
+	size    int64
+	version string
+}
+
+// ReadResumable reads the blob starting at the position encoded in
+// token. An empty token starts at the beginning of the blob. The
+// returned token is the token of the starting position, and Token of
+// the returned reader gives the token of the position reached, so a
+// client can resume after a dropped connection. The token identifies
+// the version of the blob; if the blob was written since the token was
+// issued, ErrChanged is returned. Blobs without a version, written by
+// older versions of this package, are only checked for their size.
+func (store *Store) ReadResumable(ctx context.Context, blobID string, token string) (*ResumableReader, string, error) {
+	offset := int64(0)
+	size := int64(-1)
+	version := ""
+	if token != "" {
+		var err error
+		if offset, size, version, err = parseReadToken(token); err != nil {
+			return nil, "", err
+		}
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, "", err
+	}
+	current := ""
+	if hdr != nil {
+		current = hdr.Version
+	}
+	if token != "" && current != version {
+		return nil, "", fmt.Errorf("%w: %s", ErrChanged, blobID)
+	}
+	rd, err := store.ReadRange(ctx, blobID, offset, math.MaxInt64)
+	if err != nil {
+		return nil, "", err
+	}
+	// The reader returns the rest of the blob
+	end := offset + rd.Size()
+	if size >= 0 && end != size {
+		rd.Close()
+		return nil, "", fmt.Errorf("%w: %s", ErrChanged, blobID)
+	}
+	rr := &ResumableReader{Reader: rd, offset: offset, size: end, version: current}
+	return rr, rr.Token(), nil
+}
+
+// Token returns the token of the current position of the reader
+func (rr *ResumableReader) Token() string {
+	read, _ := rr.Progress()
+	s := fmt.Sprintf("%d:%d:%s", rr.offset+read, rr.size, rr.version)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// parseReadToken returns the offset, blob size and blob version
+// encoded in a token
+func parseReadToken(token string) (offset, size int64, version string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, 0, "", ErrInvalidToken
+	}
+	parts := strings.SplitN(string(b), ":", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", ErrInvalidToken
+	}
+	if offset, err = strconv.ParseInt(parts[0], 10, 64); err != nil || offset < 0 {
+		return 0, 0, "", ErrInvalidToken
+	}
+	if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil || size < offset {
+		return 0, 0, "", ErrInvalidToken
+	}
+	return offset, size, parts[2], nil
+}
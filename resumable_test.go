@@ -0,0 +1,69 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadResumable(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	ctx := context.Background()
+	data := randomData(5005)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	rd, _, err := store.ReadResumable(ctx, "1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, 1500)
+	if _, err := io.ReadFull(rd, first); err != nil {
+		t.Fatal(err)
+	}
+	token := rd.Token()
+	rd.Close()
+
+	rd, _, err = store.ReadResumable(ctx, "1", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(first, rest...), data) {
+		t.Errorf("Wrong data")
+	}
+
+	if err := store.Write(ctx, "1", bytes.NewReader(randomData(5005))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.ReadResumable(ctx, "1", token); !errors.Is(err, ErrChanged) {
+		t.Errorf("Expected ErrChanged, got %v", err)
+	}
+	if _, _, err := store.ReadResumable(ctx, "1", "!"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestParseReadToken(t *testing.T) {
+	rr := &ResumableReader{Reader: &Reader{}, offset: 10, size: 100, version: "abc"}
+	offset, size, version, err := parseReadToken(rr.Token())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10 || size != 100 || version != "abc" {
+		t.Errorf("Wrong token: %d %d %s", offset, size, version)
+	}
+	for _, token := range []string{"x", "MTA6NQ", "MTA6NTo"} {
+		if _, _, _, err := parseReadToken(token); err != ErrInvalidToken {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDefaultReadBackoff(t *testing.T) {
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: 5 * time.Second} {
+		if d := DefaultReadBackoff(attempt); d != expected {
+			t.Errorf("Attempt %d: expected %v, got %v", attempt, expected, d)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{mongo.CommandError{Code: 91}, true},
+		{mongo.CommandError{Code: 43}, true},
+		{mongo.CommandError{Code: 2, Labels: []string{"RetryableReadError"}}, true},
+		{mongo.CommandError{Code: 2}, false},
+		{errors.New("Other"), false},
+		{context.Canceled, false},
+	} {
+		if isTransient(tc.err) != tc.transient {
+			t.Errorf("%v: expected transient %v", tc.err, tc.transient)
+		}
+	}
+}
+
+func TestReadRetry(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+	store.ReadRetries = 2
+	store.ReadBackoff = func(int) time.Duration { return time.Millisecond }
+
+	// More segments than the first batch, so the read needs a getMore
+	data := randomData(300 * 1024)
+	if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	admin := store.Collection.Database().Client().Database("admin")
+	failGetMore := func(times int) {
+		err := admin.RunCommand(context.Background(), bson.D{
+			{Key: "configureFailPoint", Value: "failCommand"},
+			{Key: "mode", Value: bson.M{"times": times}},
+			{Key: "data", Value: bson.M{"failCommands": bson.A{"getMore"}, "errorCode": 91}},
+		}).Err()
+		if err != nil {
+			t.Skipf("Fail points are not enabled: %v", err)
+		}
+	}
+	defer admin.RunCommand(context.Background(), bson.D{
+		{Key: "configureFailPoint", Value: "failCommand"},
+		{Key: "mode", Value: "off"},
+	})
+
+	failGetMore(1)
+	if !bytes.Equal(readBlob(t, store, "1"), data) {
+		t.Errorf("Wrong data after retry")
+	}
+
+	// A persistent failure is returned
+	store.ReadRetries = 0
+	failGetMore(1)
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	buf := new(bytes.Buffer)
+	if _, err := rd.WriteTo(buf); !isTransient(err) {
+		t.Errorf("Expected transient error, got %v", err)
+	}
+}
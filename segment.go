@@ -0,0 +1,67 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PutSegment stores data as segment seq of a blob, starting at offset
+// start of the blob, replacing any existing segment with that seq. The
+// data is stored as is, without compression or encryption, and the
+// blob header is not updated. This is for callers that do their own
+// chunking or encoding. Keeping the segments contiguous is the
+// responsibility of the caller: segment seq must start where segment
+// seq-1 ends, and seq must start from 0, otherwise reading the blob
+// fails with ErrCorrupted.
+func (store *Store) PutSegment(ctx context.Context, blobID string, seq, start uint64, data []byte) error {
+	sum := sha256.Sum256(data)
+	segment := blobSegment{
+		ID:    blobID,
+		Seq:   seq,
+		Data:  data,
+		Start: start,
+		N:     uint64(len(data)),
+		Hash:  sum[:],
+	}
+	_, err := store.Collection.ReplaceOne(ctx, bson.M{"blobId": blobID, "seq": seq}, segment, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	store.countBytes("write", len(data))
+	return nil
+}
+
+// GetSegment returns the start offset and the data of segment seq of
+// a blob. The data is decompressed and decrypted as necessary. Returns
+// ErrNotFound if the segment does not exist.
+func (store *Store) GetSegment(ctx context.Context, blobID string, seq uint64) (start uint64, data []byte, err error) {
+	raw, err := store.Collection.FindOne(ctx, bson.M{"blobId": blobID, "seq": seq}).DecodeBytes()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil, notFound(blobID)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	var pos segmentPos
+	if err := bson.Unmarshal(raw, &pos); err != nil {
+		return 0, nil, err
+	}
+	enc, err := store.blobEncrypter(ctx, blobID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if raw, err = store.resolveSegment(ctx, raw); err != nil {
+		return 0, nil, err
+	}
+	store.countSegment(raw)
+	data, err = store.decodeSegment(ctx, enc, blobID, raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	return pos.Start, data, nil
+}
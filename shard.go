@@ -0,0 +1,43 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ShardKey selects how the blob collection is sharded
+type ShardKey int
+
+const (
+	// ShardByBlob shards by the hash of the blob ID. All segments of
+	// a blob are on the same shard, and blobs are spread evenly, but a
+	// very large blob can create a jumbo chunk.
+	ShardByBlob ShardKey = iota
+	// ShardBySegment shards by the (blobId, seq) range, so the
+	// segments of a very large blob can be split across shards. Reads
+	// of such a blob may go to multiple shards.
+	ShardBySegment
+)
+
+// shardKeyDoc returns the shard key document
+func (key ShardKey) shardKeyDoc() bson.D {
+	if key == ShardBySegment {
+		return segmentIndexKeys
+	}
+	return bson.D{{Key: "blobId", Value: "hashed"}}
+}
+
+// EnsureShardKey shards the blob collection on a sharded cluster
+// using the given shard key. The database must have sharding enabled
+// on servers before MongoDB 6.0. Call EnsureIndex before sharding a
+// collection with ShardBySegment, so the shard key is backed by the
+// (blobId, seq) index.
+func (store *Store) EnsureShardKey(ctx context.Context, key ShardKey) error {
+	ns := store.Collection.Database().Name() + "." + store.Collection.Name()
+	admin := store.Collection.Database().Client().Database("admin")
+	return admin.RunCommand(ctx, bson.D{
+		{Key: "shardCollection", Value: ns},
+		{Key: "key", Value: key.shardKeyDoc()},
+	}).Err()
+}
@@ -0,0 +1,65 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CollectionStats are the storage statistics of the blob collection
+type CollectionStats struct {
+	// Number of documents, including segments, headers and locks
+	Count int64 `bson:"count"`
+	// Uncompressed size of the documents in bytes
+	Size int64 `bson:"size,truncate"`
+	// Storage allocated for the documents in bytes
+	StorageSize int64 `bson:"storageSize,truncate"`
+	// Total size of the indexes in bytes
+	IndexSize int64 `bson:"totalIndexSize,truncate"`
+	// Number of indexes
+	Indexes int `bson:"nindexes"`
+}
+
+// Stats returns the storage statistics of the blob collection using
+// the collStats command
+func (store *Store) Stats(ctx context.Context) (CollectionStats, error) {
+	var stats CollectionStats
+	err := store.Collection.Database().RunCommand(ctx, bson.D{{Key: "collStats", Value: store.Collection.Name()}}).Decode(&stats)
+	return stats, err
+}
+
+// Overhead returns the logical size of the blob, and the total BSON
+// size of its documents, including the header and the fields of every
+// segment. The difference is the per-document overhead, which
+// dominates with small chunk sizes. Chunks shared through the chunk
+// collection are not counted. Requires MongoDB 4.4 or later. Returns
+// ErrNotFound if the blob does not exist.
+func (store *Store) Overhead(ctx context.Context, blobID string) (dataBytes, storedBytes int64, err error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"blobId": blobID, "seq": bson.M{"$gte": headerSeq}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    nil,
+			"data":   bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$seq", 0}}, "$n", 0}}},
+			"stored": bson.M{"$sum": bson.M{"$bsonSize": "$$ROOT"}},
+		}}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, notFound(blobID)
+	}
+	var result struct {
+		Data   int64 `bson:"data"`
+		Stored int64 `bson:"stored"`
+	}
+	if err := cursor.Decode(&result); err != nil {
+		return 0, 0, err
+	}
+	return result.Data, result.Stored, nil
+}
@@ -0,0 +1,35 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// BenchmarkIndexSize reports the index and document overhead per
+// segment of the current layout, which repeats blobId on every
+// segment
+func BenchmarkIndexSize(b *testing.B) {
+	cli := setupTestConnection()
+	store := &Store{
+		Collection: cli.Database("test").Collection("blob"),
+		ChunkSize:  1024,
+	}
+	defer cleanupBlobs(store)
+	if err := store.EnsureIndex(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	const segments = 10000
+	blobID := "a-long-blob-id-like-a-uuid-0123456789abcdef"
+	if err := store.Write(context.Background(), blobID, bytes.NewReader(randomData(segments*1024))); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		stats, err := store.Stats(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(stats.IndexSize)/segments, "index-bytes/segment")
+		b.ReportMetric(float64(stats.Size-segments*1024)/segments, "overhead-bytes/segment")
+	}
+}
@@ -0,0 +1,86 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ModTime returns the time the blob was last written. Returns the zero
+// time if the blob was written by an older version of this package.
+func (store *Store) ModTime(ctx context.Context, blobID string) (time.Time, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if hdr == nil {
+		if exists, err := store.exists(ctx, blobID); err != nil || !exists {
+			if err == nil {
+				err = notFound(blobID)
+			}
+			return time.Time{}, err
+		}
+		return time.Time{}, nil
+	}
+	return hdr.UpdatedAt, nil
+}
+
+// DeleteOlderThan removes the blobs last written more than age ago,
+// and returns the number of blobs removed. This is an explicit
+// alternative to expiring blobs with a TTL. Blobs are removed one by
+// one, and a blob written again after it is selected is kept. Blobs
+// without a modification time, written by older versions of this
+// package, are not removed. If the store is in DryRun mode, the blobs
+// are counted, but not removed. DeleteOlderThan requires the indexes
+// created by EnsureIndex.
+func (store *Store) DeleteOlderThan(ctx context.Context, age time.Duration) (int64, error) {
+	if store.WriteOnce {
+		return 0, ErrImmutable
+	}
+	cutoff := store.now().Add(-age)
+	filter := bson.M{
+		"seq":       headerSeq,
+		"updatedAt": bson.M{"$lt": cutoff},
+		"blobId":    notInternal(),
+	}
+	opts := options.Find().SetProjection(bson.M{"blobId": 1})
+	if store.Scan.BatchSize > 0 {
+		opts.SetBatchSize(store.Scan.BatchSize)
+	}
+	cursor, err := store.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var removed int64
+	for cursor.Next(ctx) {
+		var hdr blobHeader
+		if err := cursor.Decode(&hdr); err != nil {
+			return removed, err
+		}
+		if store.DryRun {
+			removed++
+			continue
+		}
+		deleted := false
+		err := store.inTransaction(ctx, func(ctx context.Context) error {
+			// Check that the blob was not written since it was selected
+			n, err := store.Collection.CountDocuments(ctx, bson.M{"blobId": hdr.ID, "seq": headerSeq, "updatedAt": bson.M{"$lt": cutoff}})
+			if err != nil || n == 0 {
+				deleted = false
+				return err
+			}
+			deleted = true
+			return store.remove(ctx, hdr.ID)
+		})
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+	return removed, cursor.Err()
+}
@@ -0,0 +1,33 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// syncSeq is the seq value used by Sync. No document has this seq, so
+// the Sync write does not change anything.
+const syncSeq = -3
+
+// Sync waits until the writes acknowledged so far by the primary are
+// durable. It issues a write that does not change any document, using
+// the majority write concern with journaling. The server waits for a
+// no-op write to replicate its latest operation, so when Sync returns
+// nil, all writes the primary applied before Sync are journaled on a
+// majority of the replica set members, and they survive a failover or
+// a restart. Writes that were in progress concurrently with Sync may
+// not be covered. On a standalone server, Sync waits for the writes to
+// be journaled. On a sharded cluster, only the shards the Sync write
+// is routed to are synced.
+func (store *Store) Sync(ctx context.Context) error {
+	coll, err := store.Collection.Clone(options.Collection().
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))))
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"blobId": "", "seq": syncSeq}, bson.M{"$unset": bson.M{"sync": ""}})
+	return err
+}
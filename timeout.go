@@ -0,0 +1,84 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// TimeoutStore is a store that applies a default timeout to the
+// operations it wraps. If the context passed to an operation has no
+// deadline, the operation runs with a context that times out after
+// Timeout. A deadline set by the caller is not changed. Methods of
+// Store that are not wrapped run without a default timeout.
+type TimeoutStore struct {
+	*Store
+	Timeout time.Duration
+}
+
+// WithTimeout returns a context for an operation. If ctx has no
+// deadline and Timeout is positive, the returned context times out
+// after Timeout.
+func (store TimeoutStore) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || store.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, store.Timeout)
+}
+
+// Write writes the blob with the default timeout
+func (store TimeoutStore) Write(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	ctx, cancel := store.WithTimeout(ctx)
+	defer cancel()
+	return store.Store.Write(ctx, blobID, data, opts...)
+}
+
+// Append appends to the blob with the default timeout
+func (store TimeoutStore) Append(ctx context.Context, blobID string, data io.Reader, opts ...WriteOption) error {
+	ctx, cancel := store.WithTimeout(ctx)
+	defer cancel()
+	return store.Store.Append(ctx, blobID, data, opts...)
+}
+
+// Read opens the blob with the default timeout. The timeout covers
+// reading the whole blob, not only opening it.
+func (store TimeoutStore) Read(ctx context.Context, blobID string) (*Reader, error) {
+	ctx, cancel := store.WithTimeout(ctx)
+	rd, err := store.Store.Read(ctx, blobID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	release := rd.release
+	rd.release = func() {
+		if release != nil {
+			release()
+		}
+		cancel()
+	}
+	if rd.err != nil {
+		cancel()
+	}
+	return rd, nil
+}
+
+// Size returns the size of the blob with the default timeout
+func (store TimeoutStore) Size(ctx context.Context, blobID string) (int64, error) {
+	ctx, cancel := store.WithTimeout(ctx)
+	defer cancel()
+	return store.Store.Size(ctx, blobID)
+}
+
+// Remove removes the blobs with the default timeout
+func (store TimeoutStore) Remove(ctx context.Context, blobIDs ...string) error {
+	ctx, cancel := store.WithTimeout(ctx)
+	defer cancel()
+	return store.Store.Remove(ctx, blobIDs...)
+}
+
+// RemoveStrict removes the blob with the default timeout
+func (store TimeoutStore) RemoveStrict(ctx context.Context, blobID string) error {
+	ctx, cancel := store.WithTimeout(ctx)
+	defer cancel()
+	return store.Store.RemoveStrict(ctx, blobID)
+}
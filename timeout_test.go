@@ -0,0 +1,36 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeoutStore(t *testing.T) {
+	store := TimeoutStore{Store: setupTestStore(t), Timeout: time.Nanosecond}
+	defer cleanupBlobs(store.Store)
+
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(100))); err == nil {
+		t.Errorf("Expected timeout")
+	}
+	// The deadline of the caller is used
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	data := randomData(3000)
+	if err := store.Write(ctx, "1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	store.Timeout = time.Minute
+	if !bytes.Equal(readBlob(t, store.Store, "1"), data) {
+		t.Errorf("Wrong data")
+	}
+	rd, err := store.Read(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if rd.Size() != 3000 {
+		t.Errorf("Wrong size: %d", rd.Size())
+	}
+}
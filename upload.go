@@ -0,0 +1,222 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultUploadTTL is the default time an upload can stay uncommitted
+var DefaultUploadTTL = 24 * time.Hour
+
+// stagingPrefix is the prefix of the IDs under which uploads are staged
+const stagingPrefix = "__staging__/"
+
+// Upload is an upload session. Data written to an upload is staged
+// under a temporary ID, and becomes visible under the blob ID only
+// when the upload is committed. Uploads that are not committed or
+// aborted are removed by the TTL index after the UploadTTL of the
+// store elapses. An Upload must be used from a single goroutine.
+type Upload struct {
+	store     *Store
+	ctx       context.Context
+	blobID    string
+	stagingID string
+	w         *Writer
+	done      bool
+	// The expiration time of the committed blob, if set
+	expireAt time.Time
+	// If set, the blob is not checked for WriteOnce or AppendOnly on
+	// commit
+	rewrite bool
+}
+
+// BeginUpload starts an upload session for the blob
+func (store *Store) BeginUpload(ctx context.Context, blobID string, opts ...WriteOption) (*Upload, error) {
+	if err := store.checkWritable(ctx, blobID); err != nil {
+		return nil, err
+	}
+	return store.beginUpload(ctx, blobID, opts...)
+}
+
+func (store *Store) beginUpload(ctx context.Context, blobID string, opts ...WriteOption) (*Upload, error) {
+	var rnd [8]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	stagingID := stagingPrefix + blobID + "/" + hex.EncodeToString(rnd[:])
+	w, err := store.openWriter(ctx, stagingID, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ttl := store.UploadTTL
+	if ttl <= 0 {
+		ttl = DefaultUploadTTL
+	}
+	expireAt := w.expireAt
+	w.expireAt = store.now().Add(ttl)
+	return &Upload{
+		store:     store,
+		ctx:       ctx,
+		blobID:    blobID,
+		stagingID: stagingID,
+		w:         w,
+		expireAt:  expireAt,
+	}, nil
+}
+
+// Write writes data to the staged blob
+func (u *Upload) Write(p []byte) (int, error) {
+	return u.w.Write(p)
+}
+
+// Commit replaces the blob with the staged data. If the deployment
+// supports transactions, this is done atomically. Otherwise the old
+// blob is removed before the staged data is renamed, so readers may
+// briefly see the blob missing.
+func (u *Upload) Commit() error {
+	return u.commit(nil)
+}
+
+// commit commits the upload. If check is given, it is called in the
+// transaction before the blob is replaced, and the commit fails if it
+// returns an error.
+func (u *Upload) commit(check func(ctx context.Context) error) error {
+	if u.done {
+		return ErrWriterClosed
+	}
+	u.done = true
+	if err := u.w.Close(); err != nil {
+		return err
+	}
+	return u.store.inTransaction(u.ctx, func(ctx context.Context) error {
+		if !u.rewrite {
+			if err := u.store.checkWritable(ctx, u.blobID); err != nil {
+				return err
+			}
+		}
+		if check != nil {
+			if err := check(ctx); err != nil {
+				return err
+			}
+		}
+		if err := u.keepHeader(ctx); err != nil {
+			return err
+		}
+		if err := u.store.remove(ctx, u.blobID); err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"blobId": u.blobID}, "$unset": bson.M{"expireAt": ""}}
+		if !u.expireAt.IsZero() {
+			update = bson.M{"$set": bson.M{"blobId": u.blobID, "expireAt": u.expireAt}}
+		}
+		_, err := u.store.Collection.UpdateMany(ctx, bson.M{"blobId": u.stagingID}, update)
+		return err
+	})
+}
+
+// keepHeader copies the fields of the header of the blob that are kept
+// when the blob is written again to the staged header: the user
+// metadata unless the upload replaces it, the creation time, and the
+// content type unless the upload records one
+func (u *Upload) keepHeader(ctx context.Context) error {
+	hdr, err := u.store.getHeader(ctx, u.blobID)
+	if err != nil || hdr == nil {
+		return err
+	}
+	fields := bson.M{}
+	if hdr.Meta != nil && !u.w.setMeta {
+		fields[metaField] = hdr.Meta
+	}
+	if !hdr.CreatedAt.IsZero() {
+		fields["createdAt"] = hdr.CreatedAt
+	}
+	if hdr.ContentType != "" && u.w.contentType == "" {
+		fields["contentType"] = hdr.ContentType
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	_, err = u.store.Collection.UpdateOne(ctx, headerFilter(u.stagingID), bson.M{"$set": fields})
+	return err
+}
+
+// Abort discards the staged data. The blob is not changed.
+func (u *Upload) Abort() error {
+	if u.done {
+		return ErrWriterClosed
+	}
+	u.done = true
+	return u.w.Abort()
+}
+
+// sniffLen is the number of bytes used to detect the content type of
+// an upload
+const sniffLen = 512
+
+// Uploader writes a blob through an upload session, and records the
+// size, content hash, content type, and modification time of the blob
+// in its header when it is closed. The content type is detected from
+// the beginning of the data. The blob is replaced only when the
+// Uploader is closed, and Abort discards the data written. An
+// Uploader must be used from a single goroutine.
+type Uploader struct {
+	blobID string
+	u      *Upload
+	err    error
+	sniff  []byte
+	info   BlobInfo
+}
+
+// NewUploader returns an Uploader for the blob. An error starting the
+// upload is returned by Write and Close.
+func (store *Store) NewUploader(ctx context.Context, blobID string, opts ...WriteOption) *Uploader {
+	u, err := store.BeginUpload(ctx, blobID, opts...)
+	return &Uploader{blobID: blobID, u: u, err: err}
+}
+
+// Write writes data to the staged blob
+func (up *Uploader) Write(p []byte) (int, error) {
+	if up.err != nil {
+		return 0, up.err
+	}
+	if n := sniffLen - len(up.sniff); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		up.sniff = append(up.sniff, p[:n]...)
+	}
+	return up.u.Write(p)
+}
+
+// Close commits the upload, replacing the blob. If the upload could
+// not be started, the error is returned and nothing is written.
+func (up *Uploader) Close() error {
+	if up.err != nil {
+		return up.err
+	}
+	up.u.w.contentType = http.DetectContentType(up.sniff)
+	if err := up.u.Commit(); err != nil {
+		return err
+	}
+	up.info = up.u.w.info()
+	up.info.ID = up.blobID
+	return nil
+}
+
+// Info returns the information of the blob written by Close
+func (up *Uploader) Info() BlobInfo {
+	return up.info
+}
+
+// Abort discards the data written. The blob is not changed.
+func (up *Uploader) Abort() error {
+	if up.u == nil {
+		return nil
+	}
+	return up.u.Abort()
+}
@@ -0,0 +1,52 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidConfig is returned by Validate if the options of the store
+// are inconsistent
+var ErrInvalidConfig = errors.New("Invalid store configuration")
+
+// Validate checks the configuration of the store, so a misconfigured
+// store fails at startup instead of on the first write. A zero
+// ChunkSize is valid, DefaultChunkSize is used. Returns
+// ErrInvalidChunkSize or ErrChunkTooLarge for a bad chunk size,
+// ErrDedupEncrypted if a chunk collection is used with encryption, and
+// an error wrapping ErrInvalidConfig for other problems. The database
+// is not accessed.
+func (store *Store) Validate() error {
+	if store.Collection == nil {
+		return fmt.Errorf("%w: no collection", ErrInvalidConfig)
+	}
+	if store.ChunkSize < 0 {
+		return ErrInvalidChunkSize
+	}
+	if store.ChunkSize > MaxChunkSize {
+		return ErrChunkTooLarge
+	}
+	// The codec name is recorded in segments, and an empty name marks
+	// them as uncompressed, which is only right for NopCodec
+	if _, nop := store.Codec.(NopCodec); !nop && store.Codec != nil && store.Codec.Name() == "" {
+		return fmt.Errorf("%w: the codec has no name", ErrInvalidConfig)
+	}
+	if err := store.checkDedup(); err != nil {
+		return err
+	}
+	if store.ChunkCollection != nil &&
+		store.ChunkCollection.Name() == store.Collection.Name() &&
+		store.ChunkCollection.Database().Name() == store.Collection.Database().Name() {
+		return fmt.Errorf("%w: the chunk collection is the store collection", ErrInvalidConfig)
+	}
+	if store.WriteOnce && store.AppendOnly {
+		return fmt.Errorf("%w: WriteOnce and AppendOnly cannot be combined", ErrInvalidConfig)
+	}
+	if store.ConflictPolicy != ConflictFail && store.ConflictPolicy != ConflictRetry {
+		return fmt.Errorf("%w: unknown conflict policy %d", ErrInvalidConfig, store.ConflictPolicy)
+	}
+	if store.AckLevel < AckDefault || store.AckLevel > AckMajority {
+		return fmt.Errorf("%w: unknown ack level %d", ErrInvalidConfig, store.AckLevel)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package blobstore
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// namelessCodec is a codec without a name
+type namelessCodec struct{ NopCodec }
+
+func (namelessCodec) Name() string { return "" }
+
+func TestValidate(t *testing.T) {
+	cli, err := mongo.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := cli.Database("test").Collection("blob")
+	for _, tc := range []struct {
+		name  string
+		store *Store
+		err   error
+	}{
+		{"zero chunk size", &Store{Collection: coll}, nil},
+		{"no collection", &Store{}, ErrInvalidConfig},
+		{"negative chunk size", &Store{Collection: coll, ChunkSize: -1}, ErrInvalidChunkSize},
+		{"large chunk size", &Store{Collection: coll, ChunkSize: MaxChunkSize + 1}, ErrChunkTooLarge},
+		{"chunks encrypted", &Store{Collection: coll, ChunkCollection: cli.Database("test").Collection("chunks"), Encrypter: NopEncrypter{}}, ErrDedupEncrypted},
+		{"same chunk collection", &Store{Collection: coll, ChunkCollection: coll}, ErrInvalidConfig},
+		{"write once append only", &Store{Collection: coll, WriteOnce: true, AppendOnly: true}, ErrInvalidConfig},
+		{"conflict policy", &Store{Collection: coll, ConflictPolicy: ConflictRetry + 1}, ErrInvalidConfig},
+		{"ack level", &Store{Collection: coll, AckLevel: AckMajority + 1}, ErrInvalidConfig},
+		{"nameless codec", &Store{Collection: coll, Codec: namelessCodec{}}, ErrInvalidConfig},
+		{"nop codec", &Store{Collection: coll, Codec: NopCodec{}}, nil},
+	} {
+		if err := tc.store.Validate(); !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
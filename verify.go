@@ -0,0 +1,238 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNoChecksum is returned by Verify if a segment of the blob does not
+// have a checksum, and by DeepVerify if the blob has no checksum at
+// all, such as blobs written by older versions of this package
+var ErrNoChecksum = errors.New("No checksum")
+
+// Checksum returns the SHA-256 hash of the blob contents recorded when
+// the blob was written. The hash is copied with the blob by Snapshot.
+// It is not recomputed; use DeepVerify to check the data against it.
+// Returns ErrNoChecksum if no hash is recorded, such as for blobs
+// written by older versions of this package, by WriteParallel, or
+// modified by WriteAt.
+func (store *Store) Checksum(ctx context.Context, blobID string) ([]byte, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil || hdr.Pending {
+		exists, err := store.Collection.CountDocuments(ctx, segmentFilter(blobID))
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			return nil, notFound(blobID)
+		}
+		return nil, ErrNoChecksum
+	}
+	if hdr.SHA256 == "" {
+		return nil, ErrNoChecksum
+	}
+	return hex.DecodeString(hdr.SHA256)
+}
+
+// segmentHash is the position and the hash of a segment
+type segmentHash struct {
+	Seq   uint64 `bson:"seq"`
+	Start uint64 `bson:"s"`
+	N     uint64 `bson:"n"`
+	Hash  []byte `bson:"h"`
+}
+
+// verifier checks the continuity of the segments of a blob
+type verifier struct {
+	blobID      string
+	count, size uint64
+}
+
+// next checks that segment follows the segments checked so far
+func (v *verifier) next(segment segmentHash) error {
+	if segment.Seq != v.count {
+		return fmt.Errorf("%w: %s: expected segment %d, found %d", ErrCorrupted, v.blobID, v.count, segment.Seq)
+	}
+	if segment.Start != v.size {
+		return fmt.Errorf("%w: %s: segment %d starts at %d, expected %d", ErrCorrupted, v.blobID, v.count, segment.Start, v.size)
+	}
+	v.count++
+	v.size += segment.N
+	return nil
+}
+
+// end checks the size and the segments hash of the blob against its
+// header
+func (v *verifier) end(hdr *blobHeader, segmentsHash string) error {
+	if hdr == nil {
+		if v.count == 0 {
+			return notFound(v.blobID)
+		}
+		return nil
+	}
+	if uint64(hdr.Size) != v.size {
+		return fmt.Errorf("%w: %s: size is %d, header records %d", ErrCorrupted, v.blobID, v.size, hdr.Size)
+	}
+	if hdr.SegmentsHash != "" && hdr.SegmentsHash != segmentsHash {
+		return fmt.Errorf("%w: %s: segment hashes do not match", ErrCorrupted, v.blobID)
+	}
+	return nil
+}
+
+// Verify checks a blob using the checksums stored with its segments,
+// without fetching the segment data. It checks that the segments are
+// contiguous, that the size matches the header, and that the hash of
+// the segment checksums matches the one recorded when the blob was
+// written. This detects missing, reordered, truncated, or replaced
+// segments, but it trusts that the data of each segment matches its
+// checksum. Use DeepVerify to check the data itself. Returns an error
+// wrapping ErrCorrupted if the blob is inconsistent, or ErrNoChecksum
+// if a segment has no checksum.
+func (store *Store) Verify(ctx context.Context, blobID string) error {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	cursor, err := store.Collection.Find(ctx, segmentFilter(blobID), store.findSorted(1).
+		SetProjection(bson.M{"seq": 1, "s": 1, "n": 1, "h": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	v := verifier{blobID: blobID}
+	segmentsHash := sha256.New()
+	for cursor.Next(ctx) {
+		var segment segmentHash
+		if err := cursor.Decode(&segment); err != nil {
+			return err
+		}
+		if err := v.next(segment); err != nil {
+			return err
+		}
+		if len(segment.Hash) == 0 {
+			return fmt.Errorf("%w: %s: segment %d", ErrNoChecksum, blobID, segment.Seq)
+		}
+		segmentsHash.Write(segment.Hash)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return v.end(hdr, hex.EncodeToString(segmentsHash.Sum(nil)))
+}
+
+// DeepVerify checks a blob by fetching and decoding all of its data,
+// and recomputing its hashes. In addition to the checks of Verify, the
+// data of each segment is checked against its checksum if it has one,
+// and the hash of the whole blob is checked against the content hash
+// recorded when the blob was written. It does not trust any stored
+// checksum, so it also detects corrupted segment data, at the cost of
+// transferring the whole blob. The final segment of an encrypted blob
+// must be present. Segments without a checksum are accepted, but if
+// neither the blob nor any of its segments has a checksum, DeepVerify
+// returns an error wrapping ErrNoChecksum, since nothing recorded was
+// checked. Returns an error wrapping ErrCorrupted if the blob is
+// inconsistent.
+func (store *Store) DeepVerify(ctx context.Context, blobID string) error {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	enc, err := store.blobEncrypter(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	cursor, err := store.Collection.Find(ctx, segmentFilter(blobID), store.findSorted(1))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	v := verifier{blobID: blobID}
+	segmentsHash := sha256.New()
+	contentHash := sha256.New()
+	unfinished := false
+	checked := hdr != nil && hdr.SHA256 != ""
+	for cursor.Next(ctx) {
+		var segment segmentHash
+		if err := cursor.Decode(&segment); err != nil {
+			return err
+		}
+		if err := v.next(segment); err != nil {
+			return err
+		}
+		if err := store.verifySegment(ctx, enc, blobID, cursor.Current, segment, contentHash); err != nil {
+			return err
+		}
+		if final, ok := cursor.Current.Lookup("final").BooleanOK(); ok {
+			unfinished = !final
+		}
+		if len(segment.Hash) > 0 {
+			checked = true
+		}
+		segmentsHash.Write(segment.Hash)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if unfinished {
+		return fmt.Errorf("%w: %s: final segment is missing", ErrCorrupted, blobID)
+	}
+	if err := v.end(hdr, hex.EncodeToString(segmentsHash.Sum(nil))); err != nil {
+		return err
+	}
+	if hdr != nil && hdr.SHA256 != "" && hdr.SHA256 != hex.EncodeToString(contentHash.Sum(nil)) {
+		return fmt.Errorf("%w: %s: content hash mismatch", ErrCorrupted, blobID)
+	}
+	if !checked {
+		return fmt.Errorf("%w: %s: no checksum recorded", ErrNoChecksum, blobID)
+	}
+	return nil
+}
+
+// verifySegment decodes a raw segment and checks its data against its
+// checksum and length. The data is added to contentHash.
+func (store *Store) verifySegment(ctx context.Context, enc Encrypter, blobID string, raw bson.Raw, segment segmentHash, contentHash hash.Hash) error {
+	raw, err := store.resolveSegment(ctx, raw)
+	if err != nil {
+		return err
+	}
+	store.countSegment(raw)
+	data, err := store.decodeSegment(ctx, enc, blobID, raw)
+	if err != nil {
+		return fmt.Errorf("%w: %s: segment %d: %v", ErrCorrupted, blobID, segment.Seq, err)
+	}
+	if uint64(len(data)) != segment.N {
+		return fmt.Errorf("%w: %s: segment %d has %d bytes, expected %d", ErrCorrupted, blobID, segment.Seq, len(data), segment.N)
+	}
+	if len(segment.Hash) > 0 {
+		sum := sha256.Sum256(data)
+		if !bytes.Equal(sum[:], segment.Hash) {
+			return fmt.Errorf("%w: %s: segment %d checksum mismatch", ErrCorrupted, blobID, segment.Seq)
+		}
+	}
+	contentHash.Write(data)
+	return nil
+}
+
+// checkSegmentHash checks the decoded data of the raw segment against
+// the checksum recorded with the segment, if there is one
+func checkSegmentHash(blobID string, raw bson.Raw, data []byte) error {
+	_, recorded, ok := raw.Lookup("h").BinaryOK()
+	if !ok || len(recorded) == 0 {
+		return nil
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], recorded) {
+		seq, _ := raw.Lookup("seq").AsInt64OK()
+		return fmt.Errorf("%w: %s: segment %d checksum mismatch", ErrCorrupted, blobID, seq)
+	}
+	return nil
+}
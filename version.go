@@ -0,0 +1,213 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// versionPrefix is the prefix of the IDs under which saved versions of
+// blobs are stored
+const versionPrefix = "__versions__/"
+
+// newVersion returns a new random version token
+func newVersion() (string, error) {
+	var rnd [12]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rnd[:]), nil
+}
+
+// ReadWithVersion returns a reader for the blob, and the version of
+// the blob. The version is read before the data, so if the blob is
+// written concurrently, the data may be newer than the version, but
+// never older. Blobs written by older versions of this package have an
+// empty version.
+func (store *Store) ReadWithVersion(ctx context.Context, blobID string) (io.ReadCloser, string, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, "", err
+	}
+	rd, err := store.Read(ctx, blobID)
+	if err != nil {
+		return nil, "", err
+	}
+	if hdr == nil {
+		return rd, "", nil
+	}
+	return rd, hdr.Version, nil
+}
+
+// WriteIfVersion writes the blob only if its current version is
+// expected, and returns the new version. An empty expected version
+// matches a blob that does not exist, or a blob written by an older
+// version of this package without a version. Returns ErrConflict if
+// the version of the blob is different. The data is staged as in
+// BeginUpload, and the version check and the replacement are done in
+// a transaction. If the deployment does not support transactions, a
+// concurrent write between the check and the replacement is not
+// detected.
+func (store *Store) WriteIfVersion(ctx context.Context, blobID string, data io.Reader, expected string, opts ...WriteOption) (string, error) {
+	u, err := store.BeginUpload(ctx, blobID, opts...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := u.w.ReadFrom(data); err != nil {
+		u.Abort()
+		return "", err
+	}
+	err = u.commit(func(ctx context.Context) error {
+		hdr, err := store.getHeader(ctx, blobID)
+		if err != nil {
+			return err
+		}
+		version := ""
+		if hdr != nil {
+			version = hdr.Version
+		}
+		if version != expected {
+			return ErrConflict
+		}
+		return nil
+	})
+	if err != nil {
+		store.remove(context.Background(), u.stagingID)
+		return "", err
+	}
+	return u.w.version, nil
+}
+
+// SaveVersion saves a copy of the current contents of the blob, and
+// returns its version. Saving a version that is already saved does
+// nothing. Saved versions are kept until they are removed by
+// PruneVersions, and they are not listed as blobs. If the store has a
+// chunk collection, saved versions share the chunks of the blob, so
+// only the changed segments use additional storage.
+func (store *Store) SaveVersion(ctx context.Context, blobID string) (string, error) {
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return "", err
+	}
+	var version string
+	if hdr != nil && hdr.Version != "" {
+		version = hdr.Version
+		versions, err := store.Versions(ctx, blobID)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range versions {
+			if v == version {
+				return version, nil
+			}
+		}
+	} else if version, err = newVersion(); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%s%s/%020d/%s", versionPrefix, blobID, store.now().UnixNano(), version)
+	if err := store.Snapshot(ctx, blobID, id); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// Versions returns the saved versions of the blob, oldest first
+func (store *Store) Versions(ctx context.Context, blobID string) ([]string, error) {
+	ids, err := store.versionIDs(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, len(ids))
+	for i, id := range ids {
+		versions[i] = id[strings.LastIndexByte(id, '/')+1:]
+	}
+	return versions, nil
+}
+
+// versionIDs returns the IDs of the saved versions of the blob, oldest
+// first
+func (store *Store) versionIDs(ctx context.Context, blobID string) ([]string, error) {
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			// Versions of blobs under blobID/ have more components
+			"blobId": bson.M{"$regex": "^" + regexp.QuoteMeta(versionPrefix+blobID+"/") + `[0-9]{20}/[0-9a-f]+$`},
+			"seq":    bson.M{"$in": bson.A{headerSeq, 0}},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$blobId"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var ids []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids, cursor.Err()
+}
+
+// ReadVersion returns a reader for a saved version of the blob.
+// Returns ErrNotFound if the version is not saved.
+func (store *Store) ReadVersion(ctx context.Context, blobID, version string) (*Reader, error) {
+	ids, err := store.versionIDs(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if strings.HasSuffix(id, "/"+version) {
+			return store.Read(ctx, id)
+		}
+	}
+	return nil, notFound(blobID)
+}
+
+// PruneVersions removes all but the most recent keep saved versions
+// of the blob, and returns the number of segments removed. The blob
+// itself is not changed. Shared chunks are removed only if they are no
+// longer referenced by the blob or the other versions. If the store is
+// in DryRun mode, the segments are counted, but not removed.
+func (store *Store) PruneVersions(ctx context.Context, blobID string, keep int) (int64, error) {
+	ids, err := store.versionIDs(ctx, blobID)
+	if err != nil {
+		return 0, err
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	var removed int64
+	for len(ids) > keep {
+		id := ids[0]
+		ids = ids[1:]
+		if store.DryRun {
+			n, err := store.Collection.CountDocuments(ctx, segmentFilter(id))
+			if err != nil {
+				return removed, err
+			}
+			removed += n
+			continue
+		}
+		n, err := store.deleteSegments(ctx, segmentFilter(id))
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		if err := store.remove(ctx, id); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,117 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWriteIfVersion(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	v1, err := store.WriteIfVersion(context.Background(), "1", bytes.NewReader(randomData(1500)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, version, err := store.ReadWithVersion(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if version != v1 {
+		t.Errorf("Wrong version: %s, expected %s", version, v1)
+	}
+	data := randomData(2000)
+	v2, err := store.WriteIfVersion(context.Background(), "1", bytes.NewReader(data), v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 == v1 {
+		t.Errorf("Version not changed")
+	}
+	if _, err := store.WriteIfVersion(context.Background(), "1", bytes.NewReader(randomData(100)), v1); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	rd, _, err = store.ReadWithVersion(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	read, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Wrong data after conflict")
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	store := setupChunkStore(t)
+	defer cleanupBlobs(store)
+	defer store.ChunkCollection.Drop(context.Background())
+
+	// Each version changes the first segment only
+	rest := randomData(2048)
+	var contents [][]byte
+	var versions []string
+	for i := 0; i < 5; i++ {
+		data := append(randomData(1024), rest...)
+		if err := store.Write(context.Background(), "1", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		version, err := store.SaveVersion(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, data)
+		versions = append(versions, version)
+	}
+	// Saving again does nothing
+	if _, err := store.SaveVersion(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Versions(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 5 || saved[0] != versions[0] || saved[4] != versions[4] {
+		t.Errorf("Wrong versions: %v", saved)
+	}
+	if ids, _, err := store.ListPage(context.Background(), "", 0); err != nil || len(ids) != 1 {
+		t.Errorf("Saved versions are listed: %v %v", ids, err)
+	}
+
+	n, err := store.PruneVersions(context.Background(), "1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("Expected 6 segments removed, got %d", n)
+	}
+	if saved, _ := store.Versions(context.Background(), "1"); len(saved) != 3 || saved[0] != versions[2] {
+		t.Errorf("Wrong versions after pruning: %v", saved)
+	}
+	for i := 2; i < 5; i++ {
+		rd, err := store.ReadVersion(context.Background(), "1", versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || !bytes.Equal(read, contents[i]) {
+			t.Errorf("Version %d: wrong data: %v", i, err)
+		}
+	}
+	if _, err := store.ReadVersion(context.Background(), "1", versions[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	// The shared segments, and the first segments of the last three
+	// versions
+	if n := chunkCount(t, store); n != 5 {
+		t.Errorf("Expected 5 chunks, got %d", n)
+	}
+}
@@ -0,0 +1,42 @@
+package blobstore
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watch returns a channel that receives a value whenever the blob
+// changes. Changes are observed using a change stream, so the server
+// must be a replica set or a sharded cluster. Signals are coalesced:
+// writing many segments may produce a single signal. Removing a blob
+// is not reported, because delete events do not include the blob ID.
+// The channel is closed when ctx is done, or if the change stream
+// fails.
+func (store *Store) Watch(ctx context.Context, blobID string) (<-chan struct{}, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"operationType":       bson.M{"$in": bson.A{"insert", "update", "replace"}},
+			"fullDocument.blobId": blobID,
+			"fullDocument.seq":    bson.M{"$gte": headerSeq},
+		}}},
+	}
+	stream, err := store.Collection.Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
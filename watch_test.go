@@ -0,0 +1,61 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWatch(t *testing.T) {
+	store := setupTestStore(t)
+	defer cleanupBlobs(store)
+
+	// Change streams need a replica set or a sharded cluster
+	var hello bson.M
+	if err := store.Collection.Database().RunCommand(context.Background(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hello["setName"]; !ok && hello["msg"] != "isdbgrid" {
+		t.Skip("Not a replica set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := store.Watch(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes to other blobs are not reported
+	if err := store.Write(context.Background(), "2", bytes.NewReader(randomData(100))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+		t.Errorf("Signal for another blob")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := store.Write(context.Background(), "1", bytes.NewReader(randomData(3000))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No signal for a write")
+	}
+	// The channel is closed when the context is done
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Channel not closed")
+		}
+	}
+}
@@ -0,0 +1,948 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrWriterClosed is returned when a writer is used after it is
+// closed or aborted
+var ErrWriterClosed = errors.New("Writer closed")
+
+// Writer writes a blob incrementally. Data is buffered until a full
+// chunk is available, and then written as a segment. Close writes the
+// final partial segment and removes any segments left over from a
+// previous, larger version of the blob. A Writer must be used from a
+// single goroutine.
+type Writer struct {
+	store     *Store
+	ctx       context.Context
+	blobID    string
+	chunkSize int
+	buf       []byte
+	seq       uint64
+	start     uint64
+	closed    bool
+	aborted   bool
+	// If set, written segments expire at this time
+	expireAt time.Time
+	// The blob ID encrypted segments are bound to. This is
+	// different from blobID for staged uploads.
+	aadID string
+	// Segments are encrypted using enc, which is NopEncrypter if the
+	// store does not encrypt. keyID identifies the key if it is from
+	// the KeyProvider of the store.
+	enc   Encrypter
+	keyID string
+	// Segments are compressed using codec, which is NopCodec if the
+	// store does not compress. The codec is replaced with NopCodec if
+	// the first segment does not compress well.
+	codec        Codec
+	codecChecked bool
+	// Number of bytes stored for the blob. If resumed, the stored
+	// size of the kept segments is not known.
+	stored        int64
+	storedUnknown bool
+	// If set, buffered data is persisted as a partial segment every
+	// flushEvery, or after flushBytes are written. unflushed is the
+	// number of buffered bytes not yet persisted.
+	flushEvery  time.Duration
+	flushBytes  int
+	flushMargin time.Duration
+	lastFlush   time.Time
+	unflushed   int
+	// Set if the segment at seq is already written by this writer,
+	// so it is replaced even with DetectConflicts
+	replace bool
+	// The version of the blob written by Close
+	version string
+	// If set, the hash of the data written so far, and the hash of the
+	// segment hashes. They are nil if the writer does not write the
+	// whole blob in order.
+	hash         hash.Hash
+	segmentsHash hash.Hash
+	// If final is set, the next segment written is the last segment of
+	// the blob. sealed is set once the last segment is written.
+	final  bool
+	sealed bool
+	// The content type recorded in the header, and the modification
+	// time recorded by Close
+	contentType string
+	modTime     time.Time
+	// If setMeta is set, Close replaces the user metadata with meta
+	meta    bson.M
+	setMeta bool
+	// closeErr is the result of the first Close
+	closeErr error
+	// If resumed is set, the writer continues an existing blob, and
+	// Abort restores the blob instead of removing it. unsealed is set
+	// if the final marker of the segment before the writer was cleared.
+	resumed  *resumePoint
+	unsealed bool
+	// inflight are the segments being written by goroutines, in
+	// order, if the store has a WriteConcurrency. writeErr is the
+	// first error writing them, and free holds buffers to reuse.
+	inflight []*pendingSegment
+	writeErr error
+	free     [][]byte
+}
+
+// resumePoint is where a writer continued a blob. seq is the first
+// segment written by the writer. If data is set, the writer completes
+// the partial segment at seq, which started at start with data and the
+// final marker final.
+type resumePoint struct {
+	seq   uint64
+	start uint64
+	data  []byte
+	final bool
+}
+
+// pendingSegment is a segment written by a goroutine. done is closed
+// when the segment is written.
+type pendingSegment struct {
+	done    chan struct{}
+	data    []byte
+	segment blobSegment
+	err     error
+}
+
+// NewWriter returns a writer for the blob. The blob is overwritten as
+// data is written to the writer. The writer must be closed to
+// complete the blob.
+func (store *Store) NewWriter(ctx context.Context, blobID string, opts ...WriteOption) (*Writer, error) {
+	if err := store.checkWritable(ctx, blobID); err != nil {
+		return nil, err
+	}
+	return store.openWriter(ctx, blobID, blobID, opts...)
+}
+
+// openWriter returns a writer for blobID, with segments encrypted for
+// aadID
+func (store *Store) openWriter(ctx context.Context, blobID, aadID string, opts ...WriteOption) (*Writer, error) {
+	if err := store.checkDedup(); err != nil {
+		return nil, err
+	}
+	if err := store.autoIndex(ctx); err != nil {
+		return nil, err
+	}
+	if err := store.requireIndex(ctx); err != nil {
+		return nil, err
+	}
+	var wopts writeOptions
+	for _, opt := range opts {
+		opt(&wopts)
+	}
+	chunkSize, err := store.chunkSize(wopts)
+	if err != nil {
+		return nil, err
+	}
+	w := store.newWriter(ctx, blobID, chunkSize)
+	w.setFlush(wopts)
+	w.meta, w.setMeta = wopts.meta, wopts.metaSet
+	if wopts.codecSet {
+		w.codec = codecOrNop(wopts.codec)
+	}
+	w.expireAt = wopts.expireAt
+	w.aadID = aadID
+	w.hash = sha256.New()
+	w.segmentsHash = sha256.New()
+	enc, keyID, err := store.writeEncrypter(ctx, aadID)
+	if err != nil {
+		return nil, err
+	}
+	w.enc, w.keyID = encrypterOrNop(enc), keyID
+	return w, nil
+}
+
+func (store *Store) newWriter(ctx context.Context, blobID string, chunkSize int) *Writer {
+	return &Writer{
+		store:     store,
+		ctx:       ctx,
+		blobID:    blobID,
+		aadID:     blobID,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+		codec:     codecOrNop(store.Codec),
+		enc:       NopEncrypter{},
+	}
+}
+
+// setFlush sets the periodic flush options of the writer
+func (w *Writer) setFlush(opts writeOptions) {
+	w.flushEvery = opts.flushEvery
+	w.flushBytes = opts.flushBytes
+	w.flushMargin = opts.flushMargin
+	w.lastFlush = w.store.now()
+}
+
+// Resume continues an interrupted write of a blob. The first
+// alreadyWritten bytes of the blob are kept, and data is written
+// after them. data must start at offset alreadyWritten of the blob
+// contents. If alreadyWritten is not at a chunk boundary, the partial
+// chunk is read back and completed with data. The chunk size of the
+// blob is used if it is known, otherwise the chunk size is determined
+// as in Write.
+func (store *Store) Resume(ctx context.Context, blobID string, data io.Reader, alreadyWritten int64, opts ...WriteOption) error {
+	if alreadyWritten < 0 {
+		return ErrInvalidRange
+	}
+	if store.WriteOnce {
+		return ErrImmutable
+	}
+	if store.AppendOnly {
+		return ErrAppendOnly
+	}
+	return store.resume(ctx, blobID, data, alreadyWritten, opts...)
+}
+
+// resume continues writing the blob at alreadyWritten
+func (store *Store) resume(ctx context.Context, blobID string, data io.Reader, alreadyWritten int64, opts ...WriteOption) error {
+	w, err := store.resumeWriter(ctx, blobID, alreadyWritten, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.ReadFrom(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// resumeWriter returns a writer positioned at alreadyWritten of the
+// blob. A partial segment containing alreadyWritten is completed by
+// the writer.
+func (store *Store) resumeWriter(ctx context.Context, blobID string, alreadyWritten int64, opts ...WriteOption) (*Writer, error) {
+	if alreadyWritten == 0 {
+		return store.openWriter(ctx, blobID, blobID, opts...)
+	}
+	w, enc, err := store.continueWriter(ctx, blobID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := w.chunkSize
+	// Find the segment containing the last byte already written
+	raw, err := store.Collection.FindOne(ctx, bson.M{"blobId": blobID, "seq": bson.M{"$gte": 0}, "s": bson.M{"$lt": alreadyWritten}},
+		options.FindOne().SetSort(bson.M{"seq": -1})).DecodeBytes()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, notFound(blobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segment segmentPos
+	if err := bson.Unmarshal(raw, &segment); err != nil {
+		return nil, err
+	}
+	final, _ := raw.Lookup("final").BooleanOK()
+	if raw, err = store.resolveSegment(ctx, raw); err != nil {
+		return nil, err
+	}
+	store.countSegment(raw)
+	written, err := store.decodeSegment(ctx, enc, blobID, raw)
+	if err != nil {
+		return nil, err
+	}
+	if segment.Start+segment.N < uint64(alreadyWritten) {
+		return nil, ErrInvalidRange
+	}
+	keep := uint64(alreadyWritten) - segment.Start
+	switch {
+	case keep == segment.N && keep >= uint64(chunkSize):
+		// The segment is complete, continue with the next one
+		w.seq = segment.Seq + 1
+		w.start = uint64(alreadyWritten)
+		w.resumed = &resumePoint{seq: w.seq}
+		if err := w.unseal(); err != nil {
+			return nil, err
+		}
+	case keep <= uint64(chunkSize):
+		// Complete the partial chunk
+		w.seq = segment.Seq
+		w.start = segment.Start
+		w.buf = append(w.buf, written[:keep]...)
+		w.replace = true
+		w.resumed = &resumePoint{seq: w.seq, start: w.start, data: append([]byte(nil), written[:keep]...), final: final}
+	default:
+		// The segment is larger than the chunk size, truncate it
+		w.seq = segment.Seq
+		w.start = segment.Start
+		w.buf = written[:keep]
+		w.replace = true
+		if err := w.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// continueWriter returns a writer that continues an existing blob
+// with the chunk size, key and codec of the blob, and the encrypter
+// for its existing segments. The position of the writer is not set.
+func (store *Store) continueWriter(ctx context.Context, blobID string, opts ...WriteOption) (*Writer, Encrypter, error) {
+	if err := store.checkDedup(); err != nil {
+		return nil, nil, err
+	}
+	if err := store.autoIndex(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := store.requireIndex(ctx); err != nil {
+		return nil, nil, err
+	}
+	var wopts writeOptions
+	for _, opt := range opts {
+		opt(&wopts)
+	}
+	chunkSize, err := store.chunkSize(wopts)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr, err := store.getHeader(ctx, blobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !wopts.chunkSizeSet && hdr != nil && hdr.ChunkSize > 0 {
+		chunkSize = hdr.ChunkSize
+	}
+	// Continue with the key the blob was encrypted with
+	enc, err := store.readEncrypter(ctx, blobID, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := store.newWriter(ctx, blobID, chunkSize)
+	w.setFlush(wopts)
+	w.meta, w.setMeta = wopts.meta, wopts.metaSet
+	w.enc = encrypterOrNop(enc)
+	if hdr != nil {
+		w.keyID = hdr.KeyID
+		w.contentType = hdr.ContentType
+		w.expireAt = hdr.ExpireAt
+		// Continue with the compression of the blob
+		w.codec = NopCodec{}
+		if hdr.Codec != "" {
+			if w.codec, err = store.codec(hdr.Codec); err != nil {
+				return nil, nil, err
+			}
+		}
+		w.codecChecked = true
+	}
+	w.storedUnknown = true
+	return w, enc, nil
+}
+
+// Write writes p to the blob. Full chunks are written to the database
+// as they become available.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if err := w.buffered(n); err != nil {
+			return written, w.fail(err)
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom reads data from r until EOF and writes it to the blob. The
+// data is read in chunk-sized pieces. Returns the number of bytes read.
+// If r repeatedly returns no data and no error, ReadFrom fails with
+// io.ErrNoProgress, see MaxEmptyReads.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	r = w.store.progressReader(r)
+	var total int64
+	for {
+		var n int
+		var err error
+		if w.flushEvery > 0 || w.flushBytes > 0 || w.flushMargin > 0 {
+			// Do not wait for a full chunk, so periodic flushes can
+			// happen
+			n, err = r.Read(w.buf[len(w.buf):w.chunkSize])
+		} else {
+			n, err = io.ReadFull(r, w.buf[len(w.buf):w.chunkSize])
+		}
+		w.buf = w.buf[:len(w.buf)+n]
+		total += int64(n)
+		if err := w.buffered(n); err != nil {
+			return total, w.fail(err)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, w.fail(err)
+		}
+	}
+}
+
+// buffered is called after n bytes are added to the buffer. It
+// writes the buffer if the chunk is full, or if a periodic flush is
+// due.
+func (w *Writer) buffered(n int) error {
+	w.unflushed += n
+	if len(w.buf) == w.chunkSize {
+		return w.flush()
+	}
+	if w.unflushed == 0 {
+		return nil
+	}
+	if (w.flushBytes > 0 && w.unflushed >= w.flushBytes) ||
+		(w.flushEvery > 0 && w.store.now().Sub(w.lastFlush) >= w.flushEvery) ||
+		w.nearDeadline() {
+		_, err := w.writeSegment()
+		return err
+	}
+	return nil
+}
+
+// nearDeadline returns if the writer flushes before the deadline of its
+// context, and the deadline is within the margin
+func (w *Writer) nearDeadline() bool {
+	if w.flushMargin <= 0 {
+		return false
+	}
+	deadline, ok := w.ctx.Deadline()
+	return ok && !w.store.now().Before(deadline.Add(-w.flushMargin))
+}
+
+// flush writes the buffered data as the next segment
+func (w *Writer) flush() error {
+	if w.concurrent() {
+		return w.flushConcurrent()
+	}
+	if err := w.waitSegments(0); err != nil {
+		return err
+	}
+	segment, err := w.writeSegment()
+	if err != nil {
+		return err
+	}
+	w.advance(segment, w.buf)
+	w.buf = w.buf[:0]
+	w.replace = false
+	return nil
+}
+
+// advance moves the writer past a written segment with the plaintext
+// data
+func (w *Writer) advance(segment blobSegment, data []byte) {
+	w.seq++
+	w.start += segment.N
+	w.stored += int64(len(segment.Data))
+	if w.hash != nil {
+		w.hash.Write(data)
+	}
+	if w.segmentsHash != nil {
+		w.segmentsHash.Write(segment.Hash)
+	}
+}
+
+// concurrent returns if the buffered data can be written by a
+// goroutine. The first segment is written in place, so the codec is
+// checked before segments are encoded concurrently. Final segments,
+// segments replacing a partial segment, and writers with periodic
+// flushes or conflict detection write in place as well.
+func (w *Writer) concurrent() bool {
+	return w.store.WriteConcurrency > 1 && w.seq > 0 && w.codecChecked &&
+		!w.final && !w.replace && !w.store.DetectConflicts &&
+		w.flushEvery == 0 && w.flushBytes == 0 && w.flushMargin == 0
+}
+
+// flushConcurrent hands the buffered data to a goroutine that writes
+// it as the next segment, after waiting until fewer than
+// WriteConcurrency segments are being written. The position and the
+// content hash of the writer are advanced in order; the stored size
+// and the segments hash are updated as the segments are written.
+func (w *Writer) flushConcurrent() error {
+	if err := w.checkChunks(w.seq); err != nil {
+		return err
+	}
+	if err := w.waitSegments(w.store.WriteConcurrency - 1); err != nil {
+		return err
+	}
+	p := &pendingSegment{done: make(chan struct{}), data: w.buf}
+	ctx, seq, start := w.ctx, w.seq, w.start
+	go func() {
+		defer close(p.done)
+		p.segment, p.err = w.encode(seq, start, p.data, false)
+		if p.err == nil {
+			p.err = w.put(ctx, p.segment, p.data, false)
+		}
+	}()
+	w.inflight = append(w.inflight, p)
+	w.seq++
+	w.start += uint64(len(p.data))
+	if w.hash != nil {
+		w.hash.Write(p.data)
+	}
+	if n := len(w.free); n > 0 {
+		w.buf = w.free[n-1][:0]
+		w.free = w.free[:n-1]
+	} else {
+		w.buf = make([]byte, 0, w.chunkSize)
+	}
+	w.unflushed = 0
+	w.lastFlush = w.store.now()
+	return nil
+}
+
+// waitSegments waits until at most n segments are being written by
+// goroutines. If writing a segment failed, it waits for all of them,
+// and returns the error. The error is returned by all later calls.
+func (w *Writer) waitSegments(n int) error {
+	for w.writeErr == nil && len(w.inflight) > n {
+		p := w.inflight[0]
+		<-p.done
+		w.inflight = w.inflight[1:]
+		if p.err != nil {
+			w.writeErr = p.err
+			break
+		}
+		w.stored += int64(len(p.segment.Data))
+		if w.segmentsHash != nil {
+			w.segmentsHash.Write(p.segment.Hash)
+		}
+		w.free = append(w.free, p.data)
+	}
+	if w.writeErr != nil {
+		for _, p := range w.inflight {
+			<-p.done
+		}
+		w.inflight = nil
+	}
+	return w.writeErr
+}
+
+// fail waits for the segments being written when a write fails with
+// err, so no segment is stored after the write returns. Returns err.
+func (w *Writer) fail(err error) error {
+	w.waitSegments(0)
+	return err
+}
+
+// writeSegment writes the buffered data as the current segment,
+// without consuming the buffer
+func (w *Writer) writeSegment() (blobSegment, error) {
+	if err := w.checkChunks(w.seq); err != nil {
+		return blobSegment{}, err
+	}
+	segment, err := w.encode(w.seq, w.start, w.buf, w.final)
+	if err != nil {
+		return segment, err
+	}
+	if err := w.put(w.ctx, segment, w.buf, w.replace); err != nil {
+		return segment, err
+	}
+	w.sealed = w.final
+	w.replace = true
+	w.unflushed = 0
+	w.lastFlush = w.store.now()
+	return segment, nil
+}
+
+// checkChunks returns an error wrapping ErrTooManyChunks if the
+// segment seq is beyond the MaxChunks limit of the store
+func (w *Writer) checkChunks(seq uint64) error {
+	if w.store.MaxChunks > 0 && seq >= uint64(w.store.MaxChunks) {
+		return fmt.Errorf("%w: %s: limit is %d", ErrTooManyChunks, w.blobID, w.store.MaxChunks)
+	}
+	return nil
+}
+
+// encode returns the compressed and encrypted segment for data. final
+// marks the last segment of the blob. Once the codec is checked,
+// encode does not modify the writer, and it can be called
+// concurrently.
+func (w *Writer) encode(seq, start uint64, data []byte, final bool) (blobSegment, error) {
+	sum := sha256.Sum256(data)
+	segment := blobSegment{
+		Hash:     sum[:],
+		ID:       w.blobID,
+		Seq:      seq,
+		Data:     data,
+		Start:    start,
+		N:        uint64(len(data)),
+		ExpireAt: w.expireAt,
+	}
+	compressed, err := compress(w.ctx, w.codec, data)
+	if err != nil {
+		return segment, err
+	}
+	if !w.codecChecked && w.store.incompressible(len(data), len(compressed)) {
+		w.codec = NopCodec{}
+	} else {
+		segment.Data = compressed
+		segment.Codec = w.codec.Name()
+	}
+	w.codecChecked = true
+	nonce, ciphertext, err := encrypt(w.ctx, w.enc, segment.Data, finalAAD(w.aadID, seq, final))
+	if err != nil {
+		return segment, err
+	}
+	segment.Data = ciphertext
+	// Only encrypted segments are marked final, since the marker is
+	// authenticated with the data
+	if nonce != nil {
+		segment.Nonce = nonce
+		segment.Final = &final
+	}
+	return segment, nil
+}
+
+// put stores an encoded segment with the plaintext data. If replace
+// is not set and the store detects conflicts, the segment must not
+// exist, or it must have the same data.
+func (w *Writer) put(ctx context.Context, segment blobSegment, data []byte, replace bool) error {
+	if w.store.ChunkCollection != nil {
+		return w.putRef(ctx, segment, data, replace)
+	}
+	var err error
+	if w.store.DetectConflicts && !replace {
+		_, err = w.store.Collection.InsertOne(ctx, segment)
+		if mongo.IsDuplicateKeyError(err) {
+			// A concurrent writer storing the same data is not a
+			// conflict
+			same, err := w.sameSegment(ctx, segment, data)
+			if err != nil {
+				return err
+			}
+			if same {
+				return nil
+			}
+			return ErrConflict
+		}
+	} else if segment.Nonce != nil {
+		_, err = w.store.Collection.ReplaceOne(ctx, bson.M{"blobId": segment.ID, "seq": segment.Seq}, segment, options.Replace().SetUpsert(true))
+	} else {
+		var coll *mongo.Collection
+		if coll, err = w.store.ackCollection(); err == nil {
+			_, err = coll.ReplaceOne(ctx, bson.M{"blobId": segment.ID, "seq": segment.Seq}, segment, options.Replace().SetUpsert(true))
+			err = ackError(err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	w.store.countBytes("write", len(segment.Data))
+	return nil
+}
+
+// putRef stores the data of an encoded segment in the chunk
+// collection, and the segment with a reference to the chunk. The
+// reference to the chunk of a replaced segment is released.
+func (w *Writer) putRef(ctx context.Context, segment blobSegment, data []byte, replace bool) error {
+	// The chunk key is the hash of the data
+	ref := hex.EncodeToString(segment.Hash)
+	if err := w.store.putChunk(ctx, ref, segment.Data, segment.Codec); err != nil {
+		return err
+	}
+	w.store.countBytes("write", len(segment.Data))
+	segment.Ref = ref
+	segment.Data = nil
+	segment.Codec = ""
+	release := func(err error) error {
+		if rerr := w.store.releaseChunks(ctx, map[string]int64{ref: 1}); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if w.store.DetectConflicts && !replace {
+		_, err := w.store.Collection.InsertOne(ctx, segment)
+		if mongo.IsDuplicateKeyError(err) {
+			same, err := w.sameSegment(ctx, segment, data)
+			if err != nil {
+				return release(err)
+			}
+			if same {
+				return release(nil)
+			}
+			return release(ErrConflict)
+		}
+		if err != nil {
+			return release(err)
+		}
+		return nil
+	}
+	var old blobSegment
+	err := w.store.Collection.FindOneAndReplace(ctx, bson.M{"blobId": segment.ID, "seq": segment.Seq}, segment,
+		options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.Before).SetProjection(bson.M{"ref": 1})).Decode(&old)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return release(err)
+	}
+	if old.Ref != "" {
+		return w.store.releaseChunks(ctx, map[string]int64{old.Ref: 1})
+	}
+	return nil
+}
+
+// sameSegment returns if the stored segment at the position of
+// segment has the given plaintext data
+func (w *Writer) sameSegment(ctx context.Context, segment blobSegment, data []byte) (bool, error) {
+	raw, err := w.store.Collection.FindOne(ctx, bson.M{"blobId": segment.ID, "seq": segment.Seq}).DecodeBytes()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Removed since the insert failed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var pos segmentPos
+	if err := bson.Unmarshal(raw, &pos); err != nil {
+		return false, err
+	}
+	if pos.Start != segment.Start || pos.N != segment.N {
+		return false, nil
+	}
+	if raw, err = w.store.resolveSegment(ctx, raw); err != nil {
+		return false, err
+	}
+	stored, err := w.store.decodeSegment(ctx, w.enc, w.aadID, raw)
+	if err != nil {
+		// Not readable with the key of this writer
+		return false, nil
+	}
+	return bytes.Equal(stored, data), nil
+}
+
+// Close writes any buffered data, and removes the segments of the
+// previous version of the blob beyond the new end. Calling Close more
+// than once has no effect, later calls return the result of the first.
+// Close returns ErrWriterClosed if the writer was aborted.
+func (w *Writer) Close() error {
+	if w.aborted {
+		return ErrWriterClosed
+	}
+	if w.closed {
+		return w.closeErr
+	}
+	w.closed = true
+	w.closeErr = w.close()
+	return w.closeErr
+}
+
+func (w *Writer) close() error {
+	if w.nearDeadline() {
+		// Finish with a detached context, so the buffered data is not
+		// lost when the context times out
+		ctx, cancel := context.WithTimeout(context.Background(), w.flushMargin)
+		defer cancel()
+		w.ctx = ctx
+	}
+	if err := w.waitSegments(0); err != nil {
+		return err
+	}
+	w.final = true
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	} else if w.encrypts() && w.seq > 0 && !w.sealed {
+		if err := w.seal(); err != nil {
+			return err
+		}
+	}
+	// Remove remaining segments
+	_, err := w.store.deleteSegments(w.ctx, bson.M{"blobId": w.blobID, "seq": bson.M{"$gte": w.seq}})
+	if err != nil {
+		return err
+	}
+	update, err := w.headerUpdate()
+	if err != nil {
+		return err
+	}
+	if _, err := w.store.Collection.UpdateOne(w.ctx, headerFilter(w.blobID), update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+	w.store.verifyLater(w.blobID, w.version)
+	return nil
+}
+
+// encrypts returns if the writer encrypts segments, so the last
+// segment has to be marked final
+func (w *Writer) encrypts() bool {
+	_, nop := w.enc.(NopEncrypter)
+	return !nop
+}
+
+// seal rewrites the last segment written as the final segment. This is
+// needed if the blob ends at a segment boundary, since full segments
+// are written before it is known that no more data follows.
+func (w *Writer) seal() error {
+	if _, err := w.markPrevious(true); err != nil {
+		return err
+	}
+	w.sealed = true
+	return nil
+}
+
+// unseal rewrites the segment before the position of the writer as not
+// final, before the writer continues an encrypted blob past its last
+// segment. Otherwise the blob could be truncated back to that segment
+// unnoticed. This is the reverse of seal.
+func (w *Writer) unseal() error {
+	if !w.encrypts() || w.seq == 0 {
+		return nil
+	}
+	unsealed, err := w.markPrevious(false)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Nothing to continue
+		return nil
+	}
+	w.unsealed = unsealed
+	return err
+}
+
+// markPrevious rewrites the segment before the position of the writer
+// with the final marker set to final, unless it is already marked so.
+// A segment without a marker is not final. Segments that are not
+// encrypted are left alone, since they cannot have a marker. Returns
+// if the segment was rewritten.
+func (w *Writer) markPrevious(final bool) (bool, error) {
+	raw, err := w.store.Collection.FindOne(w.ctx, bson.M{"blobId": w.blobID, "seq": w.seq - 1}).DecodeBytes()
+	if err != nil {
+		return false, err
+	}
+	if _, err := raw.LookupErr("nonce"); err != nil {
+		return false, nil
+	}
+	if marked, _ := raw.Lookup("final").BooleanOK(); marked == final {
+		return false, nil
+	}
+	var pos segmentPos
+	if err := bson.Unmarshal(raw, &pos); err != nil {
+		return false, err
+	}
+	w.store.countSegment(raw)
+	data, err := w.store.decodeSegment(w.ctx, w.enc, w.aadID, raw)
+	if err != nil {
+		return false, err
+	}
+	segment, err := w.encode(pos.Seq, pos.Start, data, final)
+	if err != nil {
+		return false, err
+	}
+	return true, w.put(w.ctx, segment, data, true)
+}
+
+// headerUpdate returns the update of the header of the blob written by
+// the writer. It also completes a reservation of the blob.
+func (w *Writer) headerUpdate() (bson.M, error) {
+	fields, err := w.headerFields()
+	if err != nil {
+		return nil, err
+	}
+	unset := bson.M{"pending": ""}
+	if w.expireAt.IsZero() {
+		unset["expireAt"] = ""
+	}
+	return bson.M{"$set": fields, "$unset": unset, "$setOnInsert": bson.M{"createdAt": w.modTime}}, nil
+}
+
+// headerFields returns the header fields of the blob written by the
+// writer, with a new version
+func (w *Writer) headerFields() (bson.M, error) {
+	fields := bson.M{"chunkSize": w.chunkSize, "size": int64(w.start)}
+	if w.storedUnknown {
+		fields["storedSize"] = int64(-1)
+	} else {
+		fields["storedSize"] = w.stored
+	}
+	if !w.expireAt.IsZero() {
+		fields["expireAt"] = w.expireAt
+	}
+	if w.keyID != "" {
+		fields["keyId"] = w.keyID
+	}
+	var err error
+	if w.version, err = newVersion(); err != nil {
+		return nil, err
+	}
+	fields["version"] = w.version
+	w.modTime = w.store.now()
+	fields["updatedAt"] = w.modTime
+	fields["contentType"] = w.contentType
+	if w.setMeta {
+		fields[metaField] = w.meta
+	}
+	if w.hash != nil {
+		fields["sha256"] = hex.EncodeToString(w.hash.Sum(nil))
+	} else {
+		fields["sha256"] = ""
+	}
+	if w.segmentsHash != nil {
+		fields["segmentsHash"] = hex.EncodeToString(w.segmentsHash.Sum(nil))
+	} else {
+		fields["segmentsHash"] = ""
+	}
+	fields["codec"] = w.codec.Name()
+	return fields, nil
+}
+
+// Abort discards the blob. Since the segments written so far have
+// already replaced the segments of the previous version, the whole blob
+// is removed, not only the segments written by this writer. A writer
+// continuing a blob, such as one returned by NewAppendWriter, removes
+// only the segments it wrote instead, and restores the blob as it was
+// when the writer was opened. If the context of the writer is already
+// canceled, a background context is used. After Abort, the writer
+// cannot be used, and all further operations return ErrWriterClosed.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	w.aborted = true
+	w.waitSegments(0)
+	w.buf = nil
+	ctx := w.ctx
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	if w.resumed != nil {
+		return w.restore(ctx)
+	}
+	return w.store.remove(ctx, w.blobID)
+}
+
+// restore removes the segments written by a writer continuing a blob,
+// and rewrites the segment it continued from as it was
+func (w *Writer) restore(ctx context.Context) error {
+	p := w.resumed
+	if _, err := w.store.deleteSegments(ctx, bson.M{"blobId": w.blobID, "seq": bson.M{"$gte": p.seq}}); err != nil {
+		return err
+	}
+	w.ctx = ctx
+	if p.data != nil {
+		segment, err := w.encode(p.seq, p.start, p.data, p.final)
+		if err != nil {
+			return err
+		}
+		return w.put(ctx, segment, p.data, true)
+	}
+	if w.unsealed {
+		w.seq = p.seq
+		return w.seal()
+	}
+	return nil
+}
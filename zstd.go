@@ -0,0 +1,219 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrInvalidDictionary is returned for data that is not a zstd
+// dictionary
+var ErrInvalidDictionary = errors.New("Invalid zstd dictionary")
+
+var zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+func init() {
+	RegisterCodec(&ZstdCodec{})
+}
+
+// ZstdCodec compresses segments using zstd, optionally with a shared
+// dictionary. A dictionary improves compression of many small, similar
+// blobs. The name of a codec with a dictionary includes the dictionary
+// ID, so it is recorded with every segment and in the blob header. To
+// read the blobs, register the codec with RegisterCodec, or set it as
+// the Codec of the store. Dictionaries can be trained from sample
+// blobs using TrainZstdDictionary, or the zstd command line tool with
+// --train.
+type ZstdCodec struct {
+	dict []byte
+	id   uint32
+
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+// NewZstdCodec returns a zstd codec using the dictionary, which can be
+// nil
+func NewZstdCodec(dict []byte) (*ZstdCodec, error) {
+	if dict == nil {
+		return &ZstdCodec{}, nil
+	}
+	id, err := ZstdDictionaryID(dict)
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdCodec{dict: dict, id: id}, nil
+}
+
+// ZstdDictionaryID returns the ID of a zstd dictionary
+func ZstdDictionaryID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || !bytes.Equal(dict[:4], zstdDictMagic) {
+		return 0, ErrInvalidDictionary
+	}
+	id := binary.LittleEndian.Uint32(dict[4:8])
+	if id == 0 {
+		return 0, ErrInvalidDictionary
+	}
+	return id, nil
+}
+
+// Name returns "zstd", or "zstd:<id>" if the codec has a dictionary
+func (c *ZstdCodec) Name() string {
+	if c.dict == nil {
+		return "zstd"
+	}
+	return "zstd:" + strconv.FormatUint(uint64(c.id), 10)
+}
+
+// init creates the encoder and the decoder, which are safe for
+// concurrent use
+func (c *ZstdCodec) init() error {
+	c.once.Do(func() {
+		var eopts []zstd.EOption
+		var dopts []zstd.DOption
+		if c.dict != nil {
+			eopts = append(eopts, zstd.WithEncoderDict(c.dict))
+			dopts = append(dopts, zstd.WithDecoderDicts(c.dict))
+		}
+		if c.enc, c.err = zstd.NewWriter(nil, eopts...); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, dopts...)
+	})
+	return c.err
+}
+
+// Compress compresses data using zstd
+func (c *ZstdCodec) Compress(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+// Decompress decompresses zstd data
+func (c *ZstdCodec) Decompress(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(data, nil)
+}
+
+// ErrNoSamples is returned when training a dictionary without sample
+// data
+var ErrNoSamples = errors.New("No samples to train the dictionary")
+
+// Defaults of ZstdTrainOptions
+const (
+	DefaultZstdTrainSamples    = 1000
+	DefaultZstdTrainSampleSize = 128 * 1024
+	DefaultZstdDictionarySize  = 64 * 1024
+)
+
+// ZstdTrainOptions selects the blobs sampled by TrainZstdDictionary
+type ZstdTrainOptions struct {
+	// Prefix, if set, samples only the blobs whose ID starts with it
+	Prefix string
+	// Samples is the number of blobs sampled. If zero,
+	// DefaultZstdTrainSamples is used.
+	Samples int
+	// SampleSize is the number of bytes read from the start of each
+	// sampled blob. If zero, DefaultZstdTrainSampleSize is used.
+	SampleSize int
+	// DictionarySize is the maximum size of the dictionary. If zero,
+	// DefaultZstdDictionarySize is used.
+	DictionarySize int
+}
+
+// BuildZstdDictionary builds a zstd dictionary of at most maxSize
+// bytes from the samples, using the klauspost/compress dictionary
+// builder. The dictionary gets a random ID. If maxSize is not
+// positive, DefaultZstdDictionarySize is used.
+func BuildZstdDictionary(samples [][]byte, maxSize int) ([]byte, error) {
+	var input [][]byte
+	for _, sample := range samples {
+		if len(sample) > 0 {
+			input = append(input, sample)
+		}
+	}
+	if len(input) == 0 {
+		return nil, ErrNoSamples
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultZstdDictionarySize
+	}
+	return dict.BuildZstdDict(input, dict.Options{MaxDictSize: maxSize, HashBytes: 6})
+}
+
+// TrainZstdDictionary builds a zstd dictionary from a random sample of
+// the blobs of the store. The start of each sampled blob is read, and
+// decompressed and decrypted as usual. Use the dictionary with
+// NewZstdCodec, and keep it to read the blobs compressed with it.
+func (store *Store) TrainZstdDictionary(ctx context.Context, opts ZstdTrainOptions) ([]byte, error) {
+	if opts.Samples <= 0 {
+		opts.Samples = DefaultZstdTrainSamples
+	}
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = DefaultZstdTrainSampleSize
+	}
+	// Every written blob has a first segment
+	cursor, err := store.Collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$and": bson.A{
+				bson.M{"blobId": prefixFilter(opts.Prefix)},
+				bson.M{"blobId": notInternal()},
+			},
+			"seq": 0,
+		}}},
+		{{Key: "$sample", Value: bson.M{"size": opts.Samples}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "blobId": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID string `bson:"blobId"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			cursor.Close(ctx)
+			return nil, err
+		}
+		ids = append(ids, doc.ID)
+	}
+	err = cursor.Err()
+	cursor.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		rd, err := store.ReadRange(ctx, id, 0, int64(opts.SampleSize))
+		if errors.Is(err, ErrNotFound) {
+			// Removed since it was sampled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sample, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return BuildZstdDictionary(samples, opts.DictionarySize)
+}